@@ -3,13 +3,13 @@
 package noise
 
 import (
+	"context"
 	"crypto"
 	"crypto/rand"
 	"encoding/hex"
 	"errors"
 	"io/ioutil"
 	"net"
-	"time"
 
 	"golang.org/x/crypto/ed25519"
 )
@@ -33,29 +33,55 @@ func Client(conn net.Conn, config *Config) *Conn {
 // A listener implements a network listener (net.Listener) for Noise connections.
 type listener struct {
 	net.Listener
-	config *Config
+	config  *Config
+	cookies *cookieJar
+	// set if the listener runs the handshakes, see listener.go
+	workers *handshakeWorkers
 }
 
 // Accept waits for and returns the next incoming Noise connection.
-// The returned connection is of type *Conn.
+// The returned connection is of type *Conn. With Config.HandshakeWorkers,
+// its handshake is already complete.
 func (l *listener) Accept() (net.Conn, error) {
+	if l.workers != nil {
+		return l.workers.accept()
+	}
 	c, err := l.Listener.Accept()
 	if err != nil {
 		return nil, err
 	}
-	return Server(c, l.config), nil
+	conn := Server(c, l.config)
+	conn.cookies = l.cookies
+	return conn, nil
+}
+
+// Close closes the listener, and the connections whose handshake is run by
+// the listener and that were not returned by Accept yet.
+func (l *listener) Close() error {
+	if l.workers != nil {
+		l.workers.cancel()
+	}
+	return l.Listener.Close()
 }
 
 // Listen creates a Noise listener accepting connections on the
 // given network address using net.Listen.
-// The configuration config must be non-nil.
+// The configuration config must be non-nil, an invalid configuration is
+// reported with an error of kind ErrConfig. If config.GetConfigForClient
+// is set, the configurations it returns are only checked during the
+// handshakes.
 func Listen(network, laddr string, config *Config) (net.Listener, error) {
 	// check Config
 	if config == nil {
-		return nil, errors.New("Noise: no Config set")
+		return nil, errNoConfig
 	}
-	if err := checkRequirements(false, config); err != nil {
-		panic(err)
+	if config.GetConfigForClient == nil {
+		if err := checkRequirements(false, config); err != nil {
+			return nil, err
+		}
+	}
+	if config.HandshakeWorkers < 0 || config.HandshakesPerIP < 0 {
+		return nil, configError("noise: HandshakeWorkers and HandshakesPerIP cannot be negative")
 	}
 
 	// make net.Conn listen
@@ -68,39 +94,105 @@ func Listen(network, laddr string, config *Config) (net.Listener, error) {
 	noiseListener := new(listener)
 	noiseListener.Listener = l
 	noiseListener.config = config
+	noiseListener.cookies = new(cookieJar)
+	if config.HandshakeWorkers > 0 {
+		noiseListener.workers = newHandshakeWorkers()
+		go noiseListener.serve()
+	}
 	return noiseListener, nil
 }
 
+// ClientInfo describes a client to Config.GetConfigForClient.
+type ClientInfo struct {
+	// RemoteAddr is the network address of the client
+	RemoteAddr net.Addr
+	// NegotiationData is the negotiation data of the client's initial
+	// message with NoiseSocket, nil otherwise
+	NegotiationData []byte
+}
+
+// configForClient returns the configuration that Config.GetConfigForClient
+// picks for the client of a server
+func (c *Conn) configForClient(negotiationData []byte) (*Config, error) {
+	config, err := c.config.GetConfigForClient(&ClientInfo{RemoteAddr: c.conn.RemoteAddr(), NegotiationData: negotiationData})
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		config = c.config
+	}
+	if config.NoiseSocket != c.config.NoiseSocket {
+		return nil, configError("noise: the configuration returned by GetConfigForClient cannot change NoiseSocket")
+	}
+	if err = checkRequirements(false, config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
 type timeoutError struct{}
 
 func (timeoutError) Error() string   { return "noise: DialWithDialer timed out" }
 func (timeoutError) Timeout() bool   { return true }
 func (timeoutError) Temporary() bool { return true }
 
-// this functions checks if at some point in the protocol
-// the peer needs to verify the other peer static public key
-// and if the peer needs to provide a proof for its static public key
-var errNoPubkeyVerifier = errors.New("noise: no public key verifier set in noise.Config")
-var errNoProof = errors.New("noise: no public key proof set in noise.Config")
-
-func checkRequirements(isClient bool, config *Config) (err error) {
-	ht := config.HandshakePattern
-	if ht == Noise_NX || ht == Noise_KX || ht == Noise_XX || ht == Noise_IX {
-		if isClient && config.PublicKeyVerifier == nil {
-			return errNoPubkeyVerifier
-		} else if !isClient && config.StaticPublicKeyProof == nil {
-			return errNoProof
-		}
+var errNoConfig = configError("noise: no noise.Config set")
+var errNoPubkeyVerifier = configError("noise: no public key verifier set in noise.Config")
+var errNoProof = configError("noise: no public key proof set in noise.Config")
+
+// Validate checks the parts of the configuration that do not depend on the
+// role of the peer: the protocol, the options used together, the pre-shared
+// keys and the size of the keys. The returned error is of kind ErrConfig.
+// Listen() and Dial() also check that the server, or the client, has a
+// PublicKeyVerifier and a StaticPublicKeyProof if its pattern needs them.
+func (config *Config) Validate() error {
+	if config == nil {
+		return errNoConfig
 	}
-	if ht == Noise_XN || ht == Noise_XK || ht == Noise_XX || ht == Noise_X || ht == Noise_IN || ht == Noise_IK || ht == Noise_IX {
-		if isClient && config.StaticPublicKeyProof == nil {
-			return errNoProof
-		} else if !isClient && config.PublicKeyVerifier == nil {
-			return errNoPubkeyVerifier
-		}
+	protocol, err := config.protocol()
+	if err != nil {
+		return err
+	}
+	if config.NoisePipes && config.NoiseSocket {
+		return configError("noise: NoisePipes and NoiseSocket cannot be used together")
+	}
+	// ephemeral keys are only received out-of-band with Noise Pipes or
+	// when a NoiseSocket server switches protocol
+	if protocol.pattern.hasEphemeralPreMessage() && !config.NoiseSocket {
+		return configError("noise: %s can only be used via Config.NoisePipes or Config.NoiseSocket", protocol.pattern.name)
+	}
+	if config.NoiseSocket && (config.RekeyAfterMessages > 0 || config.RekeyAfterBytes > 0) {
+		return configError("noise: NoiseSocket transport messages cannot signal a rekey, RekeyAfterMessages and RekeyAfterBytes cannot be used")
+	}
+	if config.Cookies && (config.NoisePipes || config.NoiseSocket || protocol.pattern.isOneWay()) {
+		return errCookiesNotAllowed
+	}
+	if config.CookieDifficulty < 0 || config.CookieDifficulty > maxCookieDifficulty {
+		return configError("noise: CookieDifficulty must be between 0 and %d", maxCookieDifficulty)
+	}
+	if err = config.checkPreSharedKeys(protocol.pattern); err != nil {
+		return err
 	}
-	if ht == Noise_NNpsk2 && len(config.PreSharedKey) != 32 {
-		return errors.New("noise: a 32-byte pre-shared key needs to be passed as noise.Config")
+	_, _, err = config.keyPairs(protocol.dh)
+	return err
+}
+
+// checkRequirements validates the configuration, and checks if at some
+// point in the protocol the peer needs to verify the other peer static
+// public key and if the peer needs to provide a proof for its static
+// public key
+func checkRequirements(isClient bool, config *Config) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	protocol, _ := config.protocol()
+	// the remote peer sends its static public key: we need to verify it
+	if protocol.pattern.transmitsStatic(!isClient) && config.PublicKeyVerifier == nil {
+		return errNoPubkeyVerifier
+	}
+	// we send our static public key: we need to prove it
+	if protocol.pattern.transmitsStatic(isClient) && config.StaticPublicKeyProof == nil {
+		return errNoProof
 	}
 	return nil
 }
@@ -110,41 +202,37 @@ func checkRequirements(isClient bool, config *Config) (err error) {
 // timeout or deadline given in the dialer apply to connection and Noise
 // handshake as a whole.
 //
-// DialWithDialer interprets a nil configuration as equivalent to the zero
-// configuration; see the documentation of Config for the defaults.
-// TODO: make sure sane defaults for time outs are set!!!
+// The configuration config must be non-nil, an invalid configuration is
+// reported with an error of kind ErrConfig.
 func DialWithDialer(dialer *net.Dialer, network, addr string, config *Config) (*Conn, error) {
-	// We want the Timeout and Deadline values from dialer to cover the
-	// whole process: TCP connection and Noise handshake. This means that we
-	// also need to start our own timers now.
-	timeout := dialer.Timeout
-
-	if !dialer.Deadline.IsZero() {
-		deadlineTimeout := time.Until(dialer.Deadline)
-		if timeout == 0 || deadlineTimeout < timeout {
-			timeout = deadlineTimeout
-		}
-	}
-
 	// check Config
-	if config == nil {
-		panic("noise: no noise.Config set")
-	}
 	if err := checkRequirements(true, config); err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	// Dial the net.Conn first
-	var errChannel chan error
+	conn, err := dial(context.Background(), dialer, network, addr, config)
+	if err == context.DeadlineExceeded {
+		return nil, timeoutError{}
+	}
+	return conn, err
+}
 
-	if timeout != 0 {
-		errChannel = make(chan error, 2)
-		time.AfterFunc(timeout, func() {
-			errChannel <- timeoutError{}
-		})
+// dial connects to addr and runs the handshake of the client within ctx
+func dial(ctx context.Context, dialer *net.Dialer, network, addr string, config *Config) (*Conn, error) {
+	// We want the Timeout and Deadline values from dialer to cover the
+	// whole process: TCP connection and Noise handshake.
+	if dialer.Timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, dialer.Timeout)
+		defer cancel()
+	}
+	if !dialer.Deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, dialer.Deadline)
+		defer cancel()
 	}
 
-	rawConn, err := dialer.Dial(network, addr)
+	rawConn, err := dialer.DialContext(ctx, network, addr)
 	if err != nil {
 		return nil, err
 	}
@@ -158,34 +246,57 @@ func DialWithDialer(dialer *net.Dialer, network, addr string, config *Config) (*
 		hostname := addr[:colonPos]
 	*/
 
-	// Create the noise.Conn
+	// Create the noise.Conn and do the handshake
 	conn := Client(rawConn, config)
+	if err = conn.HandshakeContext(ctx); err != nil {
+		rawConn.Close()
+		return nil, err
+	}
 
-	// Do the handshake
-	if timeout == 0 {
-		err = conn.Handshake()
-	} else {
-		go func() {
-			errChannel <- conn.Handshake()
-		}()
+	return conn, nil
+}
 
-		err = <-errChannel
-	}
+// A Dialer dials Noise connections. Its zero value is not usable: Config
+// must be set.
+type Dialer struct {
+	// NetDialer is the dialer of the underlying connections. Its Timeout
+	// and Deadline cover the connection and the handshake as a whole. A
+	// nil NetDialer is equivalent to the zero net.Dialer
+	NetDialer *net.Dialer
+	// Config is the configuration of the connections
+	Config *Config
+}
+
+// Dial connects to the given network address and initiates a Noise
+// handshake. The returned connection is of type *Conn.
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
 
+// DialContext connects to the given network address and initiates a Noise
+// handshake. If ctx is done before the handshake completes, the connection
+// is closed and ctx.Err() is returned. Once the handshake has completed,
+// ctx has no effect on the returned connection, which is of type *Conn.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if err := checkRequirements(true, d.Config); err != nil {
+		return nil, err
+	}
+	dialer := d.NetDialer
+	if dialer == nil {
+		dialer = new(net.Dialer)
+	}
+	conn, err := dial(ctx, dialer, network, addr, d.Config)
 	if err != nil {
-		rawConn.Close()
+		// avoid returning a nil *Conn inside a non-nil net.Conn
 		return nil, err
 	}
-
 	return conn, nil
 }
 
 // Dial connects to the given network address using net.Dial
 // and then initiates a Noise handshake, returning the resulting
 // Noise connection.
-// Dial interprets a nil configuration as equivalent to
-// the zero configuration; see the documentation of Config
-// for the defaults.
+// The configuration config must be non-nil, see DialWithDialer.
 func Dial(network, addr string, config *Config) (*Conn, error) {
 	return DialWithDialer(new(net.Dialer), network, addr, config)
 }
@@ -200,8 +311,8 @@ func Dial(network, addr string, config *Config) (*Conn, error) {
 // point during the handshake
 func CreatePublicKeyVerifier(rootPublicKey ed25519.PublicKey) func([]byte, []byte) bool {
 	return func(publicKey, proof []byte) bool {
-		// ed25519.Verify panics if len(publicKey) is not PublicKeySize. We need to avoid that
-		if len(publicKey) != 32 {
+		// ed25519.Verify panics if len(rootPublicKey) is not PublicKeySize. We need to avoid that
+		if len(rootPublicKey) != ed25519.PublicKeySize {
 			return false
 		}
 		return ed25519.Verify(rootPublicKey, publicKey, proof)
@@ -214,7 +325,7 @@ func CreatePublicKeyVerifier(rootPublicKey ed25519.PublicKey) func([]byte, []byt
 // point during the handshake
 func CreateStaticPublicKeyProof(rootPrivateKey ed25519.PrivateKey, keyPair *KeyPair) []byte {
 
-	signature, err := rootPrivateKey.Sign(rand.Reader, keyPair.PublicKey[:], crypto.Hash(0))
+	signature, err := rootPrivateKey.Sign(rand.Reader, keyPair.PublicKey, crypto.Hash(0))
 	if err != nil {
 		panic("Noise: can't create static public key proof")
 	}
@@ -295,8 +406,8 @@ func GenerateAndSaveNoiseKeyPair(NoiseKeyPairFile string) (keyPair *KeyPair, err
 	// TODO: that should probably be saved in two files?
 	keyPair = GenerateKeypair(nil)
 	var dataToWrite [128]byte
-	hex.Encode(dataToWrite[:64], keyPair.PrivateKey[:])
-	hex.Encode(dataToWrite[64:], keyPair.PublicKey[:])
+	hex.Encode(dataToWrite[:64], keyPair.PrivateKey)
+	hex.Encode(dataToWrite[64:], keyPair.PublicKey)
 	err = ioutil.WriteFile(NoiseKeyPairFile, dataToWrite[:], 0400)
 	if err != nil {
 		return nil, errors.New("Noise: could not write on file at path")
@@ -305,22 +416,25 @@ func GenerateAndSaveNoiseKeyPair(NoiseKeyPairFile string) (keyPair *KeyPair, err
 }
 
 // LoadNoiseKeyPair reads and parses a public/private key pair from a pair
-// of files.
+// of files. Both X25519 and X448 key pairs are supported.
 func LoadNoiseKeyPair(noiseKeyPairFile string) (keypair *KeyPair, err error) {
 	// TODO: should I require a passphrase to decrypt it?
 	keyPairString, err := ioutil.ReadFile(noiseKeyPairFile)
 	if err != nil {
 		return nil, err
 	}
-	if len(keyPairString) != 64*2 {
+	keyLen := len(keyPairString) / 4
+	if keyLen != dhs[DH25519].dhLen && keyLen != dhs[DH448].dhLen || len(keyPairString)%4 != 0 {
 		return nil, errors.New("Noise: Noise key pair file is not correctly formated")
 	}
 	var keyPair KeyPair
-	_, err = hex.Decode(keyPair.PrivateKey[:], keyPairString[:64])
+	keyPair.PrivateKey = make([]byte, keyLen)
+	_, err = hex.Decode(keyPair.PrivateKey, keyPairString[:keyLen*2])
 	if err != nil {
 		return nil, err
 	}
-	_, err = hex.Decode(keyPair.PublicKey[:], keyPairString[64:])
+	keyPair.PublicKey = make([]byte, keyLen)
+	_, err = hex.Decode(keyPair.PublicKey, keyPairString[keyLen*2:])
 	if err != nil {
 		return nil, err
 	}
@@ -1,6 +1,8 @@
 package noise
 
 import (
+	"errors"
+	"net"
 	"os"
 	"testing"
 )
@@ -67,3 +69,158 @@ func TestCreationKeys(t *testing.T) {
 
 	// end
 }
+
+// echoOnce accepts a connection and echoes its first message
+func echoOnce(l net.Listener) <-chan error {
+	serverErr := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 100)
+		n, err := conn.Read(buf)
+		if err == nil {
+			_, err = conn.Write(buf[:n])
+		}
+		serverErr <- err
+	}()
+	return serverErr
+}
+
+// dialEcho dials the listener and checks that a message is echoed
+func dialEcho(l net.Listener, config *Config) error {
+	serverErr := echoOnce(l)
+	conn, err := Dial("tcp", l.Addr().String(), config)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte("hello")); err != nil {
+		return err
+	}
+	buf := make([]byte, 100)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return err
+	}
+	if string(buf[:n]) != "hello" {
+		return errors.New("the message was not echoed")
+	}
+	return <-serverErr
+}
+
+func TestGetConfigForClient(t *testing.T) {
+	serverKeyPair := GenerateKeypair(nil)
+	var clientAddr net.Addr
+	// the configuration of the listener is only a template
+	l, err := Listen("tcp", "127.0.0.1:0", &Config{
+		GetConfigForClient: func(info *ClientInfo) (*Config, error) {
+			clientAddr = info.RemoteAddr
+			return &Config{HandshakePattern: Noise_NK, KeyPair: serverKeyPair}, nil
+		},
+	})
+	if err != nil {
+		t.Fatal("cannot setup a listener on localhost:", err)
+	}
+	defer l.Close()
+
+	if err = dialEcho(l, &Config{HandshakePattern: Noise_NK, RemoteKey: serverKeyPair.PublicKey}); err != nil {
+		t.Fatal("the handshake should have used the configuration of the callback:", err)
+	}
+	if clientAddr == nil || clientAddr.Network() != "tcp" {
+		t.Fatal("the callback should have received the address of the client, got", clientAddr)
+	}
+}
+
+func TestGetConfigForClientNoiseSocket(t *testing.T) {
+	// two identities on the same port, picked from the negotiation data
+	keyPairs := map[string]*KeyPair{"alice": GenerateKeypair(nil), "bob": GenerateKeypair(nil)}
+	l, err := Listen("tcp", "127.0.0.1:0", &Config{
+		NoiseSocket: true,
+		GetConfigForClient: func(info *ClientInfo) (*Config, error) {
+			keyPair, ok := keyPairs[string(info.NegotiationData)]
+			if !ok {
+				return nil, errors.New("unknown identity")
+			}
+			return &Config{HandshakePattern: Noise_NK, KeyPair: keyPair, NoiseSocket: true}, nil
+		},
+	})
+	if err != nil {
+		t.Fatal("cannot setup a listener on localhost:", err)
+	}
+	defer l.Close()
+
+	for name, keyPair := range keyPairs {
+		config := &Config{HandshakePattern: Noise_NK, RemoteKey: keyPair.PublicKey, NoiseSocket: true, NegotiationData: []byte(name)}
+		if err = dialEcho(l, config); err != nil {
+			t.Fatalf("the server should have used the key of %s: %v", name, err)
+		}
+	}
+
+	// the callback rejects the client
+	config := &Config{HandshakePattern: Noise_NK, RemoteKey: keyPairs["alice"].PublicKey, NoiseSocket: true, NegotiationData: []byte("eve")}
+	if err = dialEcho(l, config); err == nil {
+		t.Fatal("the unknown identity should have been rejected")
+	}
+}
+
+func TestGetConfigForClientMessageSize(t *testing.T) {
+	serverKeyPair := GenerateKeypair(nil)
+	// the configuration of the callback pads the messages
+	l, err := Listen("tcp", "127.0.0.1:0", &Config{
+		GetConfigForClient: func(info *ClientInfo) (*Config, error) {
+			return &Config{HandshakePattern: Noise_NK, KeyPair: serverKeyPair, Padding: PadToBlockSize(16)}, nil
+		},
+	})
+	if err != nil {
+		t.Fatal("cannot setup a listener on localhost:", err)
+	}
+	defer l.Close()
+	go func() {
+		if client, err := Dial("tcp", l.Addr().String(), &Config{HandshakePattern: Noise_NK, RemoteKey: serverKeyPair.PublicKey, Padding: PadToBlockSize(16)}); err == nil {
+			defer client.Close()
+			client.Read(make([]byte, 10))
+		}
+	}()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal("cannot accept:", err)
+	}
+	defer conn.Close()
+
+	// the size is checked against the configuration of the handshake
+	server := conn.(*Conn)
+	unpadded := server.MaxMessageSize()
+	if err = server.WriteMessage(make([]byte, unpadded)); err != ErrMessageTooLarge {
+		t.Fatal("the message should be too large once padded, got", err)
+	}
+	if server.MaxMessageSize() >= unpadded {
+		t.Fatal("the padding should reduce the size of the messages")
+	}
+}
+
+func TestGetConfigForClientErrors(t *testing.T) {
+	// the configuration returned by the callback is checked
+	l, err := Listen("tcp", "127.0.0.1:0", &Config{
+		GetConfigForClient: func(info *ClientInfo) (*Config, error) {
+			return &Config{HandshakePattern: Noise_NK}, nil
+		},
+	})
+	if err != nil {
+		t.Fatal("cannot setup a listener on localhost:", err)
+	}
+	defer l.Close()
+
+	serverErr := echoOnce(l)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err = <-serverErr; !errors.Is(err, ErrConfig) {
+		t.Fatal("the server should have rejected the configuration, got", err)
+	}
+}
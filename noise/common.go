@@ -1,6 +1,13 @@
 package noise
 
+import (
+	"net"
+	"time"
+)
+
 // The following constants represent the details of this implementation of the Noise specification.
+// NoiseDH, NoiseAEAD and NoiseHASH are the default DH, cipher and hash functions,
+// see Config.DHFunction, Config.CipherFunction and Config.HashFunction for the others.
 const (
 	NoiseDraftVersion = "33"
 	NoiseDH           = "25519"
@@ -15,13 +22,30 @@ const (
 	NoiseMaxPlaintextSize = NoiseMessageLength - NoiseTagLength
 )
 
+// DefaultHandshakeTimeout is the time a server gives a client to complete the
+// handshake when Config.HandshakeTimeout is not set.
+const DefaultHandshakeTimeout = 30 * time.Second
+
 type Config struct {
+	// the full name of the Noise protocol that the client and the server will
+	// go through, for example "Noise_XX_25519_AESGCM_BLAKE2b". If set, it
+	// takes precedence over HandshakePattern, DHFunction, CipherFunction and
+	// HashFunction
+	ProtocolName string
 	// the type of Noise protocol that the client and the server will go through
 	HandshakePattern noiseHandshakeType
+	// the DH function used during the handshake, both peers must use the
+	// same one and key pairs must be generated for it (defaults to DH25519)
+	DHFunction noiseDHType
+	// the cipher function used to encrypt handshake and transport messages,
+	// both peers must use the same one (defaults to CipherChaChaPoly)
+	CipherFunction noiseCipherType
+	// the hash function used during the handshake, both peers must use the
+	// same one (defaults to HashSHA256)
+	HashFunction noiseHashType
 	// the current peer's keyPair
 	KeyPair *KeyPair
-	// the other peer's public key
-	// TODO: something needs to assert that this is 32-byte at some point
+	// the other peer's public key, its size must match the DH function
 	RemoteKey []byte
 	// any messages that the client and the server previously exchanged in clear
 	Prologue []byte
@@ -33,11 +57,143 @@ type Config struct {
 	// static public key as part of the handshake, this callback is mandatory in
 	// order to validate it
 	PublicKeyVerifier func(publicKey, proof []byte) bool
-	// a pre-shared key for handshake patterns including a `psk` token
+	// HandshakePayload is called before writing each handshake message, with
+	// the index of the message in the handshake (starting at 0), and returns
+	// the application data to send in it (it can return nil). Depending on the
+	// pattern and the message, this data might not be encrypted or might not
+	// be protected against replays, see the payload security properties in
+	// the Noise specification
+	HandshakePayload func(messageIndex int) []byte
+	// OnHandshakePayload is called with the application data that the remote
+	// peer sent in each handshake message. Returning an error aborts the
+	// handshake. The data is also available via Conn.HandshakePayloads()
+	OnHandshakePayload func(messageIndex int, payload []byte) error
+	// a pre-shared key for handshake patterns including a single `psk` token
+	// (for example Noise_NNpsk2). It is ignored if PreSharedKeys is set
 	PreSharedKey []byte
+	// the ordered list of 32-byte pre-shared keys for handshake patterns
+	// including `psk` tokens (for example Noise_KKpsk0+psk2): each `psk`
+	// token of the handshake consumes the next key of the list
+	PreSharedKeys [][]byte
+	// Initiator is only used by NewHandshakeState(), to choose between the
+	// role of the initiator and the role of the responder. Dial() and
+	// Listen() always make the client the initiator
+	Initiator bool
+	// NoisePipes replaces the handshake pattern with the Noise Pipes protocol:
+	// a client knowing the server's static key (RemoteKey, for example saved
+	// from a previous connection with Conn.StaticKey()) uses Noise_IK and saves
+	// a round trip, otherwise it uses Noise_XX. If the server cannot decrypt the
+	// Noise_IK message, it switches to Noise_XXfallback. Both peers need a
+	// KeyPair, a StaticPublicKeyProof and a PublicKeyVerifier. The message
+	// indices given to HandshakePayload and OnHandshakePayload keep counting
+	// the Noise_IK message after a fallback: the first Noise_XXfallback
+	// message has index 1, and the payload of the Noise_IK message is lost
+	NoisePipes bool
+	// NoiseSocket frames the handshake and transport messages as described by
+	// the NoiseSocket specification (https://noisesocket.org), and lets the
+	// server negotiate the protocol with the client. It cannot be used with
+	// NoisePipes
+	NoiseSocket bool
+	// NegotiationData is sent in clear by a NoiseSocket client in its initial
+	// message, typically to describe the protocol it uses. It is authenticated
+	// by the handshake
+	NegotiationData []byte
+	// NoiseSocketNegotiate is called by a NoiseSocket server with the
+	// negotiation data of the client's initial message. It returns the
+	// decision of the server, the negotiation data to send back (mandatory
+	// unless the message is accepted) and the configuration to use for the
+	// rest of the handshake, or nil to keep the current one. This
+	// configuration describes the protocol of the initial message
+	// (NoiseSocketAccept), of the handshake started by the server
+	// (NoiseSocketSwitch), or of the retried initial message
+	// (NoiseSocketRetry), and must set NoiseSocket. If the callback is nil,
+	// every initial message is accepted
+	NoiseSocketNegotiate func(negotiationData []byte) (decision NoiseSocketDecision, responseData []byte, config *Config)
+	// NoiseSocketRenegotiate is called by a NoiseSocket client when the server
+	// does not accept its initial message, with the negotiation data of the
+	// server. If switched is true, the server started a new handshake and the
+	// returned configuration is used to respond to it. Otherwise the server
+	// asked to retry (or rejected the client) and the returned configuration,
+	// which must set NoiseSocket, is used for a new initial message. Returning
+	// an error aborts the handshake
+	NoiseSocketRenegotiate func(negotiationData []byte, switched bool) (*Config, error)
+	// GetConfigForClient is called by a server before processing the first
+	// handshake message of a client, and returns the configuration (key
+	// pair, pattern, verifier...) to use for this connection, or nil to keep
+	// the current one. This lets a listener host several identities or
+	// patterns. It must keep the value of NoiseSocket, and with NoiseSocket
+	// it receives the negotiation data of the initial message. Returning an
+	// error aborts the handshake
+	GetConfigForClient func(info *ClientInfo) (*Config, error)
+	// HandshakeWorkers makes a listener run the handshakes of the connections
+	// it accepts, at most this many at the same time, so that Accept() only
+	// returns authenticated connections. Zero keeps the handshakes on the
+	// first Read or Write of the connections
+	HandshakeWorkers int
+	// HandshakesPerIP limits the handshakes run by a listener for the same IP
+	// address (see HandshakeWorkers), further connections are closed. Zero
+	// means no limit
+	HandshakesPerIP int
+	// OnHandshakeError is called with the address of the client and the
+	// error of each handshake run by a listener that fails (see
+	// HandshakeWorkers), including the connections refused because of
+	// HandshakesPerIP with ErrTooManyHandshakes
+	OnHandshakeError func(remoteAddr net.Addr, err error)
+	// Padding hides the length of the handshake payloads and of the transport
+	// messages by padding them before encryption, see PadToBlockSize(),
+	// PadToMaxFrame() and PadRandomly(). As it changes the format of the
+	// messages, both peers must set a padding policy (or NoiseSocket)
+	Padding PaddingPolicy
+	// RekeyAfterMessages and RekeyAfterBytes make a Conn rotate its sending
+	// key (see Conn.Rekey()) once it has sent this many messages or bytes
+	// of data with it. Zero disables the threshold
+	RekeyAfterMessages uint64
+	RekeyAfterBytes    uint64
+	// HandshakeTimeout bounds the time a handshake can take, see
+	// Conn.HandshakeContext(). Servers default to DefaultHandshakeTimeout,
+	// clients to no timeout. A negative value disables the timeout
+	HandshakeTimeout time.Duration
+	// RetransmitTimeout is the time a PacketConn waits for the next handshake
+	// message before sending its last one again, doubling after each
+	// retransmission (defaults to DefaultRetransmitTimeout)
+	RetransmitTimeout time.Duration
+	// StreamWindowSize is the flow control window of each stream of a Mux:
+	// the data the peer can send before the application reads it. It can
+	// only be larger than the default of 256 KiB
+	StreamWindowSize uint32
+	// Cookies protects a server from floods of handshakes: under load, it
+	// replies to the first handshake message with a cookie bound to the
+	// address of the client, and only processes the message once the client
+	// sends it again with the cookie. Over TCP, the client also solves a
+	// proof of work with the cookie. Both peers must set it, and it cannot
+	// be used with NoisePipes, NoiseSocket or one-way patterns
+	Cookies bool
+	// CookieHandshakes and CookieHandshakeRate define the load of a server
+	// from which cookies are required: the number of handshakes in progress
+	// on its listener (over TCP), and of handshakes started during the last
+	// second. Zero disables a threshold, cookies are always required if both
+	// are zero
+	CookieHandshakes    int
+	CookieHandshakeRate int
+	// CookieDifficulty is the number of leading zero bits of the proof of
+	// work that comes with a cookie over TCP (defaults to
+	// DefaultCookieDifficulty, at most 24): each bit doubles the work of the
+	// clients
+	CookieDifficulty int
 	// by default a noise protocol is full-duplex, meaning that both the client
 	// and the server can write on the channel at the same time. Setting this value
 	// to true will require the peers to write and read in turns. If this requirement
 	// is not respected by the application, the consequences could be catastrophic
 	HalfDuplex bool
 }
+
+// handshakeTimeout returns the timeout of the handshake, zero if there is none
+func (config *Config) handshakeTimeout(isClient bool) time.Duration {
+	switch {
+	case config.HandshakeTimeout < 0:
+		return 0
+	case config.HandshakeTimeout == 0 && !isClient:
+		return DefaultHandshakeTimeout
+	}
+	return config.HandshakeTimeout
+}
@@ -1,13 +1,18 @@
 package noise
 
 import (
+	"context"
 	"errors"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// closeNotifyTimeout bounds the time Close spends sending a close_notify
+const closeNotifyTimeout = 5 * time.Second
+
 // A Conn represents a secured connection.
 // It implements the net.Conn interface.
 type Conn struct {
@@ -18,19 +23,56 @@ type Conn struct {
 	config            *Config // configuration passed to constructor
 	hs                handshakeState
 	handshakeComplete bool
+	handshakeErr      error // error of a failed handshake
 	handshakeMutex    sync.Mutex
 
 	// Authentication thingies
 	isRemoteAuthenticated bool
 
+	// name of the handshake pattern that was used (it can change with Noise Pipes)
+	handshakePattern string
+	// true if the pattern that was used is one-way: only the client writes
+	oneWay bool
+
+	// handshake payloads: number of handshake messages written or read so
+	// far, and application data received from the remote peer
+	handshakeMessages int
+	handshakePayloads [][]byte
+
+	// the final hash of the handshake, for channel binding
+	handshakeHash []byte
+	// secret from which keying material is exported
+	exporterSecret []byte
+
+	// ephemeral keys used by the next handshakes instead of random ones (tests only)
+	debugEphemerals []*KeyPair
+
 	// input/output
 	in, out         *cipherState
 	inLock, outLock sync.Mutex
 	inputBuffer     []byte
 
+	// messages and bytes sent with the current sending key
+	outMessages, outBytes uint64
+
+	// 1 once the handshake is complete, read atomically by Close
+	established int32
+	// close_notify sent, or received
+	closeNotifySent, readClosed bool
+	// alert to send to the peer if the handshake fails
+	handshakeAlert Alert
+	// set if the final handshake message was decrypted but rejected: the
+	// peer considers the handshake complete, and the alert is encrypted
+	alertOut *cipherState
+
 	// half duplex
 	isHalfDuplex   bool
 	halfDuplexLock sync.Mutex
+
+	// the Conn only runs the handshake of a PacketConn, see packet.go
+	datagram bool
+	// cookies of the listener of a server, see cookie.go
+	cookies *cookieJar
 }
 
 // Access to net.Conn methods.
@@ -69,17 +111,15 @@ func (c *Conn) SetWriteDeadline(t time.Time) error {
 
 // Write writes data to the connection.
 func (c *Conn) Write(b []byte) (int, error) {
-
-	//
-	if hp := c.config.HandshakePattern; !c.isClient && (hp == Noise_N || hp == Noise_K || hp == Noise_X) {
-		panic("Noise: a server should not write on one-way patterns")
-	}
-
 	// Make sure to go through the handshake first
 	if err := c.Handshake(); err != nil {
 		return 0, err
 	}
 
+	if !c.canWrite() {
+		return 0, oneWayError("noise: a server cannot write on one-way patterns")
+	}
+
 	// Lock the write socket
 	if c.isHalfDuplex {
 		c.halfDuplexLock.Lock()
@@ -96,30 +136,14 @@ func (c *Conn) Write(b []byte) (int, error) {
 
 		// fragment the data
 		m := len(data)
-		if m > NoiseMaxPlaintextSize {
-			m = NoiseMaxPlaintextSize
+		if m > c.maxPlaintextSize() {
+			m = c.maxPlaintextSize()
 		}
 
-		// Encrypt
-		ciphertext, err := c.out.encryptWithAd([]byte{}, data[:m])
-		if err != nil {
-			return n, err
-		}
-
-		// header (length)
-		length := []byte{byte(len(ciphertext) >> 8), byte(len(ciphertext) % 256)}
-
 		// Send data
-		_, err = c.conn.Write(append(length, ciphertext...))
-		if err != nil {
+		if err := c.writeDataRecord(data[:m]); err != nil {
 			return n, err
 		}
-		/*
-			// TODO: should we test if we sent the correct number of bytes?
-			if _ != len(ciphertext) {
-				return errors.New("Noise: cannot send the whole data")
-			}
-		*/
 
 		// prepare next loop iteration
 		n += m
@@ -129,6 +153,91 @@ func (c *Conn) Write(b []byte) (int, error) {
 	return n, nil
 }
 
+// writeDataRecord sends data in a single transport message, it must be
+// called with the write lock
+func (c *Conn) writeDataRecord(data []byte) error {
+	// rotate the key first if a threshold has been reached
+	if c.shouldRekey() {
+		if err := c.rekeyOut(); err != nil {
+			return err
+		}
+	}
+	// keep the last nonces for control messages
+	if c.out.n >= maxDataNonce {
+		return errNonceExhausted
+	}
+	if err := c.writeTransportMessage(recordData, data); err != nil {
+		return err
+	}
+	c.outMessages++
+	c.outBytes += uint64(len(data))
+	return nil
+}
+
+// writeTransportMessage encrypts a record and writes it in a frame
+func (c *Conn) writeTransportMessage(recordType byte, data []byte) error {
+	plaintext := data
+	if c.records() {
+		plaintext = append([]byte{recordType}, data...)
+	} else if recordType != recordData {
+		return errNoRecords
+	}
+	if c.paddedBodies() {
+		var err error
+		if plaintext, err = encodeNoiseSocketBody(plaintext, c.paddingLength(len(plaintext), c.maxNoiseMessageLength())); err != nil {
+			return err
+		}
+	}
+
+	// Encrypt
+	ciphertext, err := c.out.encryptWithAd([]byte{}, plaintext)
+	if err != nil {
+		return err
+	}
+
+	// header (length)
+	length := []byte{byte(len(ciphertext) >> 8), byte(len(ciphertext) % 256)}
+
+	// Send data
+	_, err = c.conn.Write(append(length, ciphertext...))
+	/*
+		// TODO: should we test if we sent the correct number of bytes?
+		if _ != len(ciphertext) {
+			return errors.New("Noise: cannot send the whole data")
+		}
+	*/
+	return err
+}
+
+// maxNoiseMessageLength returns the maximum size of a Noise message in a frame
+func (c *Conn) maxNoiseMessageLength() int {
+	if c.datagram {
+		return maxPacketNoiseMessageLength
+	}
+	if c.config.NoiseSocket {
+		return maxMessageLength
+	}
+	return NoiseMessageLength
+}
+
+// maxPlaintextSize returns the maximum size of the data carried by a transport message
+func (c *Conn) maxPlaintextSize() int {
+	size := NoiseMaxPlaintextSize
+	if c.paddedBodies() {
+		size = c.maxNoiseMessageLength() - NoiseTagLength - 2 // 2-byte body length
+	}
+	if c.records() {
+		size-- // record type
+	}
+	return size
+}
+
+// records returns true if the transport messages carry records, see
+// records.go. NoiseSocket transport messages only carry application data
+func (c *Conn) records() bool {
+	return !c.config.NoiseSocket
+}
+
 // Read can be made to time out and return a net.Error with Timeout() == true
 // after a fixed time limit; see SetDeadline and SetReadDeadline.
 func (c *Conn) Read(b []byte) (n int, err error) {
@@ -143,9 +252,8 @@ func (c *Conn) Read(b []byte) (n int, err error) {
 		return
 	}
 
-	// If this is a one-way pattern, do some checks
-	if hp := c.config.HandshakePattern; c.isClient && (hp == Noise_N || hp == Noise_K || hp == Noise_X) {
-		panic("disco: a client should not read on one-way patterns")
+	if !c.canRead() {
+		return 0, oneWayError("noise: a client cannot read on one-way patterns")
 	}
 
 	// Lock the read socket
@@ -169,53 +277,229 @@ func (c *Conn) Read(b []byte) (n int, err error) {
 		c.inputBuffer = c.inputBuffer[:0]
 	}
 
+	// read the next data record (skipping the empty messages of WriteMessage)
+	var plaintext []byte
+	for len(plaintext) == 0 {
+		if plaintext, err = c.readDataRecord(); err != nil {
+			// the buffered data is returned before the end of the stream
+			if err == io.EOF && readSoFar > 0 {
+				return readSoFar, nil
+			}
+			return readSoFar, err
+		}
+	}
+
+	// append to the input buffer
+	c.inputBuffer = append(c.inputBuffer, plaintext...)
+
+	// read whatever we can read
+	rest := len(b) - readSoFar
+	copy(b[readSoFar:], c.inputBuffer)
+	if len(c.inputBuffer) >= rest {
+		c.inputBuffer = c.inputBuffer[rest:]
+		return len(b), nil
+	}
+
+	// we haven't filled the buffer
+	readSoFar += len(c.inputBuffer)
+	c.inputBuffer = c.inputBuffer[:0]
+	return readSoFar, nil
+
+	// TODO: should we continue to try and read other messages?
+
+}
+
+// readDataRecord returns the data of the next data record, processing the
+// other records on the way. It must be called with the read lock
+func (c *Conn) readDataRecord() ([]byte, error) {
+	// after a close_notify, there is nothing left to read
+	if c.readClosed {
+		return nil, io.EOF
+	}
+	for {
+		recordType, content, err := c.readRecord()
+		if err != nil {
+			return nil, err
+		}
+		switch recordType {
+		case recordData:
+			return content, nil
+		case recordRekey:
+			c.in.Rekey()
+		case recordCloseNotify:
+			c.readClosed = true
+			return nil, io.EOF
+		case recordAlert:
+			if len(content) != 1 {
+				return nil, errors.New("noise: the received alert is malformed")
+			}
+			return nil, &AlertError{Alert: Alert(content[0])}
+		default:
+			return nil, errors.New("noise: unknown record type received")
+		}
+	}
+}
+
+// readRecord reads a frame from the socket and decrypts the record it carries
+func (c *Conn) readRecord() (recordType byte, content []byte, err error) {
 	// read header from socket
 	bufHeader, err := readFromUntil(c.conn, 2)
 	if err != nil {
-		return 0, err
+		return 0, nil, c.truncated(err)
 	}
 	length := (int(bufHeader[0]) << 8) | int(bufHeader[1])
-	if length > NoiseMessageLength {
-		return 2, errors.New("Noise: Noise message received exceeds NoiseMessageLength")
+	if length > c.maxNoiseMessageLength() {
+		return 0, nil, errors.New("Noise: Noise message received exceeds NoiseMessageLength")
 	}
 
 	// read noise message from socket
 	noiseMessage, err := readFromUntil(c.conn, length)
 	if err != nil {
-		return 2, err
+		return 0, nil, c.truncated(err)
 	}
-
 	// decrypt
 	plaintext, err := c.in.decryptWithAd([]byte{}, noiseMessage)
 	if err != nil {
-		return 2 + length, err
+		return 0, nil, err
+	}
+	if c.paddedBodies() {
+		if plaintext, err = decodeNoiseSocketBody(plaintext); err != nil {
+			return 0, nil, err
+		}
 	}
+	if !c.records() {
+		return recordData, plaintext, nil
+	}
+	if len(plaintext) == 0 {
+		return 0, nil, errors.New("noise: the received record is empty")
+	}
+	return plaintext[0], plaintext[1:], nil
+}
 
-	// append to the input buffer
-	c.inputBuffer = append(c.inputBuffer, plaintext...)
+// truncated replaces the end of the stream by ErrTruncated: a connection
+// with records should only end after a close_notify
+func (c *Conn) truncated(err error) error {
+	if c.records() && (err == io.EOF || err == io.ErrUnexpectedEOF) {
+		return ErrTruncated
+	}
+	return err
+}
 
-	// read whatever we can read
-	rest := len(b) - readSoFar
-	copy(b[readSoFar:], c.inputBuffer)
-	if len(c.inputBuffer) >= rest {
-		c.inputBuffer = c.inputBuffer[rest:]
-		return len(b), nil
+// ErrMessageTooLarge is returned by WriteMessage when the message does not
+// fit in a single Noise transport message, see MaxMessageSize()
+var ErrMessageTooLarge = errors.New("noise: the message does not fit in a Noise transport message")
+
+// MaxMessageSize returns the maximum size of a message sent with
+// WriteMessage. It depends on the configuration (NoiseSocket, Padding),
+// which Config.GetConfigForClient can replace during the handshake.
+func (c *Conn) MaxMessageSize() int {
+	return c.maxPlaintextSize()
+}
+
+// WriteMessage sends msg in a single Noise transport message, which the peer
+// receives as a whole with ReadMessage. It returns ErrMessageTooLarge if
+// msg is larger than MaxMessageSize().
+func (c *Conn) WriteMessage(msg []byte) error {
+	// Make sure to go through the handshake first
+	if err := c.Handshake(); err != nil {
+		return err
 	}
 
-	// we haven't filled the buffer
-	readSoFar += len(c.inputBuffer)
-	c.inputBuffer = c.inputBuffer[:0]
-	return readSoFar, nil
+	if !c.canWrite() {
+		return oneWayError("noise: a server cannot write on one-way patterns")
+	}
+	// the configuration, and the padding, can change during the handshake
+	if len(msg) > c.maxPlaintextSize() {
+		return ErrMessageTooLarge
+	}
 
-	// TODO: should we continue to try and read other messages?
+	// Lock the write socket
+	if c.isHalfDuplex {
+		c.halfDuplexLock.Lock()
+		defer c.halfDuplexLock.Unlock()
+	} else {
+		c.outLock.Lock()
+		defer c.outLock.Unlock()
+	}
+	return c.writeDataRecord(msg)
+}
+
+// ReadMessage returns the next message sent with WriteMessage, or the next
+// fragment of data sent with Write (up to MaxMessageSize() bytes). It
+// should not be mixed with Read, which can leave part of a message
+// buffered: ReadMessage returns an error in that case.
+func (c *Conn) ReadMessage() ([]byte, error) {
+	// Make sure to go through the handshake first
+	if err := c.Handshake(); err != nil {
+		return nil, err
+	}
+
+	if !c.canRead() {
+		return nil, oneWayError("noise: a client cannot read on one-way patterns")
+	}
 
+	// Lock the read socket
+	if c.isHalfDuplex {
+		c.halfDuplexLock.Lock()
+		defer c.halfDuplexLock.Unlock()
+	} else {
+		c.inLock.Lock()
+		defer c.inLock.Unlock()
+	}
+
+	if len(c.inputBuffer) > 0 {
+		return nil, errors.New("noise: a previous Read left part of a message unread")
+	}
+	msg, err := c.readDataRecord()
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{}, msg...), nil
 }
 
-// Close closes the connection.
+// Close sends a close_notify to the peer, if the handshake is complete, and
+// closes the connection. The peer can then tell a clean shutdown from a
+// truncation by an attacker. The close_notify is not sent if a Write (or
+// with HalfDuplex, a Read) is in progress: it could block on a peer that does
+// not read, and Close must interrupt it instead.
 func (c *Conn) Close() error {
+	if atomic.LoadInt32(&c.established) == 1 && c.canWrite() && c.records() {
+		lock := &c.outLock
+		if c.isHalfDuplex {
+			lock = &c.halfDuplexLock
+		}
+		if lock.TryLock() {
+			c.sendCloseNotify()
+			lock.Unlock()
+		}
+	}
 	return c.conn.Close()
 }
 
+// sendCloseNotify sends a close_notify once, it must be called with the
+// write lock
+func (c *Conn) sendCloseNotify() {
+	if c.closeNotifySent {
+		return
+	}
+	c.closeNotifySent = true
+	// do not wait forever for an unresponsive peer
+	c.conn.SetWriteDeadline(time.Now().Add(closeNotifyTimeout))
+	c.writeTransportMessage(recordCloseNotify, nil)
+}
+
+// canWrite returns false for the server of a one-way pattern, it must be
+// called once the handshake is complete
+func (c *Conn) canWrite() bool {
+	return c.isClient || !c.oneWay
+}
+
+// canRead returns false for the client of a one-way pattern, it must be
+// called once the handshake is complete
+func (c *Conn) canRead() bool {
+	return !c.isClient || !c.oneWay
+}
+
 //
 // Noise-related functions
 //
@@ -225,6 +509,13 @@ func (c *Conn) Close() error {
 // Most uses of this package need not call Handshake explicitly:
 // the first Read or Write will call it automatically.
 func (c *Conn) Handshake() error {
+	return c.HandshakeContext(context.Background())
+}
+
+// HandshakeContext runs the handshake like Handshake, but gives up when ctx
+// is done: the underlying connection is then closed and ctx.Err() returned.
+// Config.HandshakeTimeout also applies.
+func (c *Conn) HandshakeContext(ctx context.Context) error {
 
 	// Locking the handshakeMutex
 	c.handshakeMutex.Lock()
@@ -234,100 +525,125 @@ func (c *Conn) Handshake() error {
 	if c.handshakeComplete {
 		return nil
 	}
+	if c.handshakeErr != nil {
+		return c.handshakeErr
+	}
 
-	// Noise.initialize(handshakePattern string, initiator bool, prologue []byte, s, e, rs, re *KeyPair) (h handshakeState)
-	var remoteKeyPair *KeyPair
-	if c.config.RemoteKey != nil {
-		if len(c.config.RemoteKey) != 32 {
-			return errors.New("noise: the provided remote key is not 32-byte")
-		}
-		remoteKeyPair = &KeyPair{}
-		copy(remoteKeyPair.PublicKey[:], c.config.RemoteKey)
+	if timeout := c.config.handshakeTimeout(c.isClient); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
 	}
-	c.hs = initialize(c.config.HandshakePattern, c.isClient, c.config.Prologue, c.config.KeyPair, nil, remoteKeyPair, nil)
-	hs := &c.hs
 
-	// pre-shared key
-	hs.psk = c.config.PreSharedKey
+	// interrupt the handshake by closing the connection
+	stop := watchContext(ctx, c.conn)
+	err := c.handshake()
+	if ctxErr := stop(); ctxErr != nil && !c.handshakeComplete {
+		// the handshake failed because the connection was closed: the
+		// next Read and Write return the same error
+		err = ctxErr
+		c.handshakeErr = err
+	}
+	return err
+}
 
-	// start handshake
-	var c1, c2 *cipherState
-	var err error
-	var receivedPayload []byte
-ContinueHandshake:
-	if hs.shouldWrite {
-		// we're writing the next message pattern
-		// if it's the message pattern and we're sending a static key, we also send a proof
-		// TODO: is this the best way of sending a proof :/ ?
-		var bufToWrite []byte
-		var proof []byte
-		if len(hs.messagePatterns) <= 2 {
-			proof = c.config.StaticPublicKeyProof
-		}
-		c1, c2, err = hs.writeMessage(proof, &bufToWrite)
-		if err != nil {
-			return err
+// watchContext closes conn if ctx is done before stop is called. stop
+// returns ctx.Err() if conn was closed.
+func watchContext(ctx context.Context, conn io.Closer) (stop func() error) {
+	if ctx.Done() == nil {
+		return func() error { return nil }
+	}
+	done := make(chan struct{})
+	interrupted := make(chan error, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+			interrupted <- ctx.Err()
+		case <-done:
+			interrupted <- nil
 		}
-		// header (length)
-		length := []byte{byte(len(bufToWrite) >> 8), byte(len(bufToWrite) % 256)}
-		// write
-		_, err = c.conn.Write(append(length, bufToWrite...))
+	}()
+	return func() error {
+		close(done)
+		return <-interrupted
+	}
+}
+
+// handshake runs the handshake, it must be called with the handshakeMutex
+func (c *Conn) handshake() error {
+	// a server can pick its configuration before processing any token,
+	// NoiseSocket servers first read the negotiation data of the client
+	clientConfig := !c.isClient && c.config.GetConfigForClient != nil
+	if clientConfig && !c.config.NoiseSocket {
+		config, err := c.configForClient(nil)
 		if err != nil {
+			c.handshakeErr = err
 			return err
 		}
+		c.config = config
+	}
 
-	} else {
-		// we're reading the next message pattern, as well as reacting to any received data
-		bufHeader, err := readFromUntil(c.conn, 2) // length header
-		if err != nil {
+	// Noise.initialize(protocol, initiator bool, prologue []byte, s, e, rs, re *KeyPair) (h handshakeState, err error)
+	var protocol protocol
+	var keyPair, remoteKeyPair *KeyPair
+	var err error
+	if !clientConfig || !c.config.NoiseSocket {
+		if protocol, err = c.config.protocol(); err != nil {
 			return err
 		}
-		length := (int(bufHeader[0]) << 8) | int(bufHeader[1])
-		if length > NoiseMessageLength {
-			return errors.New("Noise: Noise message received exceeds NoiseMessageLength")
-		}
-		noiseMessage, err := readFromUntil(c.conn, length) // noise message
-		if err != nil {
+		if keyPair, remoteKeyPair, err = c.config.keyPairs(protocol.dh); err != nil {
 			return err
 		}
-
-		c1, c2, err = hs.readMessage(noiseMessage, &receivedPayload)
-		if err != nil {
-			return err
+	}
+	var c1, c2 *cipherState
+	switch {
+	case c.config.NoisePipes:
+		c1, c2, err = c.noisePipesHandshake(protocol, remoteKeyPair)
+	case c.config.NoiseSocket:
+		c1, c2, err = c.noiseSocketHandshake(protocol, keyPair, remoteKeyPair)
+	default:
+		if err = c.initializeHandshake(protocol, c.isClient, c.config.Prologue, keyPair, nil, remoteKeyPair, nil); err == nil {
+			if c.config.Cookies {
+				c1, c2, err = c.cookieHandshake()
+			} else {
+				c1, c2, err = c.runHandshake()
+			}
 		}
-		// TODO: do something with receivedPayload
 	}
-
-	// handshake not finished
-	if c1 == nil {
-		goto ContinueHandshake
+	if err != nil {
+		// tell the peer why the handshake failed
+		if c.handshakeAlert != 0 && c.alertOut != nil {
+			// NoiseSocket has no alert records: the peer only sees the
+			// connection closing
+			if c.records() {
+				c.out = c.alertOut
+				c.writeTransportMessage(recordAlert, []byte{byte(c.handshakeAlert)})
+			}
+		} else if c.handshakeAlert != 0 {
+			c.writeHandshakeFrame([]byte{byte(c.handshakeAlert)})
+		}
+		c.handshakeErr = err
+		return err
 	}
 
 	// setup the Write and Read secure channels
 	if c1 == nil {
 		return errors.New("noise: the handshake did not return a secure channel to Write and Read from")
 	}
+	c.completeHandshake(c1, c2)
+	atomic.StoreInt32(&c.established, 1)
+	return nil
+}
 
-	// Has the other peer been authenticated so far?
-	if !c.isRemoteAuthenticated && c.config.PublicKeyVerifier != nil {
-		// test if remote static key is empty
-		isRemoteStaticKeySet := byte(0)
-		for _, val := range hs.rs.PublicKey {
-			isRemoteStaticKeySet |= val
-		}
-		if isRemoteStaticKeySet != 0 {
-			// a remote static key has been received. Verify it
-			if !c.config.PublicKeyVerifier(hs.rs.PublicKey[:], receivedPayload) {
-				return errors.New("Noise: the received public key could not be authenticated")
-			}
-		}
-	}
-
+// completeHandshake sets the secure channels up with the cipher states
+// returned by the last handshake message
+func (c *Conn) completeHandshake(c1, c2 *cipherState) {
 	// Processing the final handshake message returns two CipherState objects
 	// the first for encrypting transport messages from initiator to responder
 	// and the second for messages in the other direction.
 	if c2 != nil {
-		if c.isClient {
+		if c.hs.initiator {
 			c.out, c.in = c1, c2
 		} else {
 			c.out, c.in = c2, c1
@@ -338,12 +654,230 @@ ContinueHandshake:
 		c.out = c1
 	}
 
-	// TODO: preserve c.hs.symmetricState.h
 	// At that point the HandshakeState should be deleted except for the hash value h, which may be used for post-handshake channel binding (see Section 11.2).
+	c.handshakeHash = append([]byte{}, c.hs.symmetricState.h...)
+	c.exporterSecret = c.hs.symmetricState.exporterSecret()
 	c.hs.clear()
 	// no errors :)
 	c.handshakeComplete = true
-	return nil
+}
+
+// runHandshake writes and reads the messages of the handshake pattern of
+// c.hs until the handshake is complete.
+func (c *Conn) runHandshake() (c1, c2 *cipherState, err error) {
+	for c1 == nil {
+		if c.hs.shouldWrite {
+			c1, c2, err = c.writeHandshakeMessage(nil)
+		} else {
+			var noiseMessage []byte
+			if noiseMessage, err = c.readHandshakeFrame(); err != nil {
+				return
+			}
+			c1, c2, err = c.readHandshakeMessage(noiseMessage)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// initializeHandshake sets c.hs up for a new handshake, using the pre-shared
+// keys of the configuration
+func (c *Conn) initializeHandshake(protocol protocol, initiator bool, prologue []byte, s, e, rs, re *KeyPair) (err error) {
+	if c.hs, err = initialize(protocol, initiator, prologue, s, e, rs, re); err != nil {
+		return
+	}
+	c.hs.psks = c.config.preSharedKeys()
+	c.handshakePattern = protocol.pattern.name
+	c.oneWay = protocol.pattern.isOneWay()
+	if len(c.debugEphemerals) > 0 {
+		c.hs.debugEphemeral, c.debugEphemerals = c.debugEphemerals[0], c.debugEphemerals[1:]
+	}
+	return
+}
+
+// writeHandshakeMessage writes the next handshake message, preceded by header
+// in the same frame.
+func (c *Conn) writeHandshakeMessage(header []byte) (c1, c2 *cipherState, err error) {
+	noiseMessage, c1, c2, err := c.nextHandshakeMessage()
+	if err != nil {
+		return
+	}
+	err = c.writeHandshakeFrame(append(append([]byte{}, header...), noiseMessage...))
+	return
+}
+
+// nextHandshakeMessage returns the next handshake message, without sending it
+func (c *Conn) nextHandshakeMessage() (noiseMessage []byte, c1, c2 *cipherState, err error) {
+	hs := &c.hs
+	messageIndex := c.handshakeMessages
+	c.handshakeMessages++
+
+	// if we're sending our static key in this message, we also send a proof
+	var proof []byte
+	if len(hs.messagePatterns) > 0 && hs.messagePatterns[0].contains(token_s) {
+		proof = c.config.StaticPublicKeyProof
+	}
+	var data []byte
+	if c.config.HandshakePayload != nil {
+		data = c.config.HandshakePayload(messageIndex)
+	}
+	payload, err := encodeHandshakePayload(proof, data)
+	if err != nil {
+		return
+	}
+	if c.paddedBodies() {
+		// leave room for the keys of the message and a Noise Pipes or
+		// cookie header
+		maxLength := c.maxNoiseMessageLength() - hs.maxTokensLength()
+		if c.config.NoisePipes {
+			maxLength--
+		}
+		if c.config.Cookies {
+			maxLength -= 1 + cookieSize + cookieSolutionSize
+		}
+		if payload, err = encodeNoiseSocketBody(payload, c.paddingLength(len(payload), maxLength)); err != nil {
+			return
+		}
+	}
+
+	c1, c2, err = hs.writeMessage(payload, &noiseMessage)
+	return
+}
+
+// writeHandshakeFrame writes a handshake message in a frame
+func (c *Conn) writeHandshakeFrame(noiseMessage []byte) error {
+	if c.config.NoiseSocket {
+		_, err := c.writeNoiseSocketMessage(nil, noiseMessage)
+		return err
+	}
+	if len(noiseMessage) > NoiseMessageLength {
+		return errors.New("noise: the handshake message exceeds NoiseMessageLength")
+	}
+	// header (length)
+	length := []byte{byte(len(noiseMessage) >> 8), byte(len(noiseMessage) % 256)}
+	// write
+	_, err := c.conn.Write(append(length, noiseMessage...))
+	return err
+}
+
+// readHandshakeFrame reads the next handshake frame from the socket
+func (c *Conn) readHandshakeFrame() ([]byte, error) {
+	if c.config.NoiseSocket {
+		negotiationData, noiseMessage, err := c.readNoiseSocketMessage()
+		if err == nil && len(negotiationData) > 0 {
+			c.handshakeAlert = AlertUnexpectedMessage
+			err = errUnexpectedNegotiationData
+		}
+		if err == nil {
+			err = alertFrame(noiseMessage)
+		}
+		return noiseMessage, err
+	}
+	bufHeader, err := readFromUntil(c.conn, 2) // length header
+	if err != nil {
+		return nil, err
+	}
+	length := (int(bufHeader[0]) << 8) | int(bufHeader[1])
+	if length > NoiseMessageLength {
+		return nil, errors.New("Noise: Noise message received exceeds NoiseMessageLength")
+	}
+	noiseMessage, err := readFromUntil(c.conn, length) // noise message
+	if err == nil {
+		err = alertFrame(noiseMessage)
+	}
+	return noiseMessage, err
+}
+
+var errRemoteNotAuthenticated = errors.New("Noise: the received public key could not be authenticated")
+
+// readHandshakeMessage processes the next handshake message, as well as
+// reacting to any received data
+func (c *Conn) readHandshakeMessage(noiseMessage []byte) (c1, c2 *cipherState, err error) {
+	hs := &c.hs
+
+	// is the remote peer sending its static key in this message?
+	receivingStatic := len(hs.messagePatterns) > 0 && hs.messagePatterns[0].contains(token_s)
+
+	messageIndex := c.handshakeMessages
+	c.handshakeMessages++
+
+	var payload []byte
+	c1, c2, err = hs.readMessage(noiseMessage, &payload)
+	if err != nil {
+		c.handshakeAlert = AlertDecryptError
+		return
+	}
+	// after the final message, the peer only accepts encrypted alerts
+	if c1 != nil && c2 != nil {
+		final := c2
+		if hs.initiator {
+			final = c1
+		}
+		defer func() {
+			if err != nil {
+				c.alertOut = final
+			}
+		}()
+	}
+	if c.paddedBodies() {
+		if payload, err = decodeNoiseSocketBody(payload); err != nil {
+			c.handshakeAlert = AlertDecodeError
+			return nil, nil, err
+		}
+	}
+	proof, data, err := decodeHandshakePayload(payload)
+	if err != nil {
+		c.handshakeAlert = AlertDecodeError
+		return nil, nil, err
+	}
+
+	// a remote static key has been received along with a proof. Verify it
+	if receivingStatic && c.config.PublicKeyVerifier != nil {
+		if !c.config.PublicKeyVerifier(hs.rs.PublicKey, proof) {
+			c.handshakeAlert = AlertBadPublicKey
+			return nil, nil, errRemoteNotAuthenticated
+		}
+		c.isRemoteAuthenticated = true
+	}
+
+	// deliver the application data
+	if c.config.OnHandshakePayload != nil {
+		if err = c.config.OnHandshakePayload(messageIndex, data); err != nil {
+			c.handshakeAlert = AlertPayloadRejected
+			return nil, nil, err
+		}
+	}
+	c.handshakePayloads = append(c.handshakePayloads, data)
+	return
+}
+
+// Handshake payloads are sent in an envelope, so that the proof over a static
+// key and the application data can be sent in the same handshake message:
+//
+//	proof length (2 bytes, big-endian) || proof || application data
+func encodeHandshakePayload(proof, data []byte) ([]byte, error) {
+	if len(proof) > 0xffff {
+		return nil, configError("noise: the static public key proof is too large")
+	}
+	payload := make([]byte, 2, 2+len(proof)+len(data))
+	payload[0], payload[1] = byte(len(proof)>>8), byte(len(proof))
+	payload = append(payload, proof...)
+	return append(payload, data...), nil
+}
+
+// decodeHandshakePayload parses the envelope of a handshake payload, see
+// encodeHandshakePayload()
+func decodeHandshakePayload(payload []byte) (proof, data []byte, err error) {
+	if len(payload) < 2 {
+		return nil, nil, errors.New("noise: the received handshake payload is too short")
+	}
+	proofLength := int(payload[0])<<8 | int(payload[1])
+	if len(payload) < 2+proofLength {
+		return nil, nil, errors.New("noise: the received handshake payload is malformed")
+	}
+	return payload[2 : 2+proofLength], payload[2+proofLength:], nil
 }
 
 // IsRemoteAuthenticated can be used to check if the remote peer has been properly authenticated. It serves no real purpose for the moment as the handshake will not go through if a peer is not properly authenticated in patterns where the peer needs to be authenticated.
@@ -351,13 +885,59 @@ func (c *Conn) IsRemoteAuthenticated() bool {
 	return c.isRemoteAuthenticated
 }
 
+// HandshakePayloads returns the application data that the remote peer sent
+// in each of its handshake messages, in order (see Config.HandshakePayload).
+func (c *Conn) HandshakePayloads() ([][]byte, error) {
+	if !c.handshakeComplete {
+		return nil, errors.New("noise: handshake not completed")
+	}
+	return c.handshakePayloads, nil
+}
+
+// HandshakeHash returns the hash of the whole handshake (the final value h of
+// the handshake). Both peers obtain the same value, unique to the session,
+// which can be used for channel binding (see section 11.2 of the
+// specification): for example, signing it with an identity key proves to
+// the remote peer that the signer is at the other end of this session.
+func (c *Conn) HandshakeHash() ([]byte, error) {
+	if !c.handshakeComplete {
+		return nil, errors.New("noise: handshake not completed")
+	}
+	return append([]byte{}, c.handshakeHash...), nil
+}
+
+// ExportKeyingMaterial derives length bytes of keying material from the
+// session, in the manner of RFC 5705. Both peers obtain the same bytes for
+// the same label and context, and different labels or contexts give
+// independent secrets. This can be used to derive keys for other purposes
+// than the connection itself, for example to encrypt data at rest or to
+// protect an auxiliary channel. length can't be larger than 255 times the
+// output size of the hash function.
+//
+// The material is derived with HKDF from an exporter secret, itself derived
+// from the final chaining key and handshake hash:
+//
+//	exporter_secret = HKDF(ck, h)[0]
+//	output = HKDF-Expand(HMAC(exporter_secret, label), context, length)
+func (c *Conn) ExportKeyingMaterial(label, context []byte, length int) ([]byte, error) {
+	if !c.handshakeComplete {
+		return nil, errors.New("noise: handshake not completed")
+	}
+	hash := c.hs.symmetricState.hash
+	if length < 0 || length > 255*hash.hashLen {
+		return nil, errors.New("noise: invalid length for exported keying material")
+	}
+	prk := hash.hmacHash(c.exporterSecret, label)
+	return hash.hkdfExpand(prk, context, length), nil
+}
+
 // StaticKey returns the static key of the remote peer. It is useful in case the
 // static key is only transmitted during the handshake.
 func (c *Conn) StaticKey() ([]byte, error) {
 	if !c.handshakeComplete {
 		return nil, errors.New("noise: handshake not completed")
 	}
-	return c.hs.rs.PublicKey[:], nil
+	return c.hs.rs.PublicKey, nil
 }
 
 //
@@ -367,15 +947,12 @@ func (c *Conn) StaticKey() ([]byte, error) {
 func readFromUntil(r io.Reader, n int) ([]byte, error) {
 	result := make([]byte, n)
 	offset := 0
-	for {
+	for offset < n {
 		m, err := r.Read(result[offset:])
 		if err != nil {
 			return result, err
 		}
 		offset += m
-		if offset == n {
-			break
-		}
 	}
 	return result, nil
 }
@@ -2,6 +2,8 @@ package noise
 
 import (
 	"bytes"
+	"encoding/hex"
+	"errors"
 	"testing"
 )
 
@@ -32,6 +34,7 @@ func TestSeveralWriteRoutines(t *testing.T) {
 	addr := listener.Addr().String()
 
 	// run the server and Accept one connection
+	done := make(chan struct{})
 	go func() {
 		serverSocket, err2 := listener.Accept()
 		if err2 != nil {
@@ -40,7 +43,7 @@ func TestSeveralWriteRoutines(t *testing.T) {
 
 		var buf [100]byte
 
-		for {
+		for i := 0; i < 100; i++ {
 			n, err2 := serverSocket.Read(buf[:])
 			if err2 != nil {
 				t.Fatal("server can't read on socket")
@@ -52,6 +55,7 @@ func TestSeveralWriteRoutines(t *testing.T) {
 			//fmt.Println("server received:", string(buf[:n]))
 		}
 
+		close(done)
 	}()
 
 	// Run the client
@@ -62,13 +66,15 @@ func TestSeveralWriteRoutines(t *testing.T) {
 
 	for i := 0; i < 100; i++ {
 		go func(i int) {
-			message := "hello " + string(i)
-			_, err = clientSocket.Write([]byte(message))
-			if err != nil {
-				t.Fatal("client can't write on socket")
+			message := "hello " + string(rune(i))
+			if _, err := clientSocket.Write([]byte(message)); err != nil {
+				t.Error("client can't write on socket")
 			}
 		}(i)
 	}
+
+	// wait for the server to receive every message
+	<-done
 }
 
 func TestHalfDuplex(t *testing.T) {
@@ -96,6 +102,7 @@ func TestHalfDuplex(t *testing.T) {
 	addr := listener.Addr().String()
 
 	// run the server and Accept one connection
+	done := make(chan struct{})
 	go func() {
 		serverSocket, err2 := listener.Accept()
 		if err2 != nil {
@@ -104,7 +111,7 @@ func TestHalfDuplex(t *testing.T) {
 
 		var buf [100]byte
 
-		for {
+		for i := 0; i < 100; i++ {
 			n, err2 := serverSocket.Read(buf[:])
 			if err2 != nil {
 				t.Fatal("server can't read on socket")
@@ -116,6 +123,7 @@ func TestHalfDuplex(t *testing.T) {
 			//fmt.Println("server received:", string(buf[:n]))
 		}
 
+		close(done)
 	}()
 
 	// Run the client
@@ -126,11 +134,240 @@ func TestHalfDuplex(t *testing.T) {
 
 	for i := 0; i < 100; i++ {
 		go func(i int) {
-			message := "hello " + string(i)
-			_, err = clientSocket.Write([]byte(message))
-			if err != nil {
-				t.Fatal("client can't write on socket")
+			message := "hello " + string(rune(i))
+			if _, err := clientSocket.Write([]byte(message)); err != nil {
+				t.Error("client can't write on socket")
 			}
 		}(i)
 	}
+
+	// wait for the server to receive every message
+	<-done
+}
+
+func TestHandshakePayloads(t *testing.T) {
+	clientKeyPair := GenerateKeypair(nil)
+	serverKeyPair := GenerateKeypair(nil)
+
+	// the client sends its version in the first message, the server
+	// its feature flags in the second one, and the client a last word
+	clientPayloads := map[int][]byte{0: []byte("version 1.2"), 2: []byte("thanks")}
+	serverPayloads := map[int][]byte{1: []byte("flags: compression")}
+	var clientReceived, serverReceived [][]byte
+
+	clientConfig := &Config{
+		HandshakePattern:     Noise_XX,
+		KeyPair:              clientKeyPair,
+		StaticPublicKeyProof: CreateStaticPublicKeyProof(rootKey.privateKey, clientKeyPair),
+		PublicKeyVerifier:    publicKeyVerifier,
+		HandshakePayload:     func(messageIndex int) []byte { return clientPayloads[messageIndex] },
+		OnHandshakePayload: func(messageIndex int, payload []byte) error {
+			if messageIndex != 1 {
+				t.Errorf("the client received message %d", messageIndex)
+			}
+			clientReceived = append(clientReceived, payload)
+			return nil
+		},
+	}
+	serverConfig := &Config{
+		HandshakePattern:     Noise_XX,
+		KeyPair:              serverKeyPair,
+		StaticPublicKeyProof: CreateStaticPublicKeyProof(rootKey.privateKey, serverKeyPair),
+		PublicKeyVerifier:    publicKeyVerifier,
+		HandshakePayload:     func(messageIndex int) []byte { return serverPayloads[messageIndex] },
+		OnHandshakePayload: func(messageIndex int, payload []byte) error {
+			serverReceived = append(serverReceived, payload)
+			return nil
+		},
+	}
+	testPatternOverConn(t, clientConfig, serverConfig)
+
+	if len(clientReceived) != 1 || !bytes.Equal(clientReceived[0], serverPayloads[1]) {
+		t.Fatal("the client did not receive the server's payload")
+	}
+	if len(serverReceived) != 2 || !bytes.Equal(serverReceived[0], clientPayloads[0]) || !bytes.Equal(serverReceived[1], clientPayloads[2]) {
+		t.Fatal("the server did not receive the client's payloads")
+	}
+}
+
+func TestHandshakePayloadRejected(t *testing.T) {
+	serverKeyPair := GenerateKeypair(nil)
+	serverConfig := &Config{
+		HandshakePattern: Noise_NK,
+		KeyPair:          serverKeyPair,
+		OnHandshakePayload: func(messageIndex int, payload []byte) error {
+			if !bytes.Equal(payload, []byte("version 2")) {
+				return errors.New("unsupported version")
+			}
+			return nil
+		},
+	}
+	clientConfig := &Config{
+		HandshakePattern: Noise_NK,
+		RemoteKey:        serverKeyPair.PublicKey,
+		HandshakePayload: func(int) []byte { return []byte("version 1") },
+	}
+
+	listener, err := Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal("cannot setup a listener on localhost:", err)
+	}
+	defer listener.Close()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverSocket, err := listener.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		defer serverSocket.Close()
+		serverErr <- serverSocket.(*Conn).Handshake()
+	}()
+
+	// the handshake is run by Dial
+	if _, err := Dial("tcp", listener.Addr().String(), clientConfig); err == nil {
+		t.Fatal("the client should not complete the handshake")
+	}
+	if err := <-serverErr; err == nil || err.Error() != "unsupported version" {
+		t.Fatal("the server should have aborted the handshake:", err)
+	}
+}
+
+func TestHandshakePayloadEnvelope(t *testing.T) {
+	payload, err := encodeHandshakePayload([]byte("proof"), []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof, data, err := decodeHandshakePayload(payload)
+	if err != nil || !bytes.Equal(proof, []byte("proof")) || !bytes.Equal(data, []byte("data")) {
+		t.Fatal("the envelope was not decoded properly")
+	}
+	if _, _, err = decodeHandshakePayload([]byte{0}); err == nil {
+		t.Fatal("a truncated envelope should not be accepted")
+	}
+	if _, _, err = decodeHandshakePayload([]byte{0, 10, 1, 2}); err == nil {
+		t.Fatal("an envelope with a truncated proof should not be accepted")
+	}
+}
+
+func TestHandshakeHash(t *testing.T) {
+	serverKeyPair := GenerateKeypair(nil)
+	listener, err := Listen("tcp", "127.0.0.1:0", &Config{HandshakePattern: Noise_NK, KeyPair: serverKeyPair})
+	if err != nil {
+		t.Fatal("cannot setup a listener on localhost:", err)
+	}
+	defer listener.Close()
+
+	serverHashes := make(chan []byte)
+	go func() {
+		for {
+			serverSocket, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			var hash []byte
+			if err = serverSocket.(*Conn).Handshake(); err == nil {
+				hash, _ = serverSocket.(*Conn).HandshakeHash()
+			}
+			serverHashes <- hash
+			serverSocket.Close()
+		}
+	}()
+
+	var previousHash []byte
+	for i := 0; i < 2; i++ {
+		clientSocket, err := Dial("tcp", listener.Addr().String(), &Config{HandshakePattern: Noise_NK, RemoteKey: serverKeyPair.PublicKey})
+		if err != nil {
+			t.Fatal("client can't connect to server", err)
+		}
+		clientHash, err := clientSocket.HandshakeHash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(clientHash) != 32 || !bytes.Equal(clientHash, <-serverHashes) {
+			t.Fatal("the client and the server should have the same handshake hash")
+		}
+		if bytes.Equal(clientHash, previousHash) {
+			t.Fatal("two sessions should not have the same handshake hash")
+		}
+		previousHash = clientHash
+		clientSocket.Close()
+	}
+
+	// the handshake hash is only available after the handshake
+	if _, err := (&Conn{}).HandshakeHash(); err == nil {
+		t.Fatal("the handshake hash should not be available before the handshake")
+	}
+}
+
+func TestExportKeyingMaterial(t *testing.T) {
+	serverKeyPair := GenerateKeypair(nil)
+	listener, err := Listen("tcp", "127.0.0.1:0", &Config{HandshakePattern: Noise_NK, KeyPair: serverKeyPair, HashFunction: HashBLAKE2b})
+	if err != nil {
+		t.Fatal("cannot setup a listener on localhost:", err)
+	}
+	defer listener.Close()
+
+	serverMaterial := make(chan []byte, 1)
+	go func() {
+		serverSocket, err := listener.Accept()
+		if err != nil {
+			serverMaterial <- nil
+			return
+		}
+		defer serverSocket.Close()
+		var material []byte
+		if err = serverSocket.(*Conn).Handshake(); err == nil {
+			material, _ = serverSocket.(*Conn).ExportKeyingMaterial([]byte("blobs"), []byte("user 1"), 100)
+		}
+		serverMaterial <- material
+	}()
+
+	clientSocket, err := Dial("tcp", listener.Addr().String(), &Config{HandshakePattern: Noise_NK, RemoteKey: serverKeyPair.PublicKey, HashFunction: HashBLAKE2b})
+	if err != nil {
+		t.Fatal("client can't connect to server", err)
+	}
+	defer clientSocket.Close()
+
+	material, err := clientSocket.ExportKeyingMaterial([]byte("blobs"), []byte("user 1"), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(material) != 100 || !bytes.Equal(material, <-serverMaterial) {
+		t.Fatal("the client and the server should export the same keying material")
+	}
+
+	// different labels, contexts or lengths give different keys
+	otherLabel, _ := clientSocket.ExportKeyingMaterial([]byte("media"), []byte("user 1"), 100)
+	otherContext, _ := clientSocket.ExportKeyingMaterial([]byte("blobs"), []byte("user 2"), 100)
+	if bytes.Equal(material, otherLabel) || bytes.Equal(material, otherContext) {
+		t.Fatal("different labels and contexts should export different keying material")
+	}
+	shorter, _ := clientSocket.ExportKeyingMaterial([]byte("blobs"), []byte("user 1"), 32)
+	if !bytes.Equal(shorter, material[:32]) {
+		t.Fatal("shorter keying material should be a prefix of longer keying material")
+	}
+
+	// the exported keys are not the transport keys
+	if bytes.Contains(material, clientSocket.out.k[:]) || bytes.Contains(material, clientSocket.in.k[:]) {
+		t.Fatal("the exported keying material should not contain the transport keys")
+	}
+
+	if _, err = clientSocket.ExportKeyingMaterial(nil, nil, 255*64+1); err == nil {
+		t.Fatal("the length of the keying material should be limited")
+	}
+	if _, err = (&Conn{}).ExportKeyingMaterial(nil, nil, 32); err == nil {
+		t.Fatal("keying material should not be exported before the handshake")
+	}
+}
+
+func TestHKDFExpand(t *testing.T) {
+	// RFC 5869, test case 1
+	prk, _ := hex.DecodeString("077709362c2e32df0ddc3f0dc47bba6390b6c73bb50f9c3122ec844ad7c2b3e5")
+	info, _ := hex.DecodeString("f0f1f2f3f4f5f6f7f8f9")
+	expected, _ := hex.DecodeString("3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf34007208d5b887185865")
+	if okm := hashes[HashSHA256].hkdfExpand(prk, info, 42); !bytes.Equal(okm, expected) {
+		t.Fatalf("wrong HKDF-Expand output %x", okm)
+	}
 }
@@ -0,0 +1,127 @@
+package noise
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHandshakeContext(t *testing.T) {
+	client, server := newNKPair()
+	defer server.conn.Close()
+
+	// nobody answers the client
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if err := client.HandshakeContext(ctx); err != context.Canceled {
+		t.Fatal("the handshake should have been cancelled, got", err)
+	}
+	if _, err := client.Write([]byte("hello")); err != context.Canceled {
+		t.Fatal("the Writes should fail with the error of the handshake, got", err)
+	}
+	// the underlying connection was closed
+	if _, err := server.conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("the underlying connection should have been closed")
+	}
+
+	// a completed handshake is not affected by its context
+	client, server = newNKPair()
+	defer client.conn.Close()
+	go server.Read(make([]byte, 10))
+	ctx, cancel = context.WithCancel(context.Background())
+	if err := client.HandshakeContext(ctx); err != nil {
+		t.Fatal("the handshake failed:", err)
+	}
+	cancel()
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatal("the connection should outlive the context of its handshake:", err)
+	}
+}
+
+func TestServerHandshakeTimeout(t *testing.T) {
+	if timeout := (&Config{}).handshakeTimeout(false); timeout != DefaultHandshakeTimeout {
+		t.Fatal("servers should default to DefaultHandshakeTimeout, not", timeout)
+	}
+	if timeout := (&Config{HandshakeTimeout: -1}).handshakeTimeout(false); timeout != 0 {
+		t.Fatal("a negative HandshakeTimeout should disable the timeout, not", timeout)
+	}
+	if timeout := (&Config{}).handshakeTimeout(true); timeout != 0 {
+		t.Fatal("clients should have no timeout by default, not", timeout)
+	}
+
+	// a client connects but never sends anything
+	serverConfig := Config{HandshakePattern: Noise_NK, KeyPair: GenerateKeypair(nil), HandshakeTimeout: 50 * time.Millisecond}
+	listener, err := Listen("tcp", "127.0.0.1:0", &serverConfig)
+	if err != nil {
+		t.Fatal("cannot setup a listener on localhost:", err)
+	}
+	defer listener.Close()
+	rawClient, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal("cannot connect to the listener:", err)
+	}
+	defer rawClient.Close()
+
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatal("cannot accept a connection:", err)
+	}
+	if _, err = server.Read(make([]byte, 10)); err != context.DeadlineExceeded {
+		t.Fatal("the handshake of the server should have timed out, got", err)
+	}
+}
+
+func TestDialContext(t *testing.T) {
+	serverKeyPair := GenerateKeypair(nil)
+	l, err := Listen("tcp", "127.0.0.1:0", &Config{HandshakePattern: Noise_NK, KeyPair: serverKeyPair})
+	if err != nil {
+		t.Fatal("cannot setup a listener on localhost:", err)
+	}
+	defer l.Close()
+	addr := l.Addr().String()
+
+	// the first connection is echoed, the second one is never answered
+	go func() {
+		server, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer server.Close()
+		buf := make([]byte, 10)
+		n, err := server.Read(buf)
+		if err == nil {
+			server.Write(buf[:n])
+		}
+		silent, err := l.(*listener).Listener.Accept()
+		if err == nil {
+			defer silent.Close()
+			io.Copy(ioutil.Discard, silent)
+		}
+	}()
+
+	dialer := Dialer{Config: &Config{HandshakePattern: Noise_NK, RemoteKey: serverKeyPair.PublicKey}}
+	conn, err := dialer.DialContext(context.Background(), "tcp", addr)
+	if err != nil {
+		t.Fatal("cannot dial:", err)
+	}
+	if _, err = conn.Write([]byte("hello")); err != nil {
+		t.Fatal("client can't write:", err)
+	}
+	buf := make([]byte, 10)
+	if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "hello" {
+		t.Fatal("the server should have echoed the message, got", err)
+	}
+	conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err = dialer.DialContext(ctx, "tcp", addr); err != context.DeadlineExceeded {
+		t.Fatal("the dial should have timed out, got", err)
+	}
+	if _, err = (&Dialer{}).Dial("tcp", addr); err == nil {
+		t.Fatal("a Dialer without Config should not dial")
+	}
+}
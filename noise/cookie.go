@@ -0,0 +1,309 @@
+package noise
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//
+// Cookies
+//
+// With Config.Cookies, a server under load does not process the first
+// handshake message of a client (which costs DH operations) before the
+// client echoes a cookie, as with the cookie reply of WireGuard. Cookies are
+// MACs of the address of the client with a secret rotated every two minutes,
+// so that the server keeps no state for the clients.
+//
+// Over datagrams, the cookie proves that the client receives datagrams at
+// its address. The first handshake datagram of the client carries a cookie,
+// empty at first:
+//
+//	handshake: 1 || 0 || cookie length (1 byte) || cookie || first handshake message
+//	cookie:    4 || cookie
+//
+// Over TCP, the address of the client is already proven by the TCP
+// handshake: the client also pays for the cookie with a proof of work, a
+// solution such that SHA-256(cookie || solution || first handshake message)
+// starts with Config.CookieDifficulty zero bits. The first handshake frame of
+// the client and the first answer of the server carry a header:
+//
+//	client: token length (1 byte) || cookie || solution (8 bytes) || first handshake message
+//	server: 0 || second handshake message
+//	        1 || difficulty (1 byte) || cookie
+//
+// The token is empty in the first frame of the client.
+//
+
+const (
+	cookieMessage byte = iota
+	cookieReply
+)
+
+const (
+	cookieSize           = 16
+	cookieSecretLifetime = 2 * time.Minute
+	// size of the solution of the proof of work
+	cookieSolutionSize = 8
+	// DefaultCookieDifficulty is the difficulty of the proof of work of the
+	// cookies over TCP when Config.CookieDifficulty is not set
+	DefaultCookieDifficulty = 16
+	// maxCookieDifficulty is the hardest proof of work a client accepts
+	maxCookieDifficulty = 24
+)
+
+var (
+	errInvalidCookie     = errors.New("noise: the client did not send a valid cookie")
+	errUnexpectedCookie  = errors.New("noise: the server sent more than one cookie")
+	errMalformedCookie   = errors.New("noise: the received cookie header is malformed")
+	errCookiesNotAllowed = configError("noise: Cookies cannot be used with NoisePipes, NoiseSocket or one-way patterns")
+)
+
+// cookieDifficulty returns the difficulty of the proof of work of the cookies
+func (config *Config) cookieDifficulty() int {
+	if config.CookieDifficulty > 0 {
+		return config.CookieDifficulty
+	}
+	return DefaultCookieDifficulty
+}
+
+// A cookieJar issues and checks the cookies of a server, and measures its
+// load
+type cookieJar struct {
+	// handshakes in progress on a listener
+	handshakes int32
+
+	lock sync.Mutex
+	// current and previous secrets
+	secret, previous [32]byte
+	rotated          time.Time
+	// handshakes started during the current second
+	second  time.Time
+	started int
+}
+
+// startHandshake records the start of a handshake on a listener, and returns
+// true if the server is under load
+func (j *cookieJar) startHandshake(config *Config) bool {
+	return j.underLoad(config, int(atomic.AddInt32(&j.handshakes, 1)))
+}
+
+// endHandshake records the end of a handshake on a listener
+func (j *cookieJar) endHandshake() {
+	atomic.AddInt32(&j.handshakes, -1)
+}
+
+// underLoad records the start of a handshake, and returns true if the server
+// is under load with that many handshakes in progress
+func (j *cookieJar) underLoad(config *Config, handshakes int) bool {
+	j.lock.Lock()
+	now := time.Now()
+	if now.Sub(j.second) >= time.Second {
+		j.second, j.started = now, 0
+	}
+	j.started++
+	started := j.started
+	j.lock.Unlock()
+
+	if config.CookieHandshakes == 0 && config.CookieHandshakeRate == 0 {
+		return true
+	}
+	return (config.CookieHandshakes > 0 && handshakes >= config.CookieHandshakes) ||
+		(config.CookieHandshakeRate > 0 && started >= config.CookieHandshakeRate)
+}
+
+// secrets returns the current and previous secrets, rotating them if needed
+func (j *cookieJar) secrets() (secret, previous [32]byte) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if time.Since(j.rotated) >= cookieSecretLifetime {
+		j.previous = j.secret
+		if _, err := rand.Read(j.secret[:]); err != nil {
+			panic("noise: no source of randomness for the cookies: " + err.Error())
+		}
+		// a secret older than two lifetimes is not valid anymore
+		if time.Since(j.rotated) >= 2*cookieSecretLifetime {
+			j.previous = j.secret
+		}
+		j.rotated = time.Now()
+	}
+	return j.secret, j.previous
+}
+
+func cookieMAC(secret [32]byte, address string) []byte {
+	mac := hmac.New(sha256.New, secret[:])
+	mac.Write([]byte(address))
+	return mac.Sum(nil)[:cookieSize]
+}
+
+// cookie returns a cookie for the address
+func (j *cookieJar) cookie(address string) []byte {
+	secret, _ := j.secrets()
+	return cookieMAC(secret, address)
+}
+
+// valid returns true if the cookie was issued for the address
+func (j *cookieJar) valid(cookie []byte, address string) bool {
+	secret, previous := j.secrets()
+	return hmac.Equal(cookie, cookieMAC(secret, address)) || hmac.Equal(cookie, cookieMAC(previous, address))
+}
+
+//
+// Proof of work
+//
+
+// cookieWork returns the number of leading zero bits of the proof of work
+func cookieWork(cookie, solution, noiseMessage []byte) int {
+	h := sha256.New()
+	h.Write(cookie)
+	h.Write(solution)
+	h.Write(noiseMessage)
+	zeros := 0
+	for _, b := range h.Sum(nil) {
+		zeros += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+	return zeros
+}
+
+// solveCookie returns a solution of the proof of work
+func solveCookie(cookie, noiseMessage []byte, difficulty int) []byte {
+	solution := make([]byte, cookieSolutionSize)
+	for n := uint64(0); ; n++ {
+		binary.BigEndian.PutUint64(solution, n)
+		if cookieWork(cookie, solution, noiseMessage) >= difficulty {
+			return solution
+		}
+	}
+}
+
+//
+// Over TCP
+//
+
+// cookieHandshake runs the handshake of c.hs, with the cookie headers
+// around the first two handshake messages
+func (c *Conn) cookieHandshake() (c1, c2 *cipherState, err error) {
+	if c.isClient {
+		c1, c2, err = c.cookieClient()
+	} else {
+		// the load of the listener accounts for the whole handshake
+		jar := c.cookies
+		if jar == nil {
+			jar = new(cookieJar)
+		}
+		underLoad := jar.startHandshake(c.config)
+		defer jar.endHandshake()
+		c1, c2, err = c.cookieServer(jar, underLoad)
+	}
+	if err != nil || c1 != nil {
+		return
+	}
+	return c.runHandshake()
+}
+
+// cookieClient writes the first handshake message, again with a cookie and
+// its proof of work if the server asks for it, and reads the answer of the
+// server
+func (c *Conn) cookieClient() (c1, c2 *cipherState, err error) {
+	noiseMessage, _, _, err := c.nextHandshakeMessage()
+	if err != nil {
+		return
+	}
+	var token, frame []byte
+	for {
+		header := append([]byte{byte(len(token))}, token...)
+		if err = c.writeHandshakeFrame(append(header, noiseMessage...)); err != nil {
+			return
+		}
+		if frame, err = c.readHandshakeFrame(); err != nil {
+			return
+		}
+		switch {
+		case len(frame) > 0 && frame[0] == cookieMessage:
+			return c.readHandshakeMessage(frame[1:])
+		case len(frame) == 2+cookieSize && frame[0] == cookieReply && token == nil && frame[1] <= maxCookieDifficulty:
+			cookie := frame[2:]
+			token = append(append([]byte{}, cookie...), solveCookie(cookie, noiseMessage, int(frame[1]))...)
+		case len(frame) > 0 && frame[0] == cookieReply && token != nil:
+			c.handshakeAlert = AlertUnexpectedMessage
+			return nil, nil, errUnexpectedCookie
+		default:
+			c.handshakeAlert = AlertDecodeError
+			return nil, nil, errMalformedCookie
+		}
+	}
+}
+
+// cookieServer reads the first handshake message, only processing it once
+// it comes with a valid cookie and proof of work if the server is under
+// load, and writes the answer
+func (c *Conn) cookieServer(jar *cookieJar, underLoad bool) (c1, c2 *cipherState, err error) {
+	address := c.conn.RemoteAddr().String()
+	difficulty := c.config.cookieDifficulty()
+	var frame, noiseMessage []byte
+	for sent := false; ; sent = true {
+		if frame, err = c.readHandshakeFrame(); err != nil {
+			return
+		}
+		if len(frame) == 0 || len(frame) < 1+int(frame[0]) {
+			c.handshakeAlert = AlertDecodeError
+			return nil, nil, errMalformedCookie
+		}
+		token := frame[1 : 1+frame[0]]
+		noiseMessage = frame[1+len(token):]
+		if !underLoad || (len(token) == cookieSize+cookieSolutionSize && jar.valid(token[:cookieSize], address) &&
+			cookieWork(token[:cookieSize], token[cookieSize:], noiseMessage) >= difficulty) {
+			break
+		}
+		if sent {
+			c.handshakeAlert = AlertUnexpectedMessage
+			return nil, nil, errInvalidCookie
+		}
+		// the DH operations wait for the client to echo a cookie
+		reply := append([]byte{cookieReply, byte(difficulty)}, jar.cookie(address)...)
+		if err = c.writeHandshakeFrame(reply); err != nil {
+			return
+		}
+	}
+	if c1, c2, err = c.readHandshakeMessage(noiseMessage); err != nil || c1 != nil {
+		return
+	}
+	return c.writeHandshakeMessage([]byte{cookieMessage})
+}
+
+//
+// Over datagrams
+//
+
+// cookieDatagram returns the first handshake datagram of a client
+func cookieDatagram(cookie, noiseMessage []byte) []byte {
+	datagram := append([]byte{packetHandshake, 0, byte(len(cookie))}, cookie...)
+	return append(datagram, noiseMessage...)
+}
+
+// checkCookie returns the first handshake message of a client, or false if
+// the datagram must be ignored: a server under load then replies with a
+// cookie for the address of the client, unless it already came with one
+func (p *PacketConn) checkCookie(message []byte, addr net.Addr) ([]byte, bool) {
+	if len(message) == 0 || len(message) < 1+int(message[0]) {
+		return nil, false
+	}
+	cookie := message[1 : 1+message[0]]
+	// a PacketConn has a single handshake in progress
+	if p.cookies.underLoad(p.config, 0) && !p.cookies.valid(cookie, addr.String()) {
+		// the DH operations wait for the client to echo a cookie
+		p.conn.WriteTo(append([]byte{packetCookie}, p.cookies.cookie(addr.String())...), addr)
+		return nil, false
+	}
+	return message[1+len(cookie):], true
+}
@@ -0,0 +1,252 @@
+package noise
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCookies(t *testing.T) {
+	serverKeyPair := GenerateKeypair(nil)
+	// cookies are always required
+	l, err := Listen("tcp", "127.0.0.1:0", &Config{HandshakePattern: Noise_NK, KeyPair: serverKeyPair, Cookies: true, CookieDifficulty: 8})
+	if err != nil {
+		t.Fatal("cannot setup a listener on localhost:", err)
+	}
+	defer l.Close()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 100)
+		n, err := conn.Read(buf)
+		if err == nil {
+			_, err = conn.Write(buf[:n])
+		}
+		serverErr <- err
+	}()
+
+	conn, err := Dial("tcp", l.Addr().String(), &Config{HandshakePattern: Noise_NK, RemoteKey: serverKeyPair.PublicKey, Cookies: true})
+	if err != nil {
+		t.Fatal("cannot dial:", err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte("hello")); err != nil {
+		t.Fatal("client can't write:", err)
+	}
+	buf := make([]byte, 100)
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Fatal("the server should have echoed the message, got", err)
+	}
+	if err = <-serverErr; err != nil {
+		t.Fatal("server failed:", err)
+	}
+}
+
+func TestCookieJar(t *testing.T) {
+	var jar cookieJar
+	cookie := jar.cookie("127.0.0.1:1234")
+	if !jar.valid(cookie, "127.0.0.1:1234") {
+		t.Fatal("the cookie should be valid for its address")
+	}
+	if jar.valid(cookie, "127.0.0.1:1235") || jar.valid(make([]byte, cookieSize), "127.0.0.1:1234") {
+		t.Fatal("the cookie should only be valid for its address")
+	}
+
+	// the previous secret is still accepted after a rotation
+	jar.rotated = jar.rotated.Add(-cookieSecretLifetime)
+	if !jar.valid(cookie, "127.0.0.1:1234") || bytes.Equal(cookie, jar.cookie("127.0.0.1:1234")) {
+		t.Fatal("the cookie should still be valid after one rotation")
+	}
+	jar.rotated = jar.rotated.Add(-cookieSecretLifetime)
+	if jar.valid(cookie, "127.0.0.1:1234") {
+		t.Fatal("the cookie should have expired after two rotations")
+	}
+}
+
+func TestCookieThresholds(t *testing.T) {
+	var jar cookieJar
+	config := &Config{CookieHandshakes: 2}
+	if jar.startHandshake(config) {
+		t.Fatal("a single handshake should not require cookies")
+	}
+	if !jar.startHandshake(config) {
+		t.Fatal("two handshakes in progress should require cookies")
+	}
+
+	jar = cookieJar{}
+	config = &Config{CookieHandshakeRate: 3}
+	if jar.startHandshake(config) || jar.startHandshake(config) {
+		t.Fatal("the rate should not be reached yet")
+	}
+	jar.endHandshake()
+	jar.endHandshake()
+	if !jar.startHandshake(config) {
+		t.Fatal("the third handshake of the second should require cookies")
+	}
+
+	// a PacketConn has no handshakes in progress to count
+	jar = cookieJar{}
+	config = &Config{CookieHandshakeRate: 2}
+	if jar.underLoad(config, 0) || !jar.underLoad(config, 0) {
+		t.Fatal("the second handshake of the second should require cookies")
+	}
+	if !jar.underLoad(&Config{}, 0) {
+		t.Fatal("cookies should always be required without thresholds")
+	}
+}
+
+func TestCookieWork(t *testing.T) {
+	cookie, message := make([]byte, cookieSize), []byte("first message")
+	solution := solveCookie(cookie, message, 12)
+	if cookieWork(cookie, solution, message) < 12 {
+		t.Fatal("the solution should have 12 leading zero bits")
+	}
+	if cookieWork(cookie, solution, []byte("another message")) >= 12 && cookieWork(cookie, solution, []byte("a third message")) >= 12 {
+		t.Fatal("the solution should be bound to the handshake message")
+	}
+}
+
+func TestInvalidCookie(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	server := Server(serverConn, &Config{HandshakePattern: Noise_NK, KeyPair: GenerateKeypair(nil), Cookies: true})
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.Handshake()
+	}()
+
+	// the client sends bogus cookies and proofs of work, without any valid
+	// handshake message
+	frame := func(b []byte) []byte {
+		return append([]byte{byte(len(b) >> 8), byte(len(b))}, b...)
+	}
+	bogus := append([]byte{cookieSize + cookieSolutionSize}, make([]byte, cookieSize+cookieSolutionSize+32)...)
+	for i := 0; i < 2; i++ {
+		if _, err := clientConn.Write(frame(bogus)); err != nil {
+			t.Fatal(err)
+		}
+		header := make([]byte, 2)
+		if _, err := clientConn.Read(header); err != nil {
+			t.Fatal(err)
+		}
+		answer := make([]byte, binary.BigEndian.Uint16(header))
+		if _, err := clientConn.Read(answer); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 && (answer[0] != cookieReply || len(answer) != 2+cookieSize || answer[1] != DefaultCookieDifficulty) {
+			t.Fatal("the server should have replied with a cookie")
+		}
+		if i == 1 && (len(answer) != 1 || Alert(answer[0]) != AlertUnexpectedMessage) {
+			t.Fatal("the server should have sent an alert, got", answer)
+		}
+	}
+	if err := <-serverErr; err != errInvalidCookie {
+		t.Fatal("the server should have rejected the cookie, got", err)
+	}
+}
+
+// newCookiePair returns a Noise_NK client and server over UDP requiring
+// cookies
+func newCookiePair(t *testing.T) (client, server *PacketConn, clientConn, serverConn *lossyPacketConn) {
+	listen := func() *lossyPacketConn {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal("cannot listen on localhost:", err)
+		}
+		return &lossyPacketConn{PacketConn: conn}
+	}
+	serverKeyPair := GenerateKeypair(nil)
+	clientConn, serverConn = listen(), listen()
+	client = PacketClient(clientConn, serverConn.LocalAddr(), &Config{
+		HandshakePattern: Noise_NK,
+		RemoteKey:        serverKeyPair.PublicKey,
+		Cookies:          true,
+	})
+	server = PacketServer(serverConn, &Config{HandshakePattern: Noise_NK, KeyPair: serverKeyPair, Cookies: true})
+	return
+}
+
+func TestPacketCookies(t *testing.T) {
+	client, server, clientConn, serverConn := newCookiePair(t)
+	defer client.Close()
+	defer server.Close()
+	exchange(t, client, server)
+
+	// the server replied to the first message with a cookie, which the
+	// client sent back along with the same message
+	serverConn.Lock()
+	reply := serverConn.written[0]
+	serverConn.Unlock()
+	clientConn.Lock()
+	first, second := clientConn.written[0], clientConn.written[1]
+	clientConn.Unlock()
+	if reply[0] != packetCookie || len(reply) != 1+cookieSize {
+		t.Fatal("the server should have replied with a cookie, got", reply)
+	}
+	if !bytes.Equal(first[:3], []byte{packetHandshake, 0, 0}) || !bytes.Equal(second[3:3+cookieSize], reply[1:]) ||
+		!bytes.Equal(first[3:], second[3+cookieSize:]) {
+		t.Fatal("the client should have sent its first message again with the cookie")
+	}
+}
+
+func TestInvalidPacketCookie(t *testing.T) {
+	client, server, _, _ := newCookiePair(t)
+	defer client.Close()
+	defer server.Close()
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.Handshake()
+	}()
+
+	// a bogus cookie only gets a cookie back, without any state on the server
+	spoofer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("cannot listen on localhost:", err)
+	}
+	defer spoofer.Close()
+	for i := 0; i < 2; i++ {
+		if _, err = spoofer.WriteTo(cookieDatagram(make([]byte, cookieSize), make([]byte, 48)), server.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		spoofer.SetReadDeadline(time.Now().Add(5 * time.Second))
+		reply := make([]byte, 100)
+		n, _, err := spoofer.ReadFrom(reply)
+		if err != nil || n != 1+cookieSize || reply[0] != packetCookie {
+			t.Fatal("the server should have replied with a cookie, got", reply[:n], err)
+		}
+	}
+
+	if err = client.Handshake(); err != nil {
+		t.Fatal("the client should have completed the handshake:", err)
+	}
+	if err = <-serverErr; err != nil {
+		t.Fatal("the server should have completed the handshake:", err)
+	}
+	if !sameAddr(server.RemoteAddr(), client.LocalAddr()) {
+		t.Fatal("the server should be bound to the client's address, not", server.RemoteAddr())
+	}
+}
+
+func TestCookieRequirements(t *testing.T) {
+	for _, config := range []*Config{
+		{HandshakePattern: Noise_NK, RemoteKey: GenerateKeypair(nil).PublicKey, Cookies: true, NoiseSocket: true},
+		{HandshakePattern: Noise_N, RemoteKey: GenerateKeypair(nil).PublicKey, Cookies: true},
+	} {
+		if err := config.Validate(); err != errCookiesNotAllowed {
+			t.Fatal("the configuration should have been rejected, got", err)
+		}
+	}
+	config := &Config{HandshakePattern: Noise_NK, RemoteKey: GenerateKeypair(nil).PublicKey, Cookies: true, CookieDifficulty: maxCookieDifficulty + 1}
+	if err := config.Validate(); err == nil {
+		t.Fatal("a proof of work harder than the clients accept should be rejected")
+	}
+}
@@ -2,138 +2,348 @@ package noise
 
 import (
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
+	"hash"
 	"math"
 
+	"github.com/cloudflare/circl/dh/x448"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/blake2s"
 	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/curve25519"
 )
 
 //
-// The following code defines the X25519, chacha20poly1305, SHA-256 suite.
+// The following code defines the X25519 and X448 DH functions, the
+// ChaChaPoly and AESGCM cipher functions, as well as the SHA256, SHA512,
+// BLAKE2s and BLAKE2b hash functions.
 //
 
+// 4.1. DH functions
+
+type noiseDHType int8
+
 const (
-	dhLen    = 32 // A constant specifying the size in bytes of public keys and DH outputs. For security reasons, dhLen must be 32 or greater.
-	hashLen  = 32
-	blockLen = 64
+	// DH25519 is the X25519 function from RFC 7748. It is the default DH function.
+	DH25519 noiseDHType = iota
+
+	// DH448 is the X448 function from RFC 7748.
+	DH448
 )
 
-// 4.1. DH functions
+type dhFunc struct {
+	// the name of the DH function as it appears in a Noise protocol name
+	name string
+	// the size in bytes of private keys, public keys and DH outputs (DHLEN).
+	// For security reasons, dhLen must be 32 or greater.
+	dhLen int
+	// returns the public key associated to a private key of dhLen bytes
+	publicKey func(privateKey []byte) []byte
+	// performs a Diffie-Hellman between a private key and a public key
+	dh func(privateKey, publicKey []byte) []byte
+}
 
-// TODO: store the KeyPair's parts in *[32]byte or []byte ?
+var dhs = map[noiseDHType]dhFunc{
+	DH25519: dhFunc{
+		name:  "25519",
+		dhLen: 32,
+		publicKey: func(privateKey []byte) []byte {
+			var public, private [32]byte
+			copy(private[:], privateKey)
+			curve25519.ScalarBaseMult(&public, &private)
+			return public[:]
+		},
+		dh: func(privateKey, publicKey []byte) []byte {
+			var shared, private, public [32]byte
+			copy(private[:], privateKey)
+			copy(public[:], publicKey)
+			curve25519.ScalarMult(&shared, &private, &public)
+			return shared[:]
+		},
+	},
+	DH448: dhFunc{
+		name:  "448",
+		dhLen: 56,
+		publicKey: func(privateKey []byte) []byte {
+			var public, private x448.Key
+			copy(private[:], privateKey)
+			x448.KeyGen(&public, &private)
+			return public[:]
+		},
+		dh: func(privateKey, publicKey []byte) []byte {
+			var shared, private, public x448.Key
+			copy(private[:], privateKey)
+			copy(public[:], publicKey)
+			// like X25519 a low-order public key results in an all-zero output
+			x448.Shared(&shared, &private, &public)
+			return shared[:]
+		},
+	},
+}
 
-// KeyPair contains a private and a public part, both of 32-byte.
-// It can be generated via the GenerateKeyPair() function.
+// generateKeypair creates a key pair out of a private key of dhLen bytes.
+// If privateKey is nil the function generates a random key pair.
+func (d dhFunc) generateKeypair(privateKey []byte) (*KeyPair, error) {
+	var keyPair KeyPair
+	if privateKey != nil {
+		if len(privateKey) != d.dhLen {
+			return nil, errors.New("noise: the private key does not match the size of the DH function")
+		}
+		keyPair.PrivateKey = append([]byte{}, privateKey...)
+	} else {
+		keyPair.PrivateKey = make([]byte, d.dhLen)
+		if _, err := rand.Read(keyPair.PrivateKey); err != nil {
+			return nil, err
+		}
+	}
+
+	keyPair.PublicKey = d.publicKey(keyPair.PrivateKey)
+
+	return &keyPair, nil
+}
+
+// KeyPair contains a private and a public part, both of 32-byte for X25519
+// and of 56-byte for X448.
+// It can be generated via the GenerateKeypair() or GenerateDHKeypair() functions.
 // The public part can also be extracted via the ExportPublicKey() function.
 type KeyPair struct {
-	PrivateKey [32]byte
-	PublicKey  [32]byte
+	PrivateKey []byte
+	PublicKey  []byte
 }
 
 // GenerateKeypair creates a X25519 static keyPair out of a private key. If privateKey is nil the function generates a random key pair.
 func GenerateKeypair(privateKey *[32]byte) *KeyPair {
-
-	var keyPair KeyPair
+	var private []byte
 	if privateKey != nil {
-		copy(keyPair.PrivateKey[:], privateKey[:])
-	} else {
-		if _, err := rand.Read(keyPair.PrivateKey[:]); err != nil {
-			panic(err)
-		}
+		private = privateKey[:]
 	}
+	keyPair, err := dhs[DH25519].generateKeypair(private)
+	if err != nil {
+		panic(err)
+	}
+	return keyPair
+}
 
-	curve25519.ScalarBaseMult(&keyPair.PublicKey, &keyPair.PrivateKey)
-
-	return &keyPair
+// GenerateDHKeypair creates a static keyPair for the DH function dhType
+// (DH25519 or DH448) out of a private key. If privateKey is nil the
+// function generates a random key pair.
+func GenerateDHKeypair(dhType noiseDHType, privateKey []byte) (*KeyPair, error) {
+	dh, ok := dhs[dhType]
+	if !ok {
+		return nil, errors.New("noise: the supplied DH function does not exist")
+	}
+	return dh.generateKeypair(privateKey)
 }
 
 // ExportPublicKey returns the public part in hex format of a static key pair.
 func (kp KeyPair) ExportPublicKey() string {
-	return hex.EncodeToString(kp.PublicKey[:])
+	return hex.EncodeToString(kp.PublicKey)
 }
 
-func dh(keyPair KeyPair, publicKey [32]byte) (shared [32]byte) {
+// 4.2. Cipher functions
 
-	curve25519.ScalarMult(&shared, &keyPair.PrivateKey, &publicKey)
+type noiseCipherType int8
 
-	return
+const (
+	// CipherChaChaPoly is the ChaCha20-Poly1305 AEAD from RFC 7539.
+	// It is the default cipher function.
+	CipherChaChaPoly noiseCipherType = iota
+
+	// CipherAESGCM is AES-256 in GCM mode with a 128-bit tag. It should
+	// be preferred on hardware with AES acceleration.
+	CipherAESGCM
+)
+
+type cipherFunc struct {
+	// the name of the cipher as it appears in a Noise protocol name
+	name string
+	// returns an AEAD instance keyed with k
+	aead func(k [32]byte) (cipher.AEAD, error)
+	// encodes the 64-bit nonce n into the 96-bit nonce of the AEAD
+	nonce func(n uint64) []byte
+}
+
+var ciphers = map[noiseCipherType]cipherFunc{
+
+	// The 96-bit nonce is formed by encoding 32 bits of zeros followed
+	// by little-endian encoding of n.
+	CipherChaChaPoly: cipherFunc{
+		name: "ChaChaPoly",
+		aead: func(k [32]byte) (cipher.AEAD, error) {
+			return chacha20poly1305.New(k[:])
+		},
+		nonce: func(n uint64) []byte {
+			var nonce [12]byte
+			binary.LittleEndian.PutUint64(nonce[4:], n)
+			return nonce[:]
+		},
+	},
+
+	// The 96-bit nonce is formed by encoding 32 bits of zeros followed
+	// by big-endian encoding of n.
+	CipherAESGCM: cipherFunc{
+		name: "AESGCM",
+		aead: func(k [32]byte) (cipher.AEAD, error) {
+			block, err := aes.NewCipher(k[:])
+			if err != nil {
+				return nil, err
+			}
+			return cipher.NewGCM(block)
+		},
+		nonce: func(n uint64) []byte {
+			var nonce [12]byte
+			binary.BigEndian.PutUint64(nonce[4:], n)
+			return nonce[:]
+		},
+	},
 }
 
-// 4.2. Cipher functions
 // TODO: should this really panic? decrypts return an error, this does not
-func encrypt(k [32]byte, n uint64, ad, plaintext []byte) (ciphertext []byte) {
+func (c cipherFunc) encrypt(k [32]byte, n uint64, ad, plaintext []byte) (ciphertext []byte) {
 
-	cipher, err := chacha20poly1305.New(k[:])
+	aead, err := c.aead(k)
 	if err != nil {
 		panic(err)
 	}
 
-	var nonce [8]byte
-	binary.LittleEndian.PutUint64(nonce[:], n)
 	// TODO: storage can be re-used by doing Seal(plaintext[:0], ...)
 	// if we do that, we could think of creating a single buffer of NoiseMessageLength for all operations
-	ciphertext = cipher.Seal(nil, append([]byte{0, 0, 0, 0}, nonce[:]...), plaintext, ad)
+	ciphertext = aead.Seal(nil, c.nonce(n), plaintext, ad)
 
 	return
 }
 
-func decrypt(k [32]byte, n uint64, ad, ciphertext []byte) (plaintext []byte, err error) {
+func (c cipherFunc) decrypt(k [32]byte, n uint64, ad, ciphertext []byte) (plaintext []byte, err error) {
 
-	cipher, err := chacha20poly1305.New(k[:])
+	aead, err := c.aead(k)
 	if err != nil {
 		return
 	}
 
-	var nonce [8]byte
-	binary.LittleEndian.PutUint64(nonce[:], n)
-	plaintext, err = cipher.Open(nil, append([]byte{0, 0, 0, 0}, nonce[:]...), ciphertext, ad)
+	plaintext, err = aead.Open(nil, c.nonce(n), ciphertext, ad)
 	return
 }
 
-func rekey(k [32]byte) (newkey [32]byte) {
+func (c cipherFunc) rekey(k [32]byte) (newkey [32]byte) {
 
-	copy(newkey[:], encrypt(k, math.MaxUint64, []byte{}, bytes.Repeat([]byte{0}, 32))[:32])
+	copy(newkey[:], c.encrypt(k, math.MaxUint64, []byte{}, bytes.Repeat([]byte{0}, 32))[:32])
 
 	return
 }
 
 // 4.3. Hash functions
 
-func hash(data []byte) [32]byte {
-	return sha256.Sum256(data)
-	//return K12.NewK12([]byte("noise_hash"))
+type noiseHashType int8
+
+const (
+	// HashSHA256 is SHA-256 from FIPS 180-4. It is the default hash function.
+	HashSHA256 noiseHashType = iota
+
+	// HashSHA512 is SHA-512 from FIPS 180-4.
+	HashSHA512
+
+	// HashBLAKE2s is BLAKE2s from RFC 7693 with a 32-byte output.
+	HashBLAKE2s
+
+	// HashBLAKE2b is BLAKE2b from RFC 7693 with a 64-byte output.
+	HashBLAKE2b
+)
+
+type hashFunc struct {
+	// the name of the hash as it appears in a Noise protocol name
+	name string
+	// the size in bytes of the hash output (HASHLEN)
+	hashLen int
+	// the size in bytes that the hash function uses internally to divide its input for iterative processing (BLOCKLEN)
+	blockLen int
+	// returns a new hash.Hash instance, also used by HMAC
+	new func() hash.Hash
+}
+
+var hashes = map[noiseHashType]hashFunc{
+	HashSHA256: hashFunc{
+		name:     "SHA256",
+		hashLen:  32,
+		blockLen: 64,
+		new:      sha256.New,
+	},
+	HashSHA512: hashFunc{
+		name:     "SHA512",
+		hashLen:  64,
+		blockLen: 128,
+		new:      sha512.New,
+	},
+	HashBLAKE2s: hashFunc{
+		name:     "BLAKE2s",
+		hashLen:  32,
+		blockLen: 64,
+		new: func() hash.Hash {
+			// an unkeyed BLAKE2s never returns an error
+			h, _ := blake2s.New256(nil)
+			return h
+		},
+	},
+	HashBLAKE2b: hashFunc{
+		name:     "BLAKE2b",
+		hashLen:  64,
+		blockLen: 128,
+		new: func() hash.Hash {
+			// an unkeyed BLAKE2b never returns an error
+			h, _ := blake2b.New512(nil)
+			return h
+		},
+	},
+}
+
+func (hf hashFunc) hash(data []byte) []byte {
+	h := hf.new()
+	h.Write(data)
+	return h.Sum(nil)
 }
 
-func hmacHash(key, data []byte) []byte {
-	// return K12Sum([]byte()"noise_mac"), append(key, data...), out)
-	mac := hmac.New(sha256.New, key)
+func (hf hashFunc) hmacHash(key, data []byte) []byte {
+	mac := hmac.New(hf.new, key)
 	mac.Write(data)
 	return mac.Sum(nil)
 }
 
-func hkdf(chainingKey, inputKeyMaterial []byte, numOutputs int) (output []byte) {
+// hkdf returns the concatenation of numOutputs outputs of hashLen bytes
+func (hf hashFunc) hkdf(chainingKey, inputKeyMaterial []byte, numOutputs int) (output []byte) {
 
 	if numOutputs != 2 && numOutputs != 3 {
 		panic("numOutputs should be 2 or 3")
 	}
 
-	// kdf := K12.NewK12([]byte("noise_kdf")])
-	// hash.Write(append(chainingKey, inputKeyMaterial...))
-	// output = make([]byte, 32 * numOutputs)
-	// hash.Read(output)
-	// return
-	tempKey := hmacHash(chainingKey, inputKeyMaterial)
-	output = hmacHash(tempKey, []byte{0x01})
-	output = append(output, hmacHash(tempKey, append(output, 0x02))...)
+	tempKey := hf.hmacHash(chainingKey, inputKeyMaterial)
+	output1 := hf.hmacHash(tempKey, []byte{0x01})
+	output2 := hf.hmacHash(tempKey, append(output1, 0x02))
+	output = append(output1, output2...)
 
 	if numOutputs == 2 {
 		return
 	}
-	output = append(output, hmacHash(tempKey, append(output[32:], 0x03))...)
+	output3 := hf.hmacHash(tempKey, append(output2, 0x03))
+	output = append(output, output3...)
 	return
 }
+
+// hkdfExpand is the expand step of HKDF (RFC 5869): it returns length bytes
+// derived from the pseudorandom key prk and from info. length can't be larger
+// than 255 * hashLen
+func (hf hashFunc) hkdfExpand(prk, info []byte, length int) (output []byte) {
+	var block []byte
+	for counter := byte(1); len(output) < length; counter++ {
+		data := append(append(append([]byte{}, block...), info...), counter)
+		block = hf.hmacHash(prk, data)
+		output = append(output, block...)
+	}
+	return output[:length]
+}
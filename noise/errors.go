@@ -0,0 +1,51 @@
+package noise
+
+import (
+	"errors"
+	"fmt"
+)
+
+//
+// Errors
+//
+// The errors returned by this package belong to one of the following kinds
+// when the caller can do something about them, which errors.Is() checks:
+//
+//	if errors.Is(err, noise.ErrConfig) {
+//		// fix the configuration
+//	}
+//
+
+var (
+	// ErrConfig is the kind of the errors returned for an invalid or
+	// incomplete Config, see Config.Validate()
+	ErrConfig = errors.New("noise: invalid configuration")
+	// ErrWrongTurn is the kind of the errors returned when a handshake
+	// message is written when one should be read (or the opposite), or when
+	// the handshake has no message left
+	ErrWrongTurn = errors.New("noise: wrong turn in the handshake")
+	// ErrOneWayPattern is the kind of the errors returned when the server of
+	// a one-way pattern (for example Noise_N) writes, or when its client reads
+	ErrOneWayPattern = errors.New("noise: one-way patterns only go from the client to the server")
+)
+
+// kindError is an error of one of the kinds above, with its own message
+type kindError struct {
+	kind error
+	msg  string
+}
+
+func (e *kindError) Error() string { return e.msg }
+func (e *kindError) Unwrap() error { return e.kind }
+
+func configError(format string, a ...interface{}) error {
+	return &kindError{kind: ErrConfig, msg: fmt.Sprintf(format, a...)}
+}
+
+func wrongTurnError(msg string) error {
+	return &kindError{kind: ErrWrongTurn, msg: msg}
+}
+
+func oneWayError(msg string) error {
+	return &kindError{kind: ErrOneWayPattern, msg: msg}
+}
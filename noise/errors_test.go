@@ -0,0 +1,80 @@
+package noise
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestConfigValidate(t *testing.T) {
+	var nilConfig *Config
+	invalid := map[string]*Config{
+		"nil":                   nilConfig,
+		"unknown protocol":      {ProtocolName: "Noise_ZZ_25519_AESGCM_SHA256"},
+		"pipes and socket":      {HandshakePattern: Noise_NK, NoisePipes: true, NoiseSocket: true},
+		"ephemeral pre-message": {ProtocolName: "Noise_XXfallback_25519_ChaChaPoly_SHA256"},
+		"missing psk":           {HandshakePattern: Noise_NNpsk2},
+		"short remote key":      {HandshakePattern: Noise_NK, RemoteKey: []byte{1, 2, 3}},
+	}
+	for name, config := range invalid {
+		if err := config.Validate(); !errors.Is(err, ErrConfig) {
+			t.Fatalf("%s: Validate should return an ErrConfig, got %v", name, err)
+		}
+	}
+	if err := (&Config{HandshakePattern: Noise_NK}).Validate(); err != nil {
+		t.Fatal("a valid configuration was rejected:", err)
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	// the server of Noise_XX needs a PublicKeyVerifier
+	if _, err := Listen("tcp", "127.0.0.1:0", &Config{HandshakePattern: Noise_XX, KeyPair: GenerateKeypair(nil), StaticPublicKeyProof: []byte{}}); !errors.Is(err, ErrConfig) {
+		t.Fatal("Listen should return an ErrConfig, got", err)
+	}
+	if _, err := DialWithDialer(new(net.Dialer), "tcp", "127.0.0.1:0", nil); !errors.Is(err, ErrConfig) {
+		t.Fatal("DialWithDialer should return an ErrConfig, got", err)
+	}
+	// the client of Noise_NK needs the key of the server
+	clientPipe, serverPipe := net.Pipe()
+	defer serverPipe.Close()
+	client := Client(clientPipe, &Config{HandshakePattern: Noise_NK})
+	if err := client.Handshake(); !errors.Is(err, ErrConfig) {
+		t.Fatal("the handshake should fail with an ErrConfig, got", err)
+	}
+}
+
+func TestWrongTurnErrors(t *testing.T) {
+	initiator, err := NewHandshakeState(&Config{HandshakePattern: Noise_NN, Initiator: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err = initiator.ReadMessage(nil); !errors.Is(err, ErrWrongTurn) {
+		t.Fatal("the initiator should not read first, got", err)
+	}
+	hs := initiator.hs
+	hs.shouldWrite = false
+	if _, _, err = hs.writeMessage(nil, new([]byte)); !errors.Is(err, ErrWrongTurn) {
+		t.Fatal("writeMessage should return an ErrWrongTurn, got", err)
+	}
+}
+
+func TestOneWayErrors(t *testing.T) {
+	serverKeyPair := GenerateKeypair(nil)
+	clientPipe, serverPipe := net.Pipe()
+	client := Client(clientPipe, &Config{HandshakePattern: Noise_N, RemoteKey: serverKeyPair.PublicKey})
+	server := Server(serverPipe, &Config{HandshakePattern: Noise_N, KeyPair: serverKeyPair})
+	defer client.conn.Close()
+	defer server.conn.Close()
+
+	// the pattern is known once the handshake is complete
+	go client.Handshake()
+	if _, err := server.Write([]byte("hello")); !errors.Is(err, ErrOneWayPattern) {
+		t.Fatal("the server of a one-way pattern should not write, got", err)
+	}
+	if err := server.Rekey(); !errors.Is(err, ErrOneWayPattern) {
+		t.Fatal("the server of a one-way pattern should not rekey, got", err)
+	}
+	if _, err := client.Read(make([]byte, 10)); !errors.Is(err, ErrOneWayPattern) {
+		t.Fatal("the client of a one-way pattern should not read, got", err)
+	}
+}
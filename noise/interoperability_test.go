@@ -41,7 +41,8 @@ func TestFlynnNoise(t *testing.T) {
 	//copy(responderKeyStruct.privateKey[:], responderKey.Private[:32])
 	//copy(responderKeyStruct.publicKey[:], responderKey.Public[:32])
 
-	initiator := initialize(Noise_XX, true, nil, initiatorKey, nil, nil, nil)
+	protocol, _ := parseProtocolName("Noise_XX_25519_ChaChaPoly_SHA256")
+	initiator, _ := initialize(protocol, true, nil, initiatorKey, nil, nil, nil)
 
 	// init flynn
 	hsR, _ := noise.NewHandshakeState(noise.Config{
@@ -130,3 +131,87 @@ func TestFlynnNoise(t *testing.T) {
 		return
 	}
 }
+
+func TestFlynnNoiseXXfallback(t *testing.T) {
+
+	// Alice's ephemeral key was sent in a first message (Noise_IK in Noise Pipes)
+	// that Bob could not decrypt. Bob, now initiator, starts a Noise_XXfallback
+	aliceStatic := GenerateKeypair(nil)
+	aliceEphemeral := GenerateKeypair(nil)
+	cs := noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashSHA256)
+	bobStatic, _ := cs.GenerateKeypair(rand.Reader)
+
+	protocol, err := parseProtocolName("Noise_XXfallback_25519_ChaChaPoly_SHA256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := initialize(protocol, false, nil, aliceStatic, aliceEphemeral, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bob, err := noise.NewHandshakeState(noise.Config{
+		CipherSuite:   cs,
+		Random:        rand.Reader,
+		Pattern:       noise.HandshakeXXfallback,
+		Initiator:     true,
+		StaticKeypair: bobStatic,
+		PeerEphemeral: aliceEphemeral.PublicKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 1. "<- e, ee, s, es" in the notation of the specification
+	bufferBob, _, _, err := bob.WriteMessage(nil, []byte("salut"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bufferAlice []byte
+	if _, _, err = alice.readMessage(bufferBob, &bufferAlice); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bufferAlice, []byte("salut")) {
+		t.Fatal("first message failed")
+	}
+	if !bytes.Equal(alice.rs.PublicKey, bobStatic.Public) {
+		t.Fatal("Alice did not receive Bob's static key")
+	}
+
+	// 2. "-> s, se" in the notation of the specification
+	bufferAlice = bufferAlice[:0]
+	aliceCipherRead, aliceCipherWrite, err := alice.writeMessage([]byte("ca va ?"), &bufferAlice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bufferBob, bobCipherWrite, bobCipherRead, err := bob.ReadMessage(nil, bufferAlice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bufferBob, []byte("ca va ?")) {
+		t.Fatal("second message failed")
+	}
+	if !bytes.Equal(bob.PeerStatic(), aliceStatic.PublicKey) {
+		t.Fatal("Bob did not receive Alice's static key")
+	}
+
+	// transport messages in both directions
+	ciphertext1, err := aliceCipherWrite.encryptWithAd([]byte{}, []byte("hello!"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext1, err := bobCipherRead.Decrypt(nil, []byte{}, ciphertext1)
+	if err != nil || !bytes.Equal(plaintext1, []byte("hello!")) {
+		t.Fatal("Alice's transport message failed")
+	}
+	// Bob's cipher states do not expose an Encrypt() that is stable across
+	// versions of flynn/noise, check that the other direction uses the same key
+	ciphertext2, err := aliceCipherRead.encryptWithAd([]byte{}, []byte("hi!"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext2, err := bobCipherWrite.Decrypt(nil, []byte{}, ciphertext2)
+	if err != nil || !bytes.Equal(plaintext2, []byte("hi!")) {
+		t.Fatal("cipher states do not match")
+	}
+}
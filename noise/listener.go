@@ -0,0 +1,188 @@
+package noise
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+//
+// Handshake workers
+//
+// With Config.HandshakeWorkers, the listener accepts the connections in the
+// background and runs their handshakes itself, at most HandshakeWorkers at
+// the same time and HandshakesPerIP per IP address of the clients. Accept()
+// then only returns authenticated connections, and the handshakes that fail
+// are reported to Config.OnHandshakeError. Temporary errors of the underlying
+// listener are retried after a delay. A worker stays busy until its
+// connection is returned by Accept(), so that an application that does not
+// accept connections also stops the handshakes.
+//
+
+// ErrTooManyHandshakes is reported to Config.OnHandshakeError when a
+// connection is closed because its IP address already has
+// Config.HandshakesPerIP handshakes in progress
+var ErrTooManyHandshakes = errors.New("noise: too many handshakes in progress from the same IP address")
+
+var errListenerClosed = errors.New("noise: the listener is closed")
+
+// maxAcceptDelay bounds the wait after a temporary error of the underlying
+// listener
+const maxAcceptDelay = time.Second
+
+// handshakeWorkers runs the handshakes of a listener
+type handshakeWorkers struct {
+	// authenticated connections
+	ready chan *Conn
+	// canceled by Close, which interrupts the handshakes in progress
+	ctx    context.Context
+	cancel context.CancelFunc
+	// closed by the accepting loop when it stops
+	stopped chan struct{}
+	// error of the underlying listener, set before stopped is closed
+	acceptErr error
+
+	lock sync.Mutex
+	// handshakes in progress per IP address
+	handshakes map[string]int
+}
+
+// serve accepts the connections of the underlying listener and starts
+// their handshakes
+func (l *listener) serve() {
+	w := l.workers
+	defer close(w.stopped)
+	slots := make(chan struct{}, l.config.HandshakeWorkers)
+	var delay time.Duration // how long to sleep on accept failure
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() && w.ctx.Err() == nil {
+				// for example, too many open files: wait and try again,
+				// as net/http does
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else {
+					delay *= 2
+				}
+				if delay > maxAcceptDelay {
+					delay = maxAcceptDelay
+				}
+				select {
+				case <-time.After(delay):
+					continue
+				case <-w.ctx.Done():
+				}
+			}
+			select {
+			case <-w.ctx.Done():
+				w.acceptErr = errListenerClosed
+			default:
+				w.acceptErr = err
+			}
+			return
+		}
+		delay = 0
+		ip := remoteIP(c.RemoteAddr())
+		if !w.startHandshake(ip, l.config.HandshakesPerIP) {
+			c.Close()
+			l.handshakeError(c.RemoteAddr(), ErrTooManyHandshakes)
+			continue
+		}
+		// wait for a free worker
+		select {
+		case slots <- struct{}{}:
+		case <-w.ctx.Done():
+			c.Close()
+			w.endHandshake(ip)
+			w.acceptErr = errListenerClosed
+			return
+		}
+		go func() {
+			defer func() { <-slots }()
+			l.handshake(c, ip)
+		}()
+	}
+}
+
+// handshake runs the handshake of a connection, and hands it to Accept
+func (l *listener) handshake(c net.Conn, ip string) {
+	w := l.workers
+	conn := Server(c, l.config)
+	conn.cookies = l.cookies
+	err := conn.HandshakeContext(w.ctx)
+	w.endHandshake(ip)
+	if err != nil {
+		conn.Close()
+		l.handshakeError(c.RemoteAddr(), err)
+		return
+	}
+	select {
+	case w.ready <- conn:
+	case <-w.ctx.Done():
+		conn.Close()
+	}
+}
+
+// handshakeError reports a failed handshake to Config.OnHandshakeError
+func (l *listener) handshakeError(remoteAddr net.Addr, err error) {
+	if l.config.OnHandshakeError != nil {
+		l.config.OnHandshakeError(remoteAddr, err)
+	}
+}
+
+// startHandshake records a handshake from the IP address, unless it already
+// has limit handshakes in progress (zero means no limit)
+func (w *handshakeWorkers) startHandshake(ip string, limit int) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if limit > 0 && w.handshakes[ip] >= limit {
+		return false
+	}
+	w.handshakes[ip]++
+	return true
+}
+
+// endHandshake records the end of a handshake from the IP address
+func (w *handshakeWorkers) endHandshake(ip string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.handshakes[ip]--; w.handshakes[ip] == 0 {
+		delete(w.handshakes, ip)
+	}
+}
+
+// accept returns the next authenticated connection
+func (w *handshakeWorkers) accept() (net.Conn, error) {
+	select {
+	case conn := <-w.ready:
+		return conn, nil
+	case <-w.ctx.Done():
+		return nil, errListenerClosed
+	case <-w.stopped:
+		return nil, w.acceptErr
+	}
+}
+
+// newHandshakeWorkers returns the workers of a listener, serve must then
+// be started
+func newHandshakeWorkers() *handshakeWorkers {
+	w := &handshakeWorkers{
+		ready:      make(chan *Conn),
+		stopped:    make(chan struct{}),
+		handshakes: make(map[string]int),
+	}
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+	return w
+}
+
+// remoteIP returns the IP address of addr, or addr itself if it has no port
+func remoteIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,175 @@
+package noise
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// listenWorkers returns a Noise_NK listener running the handshakes, which
+// reports the failed handshakes on the returned channel
+func listenWorkers(t *testing.T, workers, perIP int) (l net.Listener, serverKeyPair *KeyPair, failed <-chan error) {
+	serverKeyPair = GenerateKeypair(nil)
+	errs := make(chan error, 10)
+	l, err := Listen("tcp", "127.0.0.1:0", &Config{
+		HandshakePattern: Noise_NK,
+		KeyPair:          serverKeyPair,
+		HandshakeWorkers: workers,
+		HandshakesPerIP:  perIP,
+		OnHandshakeError: func(remoteAddr net.Addr, err error) { errs <- err },
+	})
+	if err != nil {
+		t.Fatal("cannot setup a listener on localhost:", err)
+	}
+	return l, serverKeyPair, errs
+}
+
+func TestHandshakeWorkers(t *testing.T) {
+	l, serverKeyPair, failed := listenWorkers(t, 2, 0)
+	defer l.Close()
+
+	// a client that does not complete its handshake is never accepted
+	silent, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	silent.Write([]byte{0, 3, 1, 2, 3})
+
+	// the handshake runs without any Read or Write on the server side
+	client, err := Dial("tcp", l.Addr().String(), &Config{HandshakePattern: Noise_NK, RemoteKey: serverKeyPair.PublicKey})
+	if err != nil {
+		t.Fatal("cannot dial:", err)
+	}
+	defer client.Close()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal("cannot accept:", err)
+	}
+	defer conn.Close()
+	serverHash, err := conn.(*Conn).HandshakeHash()
+	clientHash, _ := client.HandshakeHash()
+	if err != nil || !bytes.Equal(serverHash, clientHash) {
+		t.Fatal("the accepted connection should be authenticated, got", err)
+	}
+
+	// the failed handshake is reported
+	select {
+	case err = <-failed:
+		if err == nil {
+			t.Fatal("the error of the failed handshake should be reported")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the failed handshake was not reported")
+	}
+}
+
+func TestHandshakesPerIP(t *testing.T) {
+	l, serverKeyPair, failed := listenWorkers(t, 2, 1)
+	defer l.Close()
+
+	// a stalled handshake takes the only handshake allowed for localhost
+	stalled, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+	if _, err = Dial("tcp", l.Addr().String(), &Config{HandshakePattern: Noise_NK, RemoteKey: serverKeyPair.PublicKey}); err == nil {
+		t.Fatal("the second handshake from the same IP address should have been refused")
+	}
+	if err = <-failed; err != ErrTooManyHandshakes {
+		t.Fatal("the refused connection should be reported, got", err)
+	}
+
+	// once the stalled handshake fails, new ones can run
+	stalled.Close()
+	if err = <-failed; err == nil {
+		t.Fatal("the stalled handshake should have failed")
+	}
+	client, err := Dial("tcp", l.Addr().String(), &Config{HandshakePattern: Noise_NK, RemoteKey: serverKeyPair.PublicKey})
+	if err != nil {
+		t.Fatal("cannot dial:", err)
+	}
+	client.Close()
+}
+
+func TestHandshakeWorkersClose(t *testing.T) {
+	l, _, _ := listenWorkers(t, 1, 0)
+	accepted := make(chan error, 1)
+	go func() {
+		_, err := l.Accept()
+		accepted <- err
+	}()
+	l.Close()
+	select {
+	case err := <-accepted:
+		if err == nil {
+			t.Fatal("Accept should fail once the listener is closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Accept should return once the listener is closed")
+	}
+	if _, err := Listen("tcp", "127.0.0.1:0", &Config{HandshakePattern: Noise_NN, HandshakeWorkers: -1}); err == nil {
+		t.Fatal("a negative number of workers should be rejected")
+	}
+}
+
+// failingListener fails its first Accept calls with the given errors
+type failingListener struct {
+	net.Listener
+	errs []error
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	if len(l.errs) > 0 {
+		err := l.errs[0]
+		l.errs = l.errs[1:]
+		return nil, err
+	}
+	return l.Listener.Accept()
+}
+
+// temporaryError is a temporary error of a listener, like EMFILE
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+func TestHandshakeWorkersAcceptErrors(t *testing.T) {
+	serverKeyPair := GenerateKeypair(nil)
+	config := &Config{HandshakePattern: Noise_NK, KeyPair: serverKeyPair, HandshakeWorkers: 1}
+	listen := func(errs ...error) *listener {
+		tcp, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal("cannot setup a listener on localhost:", err)
+		}
+		l := &listener{Listener: &failingListener{Listener: tcp, errs: errs}, config: config, workers: newHandshakeWorkers()}
+		go l.serve()
+		return l
+	}
+
+	// the temporary errors are retried
+	l := listen(temporaryError{}, temporaryError{})
+	defer l.Close()
+	client, err := Dial("tcp", l.Addr().String(), &Config{HandshakePattern: Noise_NK, RemoteKey: serverKeyPair.PublicKey, HandshakeTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal("cannot dial:", err)
+	}
+	defer client.Close()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal("the listener should have survived the temporary errors, got", err)
+	}
+	conn.Close()
+
+	// the others stop the listener
+	failure := errors.New("failure")
+	l = listen(failure)
+	defer l.Close()
+	if _, err = l.Accept(); err != failure {
+		t.Fatal("Accept should return the error of the underlying listener, got", err)
+	}
+}
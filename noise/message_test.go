@@ -0,0 +1,65 @@
+package noise
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestMessages(t *testing.T) {
+	client, server := newNKPair()
+	defer client.Close()
+
+	messages := [][]byte{[]byte("first"), {}, bytes.Repeat([]byte("x"), client.MaxMessageSize()), []byte("last")}
+	go func() {
+		for _, msg := range messages {
+			if err := client.WriteMessage(msg); err != nil {
+				return
+			}
+		}
+		client.Close()
+	}()
+
+	// each message is received as a whole, even the empty one
+	for i, expected := range messages {
+		msg, err := server.ReadMessage()
+		if err != nil {
+			t.Fatal("server can't read message", i, err)
+		}
+		if !bytes.Equal(msg, expected) {
+			t.Fatalf("message %d: received %d bytes instead of %d", i, len(msg), len(expected))
+		}
+	}
+	if _, err := server.ReadMessage(); err != io.EOF {
+		t.Fatal("the server should read io.EOF after the last message, not", err)
+	}
+}
+
+func TestMessageTooLarge(t *testing.T) {
+	for _, options := range []Config{{}, {Padding: PadToBlockSize(16)}, {NoiseSocket: true}} {
+		client, server := newNKPair()
+		client.config.Padding, server.config.Padding = options.Padding, options.Padding
+		client.config.NoiseSocket, server.config.NoiseSocket = options.NoiseSocket, options.NoiseSocket
+		go server.Handshake()
+
+		// the size is checked once the handshake is complete
+		if err := client.WriteMessage(make([]byte, client.MaxMessageSize()+1)); err != ErrMessageTooLarge {
+			t.Fatal("a message that doesn't fit should be refused, got", err)
+		}
+		client.conn.Close()
+	}
+}
+
+func TestReadMessageAfterRead(t *testing.T) {
+	client, server := newNKPair()
+	defer client.conn.Close() // nobody reads a close_notify
+	go client.WriteMessage([]byte("hello"))
+
+	buf := make([]byte, 2)
+	if _, err := server.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.ReadMessage(); err == nil {
+		t.Fatal("ReadMessage should not return the rest of a message read with Read")
+	}
+}
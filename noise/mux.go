@@ -0,0 +1,634 @@
+package noise
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+//
+// Stream multiplexing
+//
+// A Mux carries many streams over a single Conn, in the spirit of yamux.
+// Each message of the Conn carries a frame of a stream:
+//
+//	type (1 byte) || stream ID (4 bytes, big-endian) || body
+//
+// * open: the sender opens the stream. Clients use odd IDs, servers even ones
+// * data: the body is data of the stream
+// * window update: the body is a 4-byte increment of the flow control window
+// * close: the sender will not send more data on the stream. A body of 1
+//   means that it will not read the stream anymore either
+// * reset: the sender aborts the stream
+//
+// Stream IDs are opened in increasing order, and never reused.
+// A peer can only send as much data on a stream as its flow control window
+// allows: initialStreamWindow bytes at first. The receiver grows the window
+// as the application reads the data, and right away if its
+// Config.StreamWindowSize is larger.
+//
+
+const (
+	frameOpen byte = iota
+	frameData
+	frameWindowUpdate
+	frameClose
+	frameReset
+)
+
+const frameHeaderSize = 5
+
+// closeRead is the body of a close frame sent by Stream.Close
+const closeRead byte = 1
+
+// initialStreamWindow is the flow control window of a new stream
+const initialStreamWindow = 256 * 1024
+
+// muxAcceptBacklog is the number of opened streams waiting for AcceptStream,
+// further streams are reset
+const muxAcceptBacklog = 256
+
+var (
+	// ErrMuxClosed is returned by a Mux and its streams once the Mux, or
+	// its Conn, is closed
+	ErrMuxClosed = errors.New("noise: the multiplexed connection is closed")
+
+	errStreamClosed     = errors.New("noise: the stream is closed")
+	errStreamPeerClosed = errors.New("noise: the stream was closed by the peer")
+	errStreamReset      = errors.New("noise: the stream was reset by the peer")
+	errMuxProtocol      = errors.New("noise: the peer violated the multiplexing protocol")
+)
+
+// streamWindowSize returns the flow control window of the streams of a Mux
+func (config *Config) streamWindowSize() uint32 {
+	if config.StreamWindowSize > initialStreamWindow {
+		return config.StreamWindowSize
+	}
+	return initialStreamWindow
+}
+
+// A Mux multiplexes streams over a single Conn. It implements net.Listener,
+// Accept returning the streams opened by the peer.
+type Mux struct {
+	conn       *Conn
+	windowSize uint32
+
+	// serializes the opening of streams, so that their IDs are sent in
+	// increasing order
+	openLock sync.Mutex
+
+	lock    sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	// the smallest ID the peer can still open
+	nextPeerID uint32
+
+	accept    chan *Stream
+	closed    chan struct{}
+	closeOnce sync.Once
+	err       error // why the Mux was closed, set before closed is
+}
+
+// NewMux returns a Mux carrying streams over conn, which must not be read
+// or written directly anymore. Both peers must use a Mux.
+func NewMux(conn *Conn) *Mux {
+	m := &Mux{
+		conn:       conn,
+		windowSize: conn.config.streamWindowSize(),
+		streams:    make(map[uint32]*Stream),
+		nextID:     2,
+		nextPeerID: 1,
+		accept:     make(chan *Stream, muxAcceptBacklog),
+		closed:     make(chan struct{}),
+	}
+	if conn.isClient {
+		m.nextID, m.nextPeerID = 1, 2
+	}
+	go m.receive()
+	return m
+}
+
+// OpenStream opens a new stream, which the peer receives with AcceptStream.
+func (m *Mux) OpenStream() (*Stream, error) {
+	m.openLock.Lock()
+	defer m.openLock.Unlock()
+	m.lock.Lock()
+	if err := m.closeErr(); err != nil {
+		m.lock.Unlock()
+		return nil, err
+	}
+	id := m.nextID
+	if id+2 < id {
+		m.lock.Unlock()
+		return nil, errors.New("noise: no stream IDs left")
+	}
+	m.nextID += 2
+	s := m.newStream(id)
+	m.streams[id] = s
+	m.lock.Unlock()
+
+	if err := m.writeFrame(frameOpen, id, nil); err != nil {
+		return nil, err
+	}
+	if err := m.growWindow(id); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// AcceptStream waits for and returns the next stream opened by the peer.
+func (m *Mux) AcceptStream() (*Stream, error) {
+	select {
+	case s := <-m.accept:
+		return s, nil
+	case <-m.closed:
+		return nil, m.err
+	}
+}
+
+// Accept waits for and returns the next stream opened by the peer, as a
+// net.Conn of type *Stream.
+func (m *Mux) Accept() (net.Conn, error) {
+	s, err := m.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Addr returns the local address of the Conn.
+func (m *Mux) Addr() net.Addr {
+	return m.conn.LocalAddr()
+}
+
+// Close closes the Conn, and all of its streams.
+func (m *Mux) Close() error {
+	return m.shutdown(ErrMuxClosed)
+}
+
+// shutdown closes the Mux because of err, and returns the error of closing
+// the Conn the first time
+func (m *Mux) shutdown(err error) (closeErr error) {
+	m.closeOnce.Do(func() {
+		m.err = err
+		close(m.closed)
+		closeErr = m.conn.Close()
+	})
+	return
+}
+
+// closeErr returns why the Mux was closed, or nil
+func (m *Mux) closeErr() error {
+	select {
+	case <-m.closed:
+		return m.err
+	default:
+		return nil
+	}
+}
+
+// newStream returns a new stream, whose window was grown to m.windowSize
+func (m *Mux) newStream(id uint32) *Stream {
+	return &Stream{
+		id:         id,
+		mux:        m,
+		changed:    make(chan struct{}),
+		recvWindow: m.windowSize,
+		sendWindow: initialStreamWindow,
+	}
+}
+
+// growWindow tells the peer about a window larger than initialStreamWindow
+func (m *Mux) growWindow(id uint32) error {
+	if m.windowSize == initialStreamWindow {
+		return nil
+	}
+	return m.writeWindowUpdate(id, m.windowSize-initialStreamWindow)
+}
+
+// removeStream stops routing the frames of a stream
+func (m *Mux) removeStream(id uint32) {
+	m.lock.Lock()
+	delete(m.streams, id)
+	m.lock.Unlock()
+}
+
+// writeFrame sends a frame of a stream
+func (m *Mux) writeFrame(frameType byte, id uint32, body []byte) error {
+	frame := make([]byte, frameHeaderSize, frameHeaderSize+len(body))
+	frame[0] = frameType
+	binary.BigEndian.PutUint32(frame[1:], id)
+	if err := m.conn.WriteMessage(append(frame, body...)); err != nil {
+		if closeErr := m.closeErr(); closeErr != nil {
+			return closeErr
+		}
+		return err
+	}
+	return nil
+}
+
+func (m *Mux) writeWindowUpdate(id, increment uint32) error {
+	var body [4]byte
+	binary.BigEndian.PutUint32(body[:], increment)
+	return m.writeFrame(frameWindowUpdate, id, body[:])
+}
+
+// receive routes the frames received to their streams, until the Conn fails
+func (m *Mux) receive() {
+	for {
+		frame, err := m.conn.ReadMessage()
+		if err == nil {
+			err = m.handleFrame(frame)
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = ErrMuxClosed
+			}
+			m.shutdown(err)
+			return
+		}
+	}
+}
+
+// handleFrame processes a frame received. The frames sent by the receive
+// loop are sent in the background, so that it keeps reading.
+func (m *Mux) handleFrame(frame []byte) error {
+	if len(frame) < frameHeaderSize {
+		return errMuxProtocol
+	}
+	frameType, id, body := frame[0], binary.BigEndian.Uint32(frame[1:]), frame[frameHeaderSize:]
+	if frameType == frameOpen {
+		return m.handleOpen(id)
+	}
+
+	m.lock.Lock()
+	s := m.streams[id]
+	m.lock.Unlock()
+	if s == nil {
+		// the stream was closed, or reset
+		return nil
+	}
+	switch frameType {
+	case frameData:
+		return s.receiveData(body)
+	case frameWindowUpdate:
+		if len(body) != 4 {
+			return errMuxProtocol
+		}
+		return s.receiveWindowUpdate(binary.BigEndian.Uint32(body))
+	case frameClose:
+		s.receiveClose(len(body) == 1 && body[0] == closeRead)
+	case frameReset:
+		s.receiveReset()
+	default:
+		return errMuxProtocol
+	}
+	return nil
+}
+
+// handleOpen creates a stream opened by the peer
+func (m *Mux) handleOpen(id uint32) error {
+	// the IDs of the peer have the other parity
+	if id == 0 || (id%2 == 1) == m.conn.isClient {
+		return errMuxProtocol
+	}
+	m.lock.Lock()
+	// the ID of a stream that was removed is not reused
+	if id < m.nextPeerID {
+		m.lock.Unlock()
+		return errMuxProtocol
+	}
+	m.nextPeerID = id + 2
+	s := m.newStream(id)
+	m.streams[id] = s
+	m.lock.Unlock()
+
+	select {
+	case m.accept <- s:
+		go m.growWindow(id)
+	default:
+		// too many streams are waiting to be accepted
+		m.removeStream(id)
+		go m.writeFrame(frameReset, id, nil)
+	}
+	return nil
+}
+
+//
+// Streams
+//
+
+// A Stream is a bidirectional stream of a Mux. It implements net.Conn.
+type Stream struct {
+	id  uint32
+	mux *Mux
+
+	writeLock sync.Mutex // serializes the Writes
+
+	lock sync.Mutex
+	// closed and replaced each time the state of the stream changes
+	changed chan struct{}
+
+	readBuffer bytes.Buffer
+	// data read since the last window update
+	consumed uint32
+	// data the peer can still send, and that we can still send
+	recvWindow, sendWindow uint32
+
+	// close received, close sent, Close called, reset received
+	readClosed, writeClosed, closed, reset bool
+	// the peer called Close: it does not read the stream anymore
+	peerClosed bool
+
+	readDeadline, writeDeadline time.Time
+}
+
+// ID returns the identifier of the stream, odd for the streams opened by
+// the client and even for the ones opened by the server.
+func (s *Stream) ID() uint32 {
+	return s.id
+}
+
+// notify wakes the goroutines waiting for a change of the stream, it must be
+// called with the lock
+func (s *Stream) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// wait waits for a change of the stream, the deadline or the closing of the
+// Mux. It must be called with the lock, which it releases while waiting.
+func (s *Stream) wait(deadline time.Time) error {
+	changed := s.changed
+	s.lock.Unlock()
+	defer s.lock.Lock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-changed:
+	case <-s.mux.closed:
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+// pastDeadline returns true if the deadline is set and has passed
+func pastDeadline(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+// Read reads data from the stream. It returns io.EOF once the peer closed
+// the stream and all of its data was read.
+func (s *Stream) Read(b []byte) (int, error) {
+	s.lock.Lock()
+	if err := s.waitData(); err != nil {
+		s.lock.Unlock()
+		return 0, err
+	}
+	n, _ := s.readBuffer.Read(b)
+
+	// grow the window of the peer once half of it was read
+	var increment uint32
+	s.consumed += uint32(n)
+	if s.consumed >= s.mux.windowSize/2 && !s.readClosed {
+		increment, s.consumed = s.consumed, 0
+		s.recvWindow += increment
+	}
+	s.lock.Unlock()
+
+	if increment > 0 {
+		s.mux.writeWindowUpdate(s.id, increment)
+	}
+	return n, nil
+}
+
+// Write writes data on the stream. It blocks while the flow control window
+// of the peer is full.
+func (s *Stream) Write(b []byte) (n int, err error) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	maxData := s.mux.conn.MaxMessageSize() - frameHeaderSize
+	for len(b) > 0 {
+		s.lock.Lock()
+		if err = s.waitWindow(); err != nil {
+			s.lock.Unlock()
+			return n, err
+		}
+		chunk := len(b)
+		if chunk > int(s.sendWindow) {
+			chunk = int(s.sendWindow)
+		}
+		if chunk > maxData {
+			chunk = maxData
+		}
+		s.sendWindow -= uint32(chunk)
+		s.lock.Unlock()
+
+		if err = s.mux.writeFrame(frameData, s.id, b[:chunk]); err != nil {
+			return n, err
+		}
+		n += chunk
+		b = b[chunk:]
+	}
+	return n, nil
+}
+
+// waitData waits for data to read, it must be called with the lock
+func (s *Stream) waitData() error {
+	for s.readBuffer.Len() == 0 {
+		switch {
+		case s.closed:
+			return errStreamClosed
+		case s.reset:
+			return errStreamReset
+		case s.readClosed:
+			return io.EOF
+		case s.mux.closeErr() != nil:
+			return s.mux.closeErr()
+		case pastDeadline(s.readDeadline):
+			return os.ErrDeadlineExceeded
+		}
+		if err := s.wait(s.readDeadline); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitWindow waits for the flow control window of the peer to have room for
+// more data, it must be called with the lock
+func (s *Stream) waitWindow() error {
+	for {
+		switch {
+		case s.closed || s.writeClosed:
+			return errStreamClosed
+		case s.reset:
+			return errStreamReset
+		case s.peerClosed:
+			return errStreamPeerClosed
+		case s.mux.closeErr() != nil:
+			return s.mux.closeErr()
+		case pastDeadline(s.writeDeadline):
+			return os.ErrDeadlineExceeded
+		case s.sendWindow > 0:
+			return nil
+		}
+		if err := s.wait(s.writeDeadline); err != nil {
+			return err
+		}
+	}
+}
+
+// CloseWrite tells the peer that no more data will be written on the stream,
+// its Read then returns io.EOF. The stream can still be read.
+func (s *Stream) CloseWrite() error {
+	s.lock.Lock()
+	if s.writeClosed || s.reset {
+		s.lock.Unlock()
+		return nil
+	}
+	s.writeClosed = true
+	done := s.readClosed
+	s.notify()
+	s.lock.Unlock()
+
+	if done {
+		s.mux.removeStream(s.id)
+	}
+	return s.mux.writeFrame(frameClose, s.id, nil)
+}
+
+// Close closes the stream: the data written so far is still delivered to the
+// peer, which reads io.EOF after it. The unread data, and the data received
+// afterwards, is discarded: the Writes of the peer then fail.
+func (s *Stream) Close() error {
+	s.lock.Lock()
+	if s.closed || s.reset {
+		s.lock.Unlock()
+		return nil
+	}
+	s.closed = true
+	// give the window of the discarded data back to the peer, whose Writes
+	// may be waiting for it
+	discarded := s.consumed + uint32(s.readBuffer.Len())
+	s.consumed = 0
+	s.readBuffer.Reset()
+	readClosed := s.readClosed
+	s.writeClosed = true
+	s.notify()
+	s.lock.Unlock()
+
+	if readClosed {
+		s.mux.removeStream(s.id)
+	} else if discarded > 0 {
+		if err := s.mux.writeWindowUpdate(s.id, discarded); err != nil {
+			return err
+		}
+	}
+	return s.mux.writeFrame(frameClose, s.id, []byte{closeRead})
+}
+
+func (s *Stream) receiveData(data []byte) error {
+	s.lock.Lock()
+	if uint32(len(data)) > s.recvWindow {
+		s.lock.Unlock()
+		return errMuxProtocol
+	}
+	if s.closed {
+		// let the peer send the rest of its data
+		s.lock.Unlock()
+		go s.mux.writeWindowUpdate(s.id, uint32(len(data)))
+		return nil
+	}
+	s.recvWindow -= uint32(len(data))
+	s.readBuffer.Write(data)
+	s.notify()
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *Stream) receiveWindowUpdate(increment uint32) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.sendWindow+increment < s.sendWindow {
+		return errMuxProtocol
+	}
+	s.sendWindow += increment
+	s.notify()
+	return nil
+}
+
+func (s *Stream) receiveClose(peerClosed bool) {
+	s.lock.Lock()
+	s.readClosed = true
+	if peerClosed {
+		s.peerClosed = true
+	}
+	done := s.writeClosed
+	s.notify()
+	s.lock.Unlock()
+
+	if done {
+		s.mux.removeStream(s.id)
+	}
+}
+
+func (s *Stream) receiveReset() {
+	s.lock.Lock()
+	s.reset = true
+	s.readBuffer.Reset()
+	s.notify()
+	s.lock.Unlock()
+
+	s.mux.removeStream(s.id)
+}
+
+// LocalAddr returns the local address of the Conn.
+func (s *Stream) LocalAddr() net.Addr {
+	return s.mux.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the Conn.
+func (s *Stream) RemoteAddr() net.Addr {
+	return s.mux.conn.RemoteAddr()
+}
+
+// SetDeadline sets the read and write deadlines of the stream.
+func (s *Stream) SetDeadline(t time.Time) error {
+	s.lock.Lock()
+	s.readDeadline, s.writeDeadline = t, t
+	s.notify()
+	s.lock.Unlock()
+	return nil
+}
+
+// SetReadDeadline sets the read deadline of the stream.
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.lock.Lock()
+	s.readDeadline = t
+	s.notify()
+	s.lock.Unlock()
+	return nil
+}
+
+// SetWriteDeadline sets the deadline of the Writes waiting for the flow
+// control window of the peer. A Write blocked by the Conn is not interrupted.
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.lock.Lock()
+	s.writeDeadline = t
+	s.notify()
+	s.lock.Unlock()
+	return nil
+}
@@ -0,0 +1,198 @@
+package noise
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newMuxPair returns two peers multiplexing streams over Noise_NK on localhost
+func newMuxPair(t *testing.T, windowSize uint32) (client, server *Mux) {
+	serverKeyPair := GenerateKeypair(nil)
+	listener, err := Listen("tcp", "127.0.0.1:0", &Config{HandshakePattern: Noise_NK, KeyPair: serverKeyPair, StreamWindowSize: windowSize})
+	if err != nil {
+		t.Fatal("cannot setup a listener on localhost:", err)
+	}
+	defer listener.Close()
+
+	// the handshake of the server runs in the receiving loop of its Mux
+	accepted := make(chan *Mux, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- NewMux(conn.(*Conn))
+	}()
+	conn, err := Dial("tcp", listener.Addr().String(), &Config{HandshakePattern: Noise_NK, RemoteKey: serverKeyPair.PublicKey, StreamWindowSize: windowSize})
+	if err != nil {
+		t.Fatal("cannot dial:", err)
+	}
+	server, ok := <-accepted
+	if !ok {
+		t.Fatal("cannot accept a connection")
+	}
+	return NewMux(conn), server
+}
+
+// echoStreams echoes the data of the streams opened by the peer
+func echoStreams(m *Mux) {
+	for {
+		s, err := m.AcceptStream()
+		if err != nil {
+			return
+		}
+		go func() {
+			io.Copy(s, s)
+			s.Close()
+		}()
+	}
+}
+
+func TestMux(t *testing.T) {
+	client, server := newMuxPair(t, 0)
+	defer client.Close()
+	go echoStreams(server)
+
+	// concurrent streams, larger than the flow control window
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s, err := client.OpenStream()
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer s.Close()
+			data := bytes.Repeat([]byte{byte(i)}, 3*initialStreamWindow+i)
+			go func() {
+				s.Write(data)
+				s.CloseWrite()
+			}()
+			echoed, err := ioutil.ReadAll(s)
+			if err == nil && !bytes.Equal(echoed, data) {
+				err = io.ErrUnexpectedEOF
+			}
+			if err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal("a stream failed:", err)
+	}
+}
+
+func TestMuxFlowControl(t *testing.T) {
+	client, server := newMuxPair(t, 2*initialStreamWindow)
+	defer client.Close()
+
+	s, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the server does not read yet: only a window of data can be written
+	data := bytes.Repeat([]byte("x"), 3*initialStreamWindow)
+	s.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+	n, err := s.Write(data)
+	if err != os.ErrDeadlineExceeded || n != 2*initialStreamWindow {
+		t.Fatalf("the write should have been blocked after %d bytes, wrote %d (%v)", 2*initialStreamWindow, n, err)
+	}
+
+	// the server reads, and the rest of the data can be written
+	accepted, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetWriteDeadline(time.Time{})
+	go func() {
+		s.Write(data[n:])
+		s.Close()
+	}()
+	received, err := ioutil.ReadAll(accepted)
+	if err != nil || !bytes.Equal(received, data) {
+		t.Fatal("the server should have received all of the data, got", len(received), err)
+	}
+}
+
+func TestMuxClose(t *testing.T) {
+	client, server := newMuxPair(t, 0)
+	s, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := server.AcceptStream()
+	if err != nil || accepted.ID() != s.ID() || s.ID()%2 != 1 {
+		t.Fatal("the server should have accepted the stream opened by the client", err)
+	}
+
+	// the whole Mux is closed: the streams and Accept of the peer fail
+	client.Close()
+	buf := make([]byte, 10)
+	if n, err := accepted.Read(buf); err != nil || string(buf[:n]) != "hello" {
+		t.Fatal("the data sent before closing should be received, got", err)
+	}
+	if _, err = accepted.Read(buf); err != ErrMuxClosed {
+		t.Fatal("the stream should fail with ErrMuxClosed, got", err)
+	}
+	if _, err = server.Accept(); err != ErrMuxClosed {
+		t.Fatal("Accept should fail with ErrMuxClosed, got", err)
+	}
+	if _, err = s.Write(buf); err != ErrMuxClosed {
+		t.Fatal("the streams of a closed Mux should not be written, got", err)
+	}
+}
+
+func TestMuxCloseUnread(t *testing.T) {
+	client, server := newMuxPair(t, 0)
+	defer client.Close()
+	defer server.Close()
+
+	s, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := make(chan error, 1)
+	go func() {
+		_, err := s.Write(bytes.Repeat([]byte("x"), 3*initialStreamWindow))
+		written <- err
+	}()
+
+	// the server closes the stream without reading most of the data
+	accepted, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = accepted.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err = accepted.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-written:
+		if err != errStreamPeerClosed {
+			t.Fatal("the Write should fail once the peer closed the stream, got", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the Write should not stay blocked once the peer closed the stream")
+	}
+
+	// the ID of the stream cannot be opened again
+	if err = server.handleOpen(s.ID()); err != errMuxProtocol {
+		t.Fatal("a stream ID should not be reused, got", err)
+	}
+}
@@ -25,8 +25,9 @@ import (
 //
 
 type cipherState struct {
-	k [32]byte
-	n uint64
+	k      [32]byte
+	n      uint64
+	cipher cipherFunc
 }
 
 func (c *cipherState) initializeKey(key []byte) {
@@ -56,7 +57,7 @@ func (c *cipherState) encryptWithAd(ad, plaintext []byte) (ciphertext []byte, er
 
 	// If k is non-empty returns encrypt(k, n++, ad, plaintext).
 	if c.hasKey() {
-		ciphertext = encrypt(c.k, c.n, ad, plaintext)
+		ciphertext = c.cipher.encrypt(c.k, c.n, ad, plaintext)
 		c.n++
 		return
 	}
@@ -77,7 +78,7 @@ func (c *cipherState) decryptWithAd(ad, ciphertext []byte) (plaintext []byte, er
 
 	// If k is non-empty returns decrypt(k, n++, ad, ciphertext).
 	if c.hasKey() {
-		plaintext, err = decrypt(c.k, c.n, ad, ciphertext)
+		plaintext, err = c.cipher.decrypt(c.k, c.n, ad, ciphertext)
 
 		// If an authentication failure occurs in decrypt() then n is not incremented and an error is signaled to the caller.
 		if err != nil {
@@ -97,7 +98,7 @@ func (c *cipherState) decryptWithAd(ad, ciphertext []byte) (plaintext []byte, er
 
 // TODO: add documentation for public functions, also test this function
 func (c *cipherState) Rekey() {
-	c.k = rekey(c.k)
+	c.k = c.cipher.rekey(c.k)
 }
 
 //
@@ -106,50 +107,51 @@ func (c *cipherState) Rekey() {
 
 type symmetricState struct {
 	cipherState cipherState
-	ck          [hashLen]byte
-	h           [hashLen]byte
+	hash        hashFunc
+	ck          []byte
+	h           []byte
 }
 
 func (s *symmetricState) initializeSymmetric(protocolName []byte) {
-	if pad := hashLen - len(protocolName); pad >= 0 {
+	if pad := s.hash.hashLen - len(protocolName); pad >= 0 {
 		// If protocolName is less than or equal to hashLen bytes in length,
 		// sets h equal to protocolName with zero bytes appended to make hashLen bytes.
-		copy(s.h[:], append(protocolName, bytes.Repeat([]byte{0}, pad)...))
+		s.h = append(append([]byte{}, protocolName...), bytes.Repeat([]byte{0}, pad)...)
 	} else {
 		// Otherwise sets h = hash(protocolName).
-		s.h = hash(protocolName)
+		s.h = s.hash.hash(protocolName)
 	}
 
-	s.ck = s.h
+	s.ck = append([]byte{}, s.h...)
 
 	//	initializeKey() // This is done by default in Go
 }
 
-func (s *symmetricState) mixKey(inputKeyMaterial [32]byte) {
+func (s *symmetricState) mixKey(inputKeyMaterial []byte) {
 
-	output := hkdf(s.ck[:], inputKeyMaterial[:], 2)
-	copy(s.ck[:], output[:hashLen])
+	output := s.hash.hkdf(s.ck, inputKeyMaterial, 2)
+	s.ck = output[:s.hash.hashLen]
 
-	// The output of HKDF is taken as is because we use hashLen = 32
-	s.cipherState.initializeKey(output[hashLen:])
+	// If hashLen is 64, then the output of HKDF is truncated to 32 bytes
+	s.cipherState.initializeKey(output[s.hash.hashLen : s.hash.hashLen+32])
 
 }
 
 func (s *symmetricState) mixHash(data []byte) {
-	s.h = hash(append(s.h[:], data...))
+	s.h = s.hash.hash(append(append([]byte{}, s.h...), data...))
 }
 
 func (s *symmetricState) mixKeyAndHash(inputKeyMaterial []byte) {
 
-	output := hkdf(s.ck[:], inputKeyMaterial, 3)
+	hashLen := s.hash.hashLen
+	output := s.hash.hkdf(s.ck, inputKeyMaterial, 3)
 
-	copy(s.ck[:], output[:hashLen])
+	s.ck = output[:hashLen]
 
 	s.mixHash(output[hashLen : hashLen*2])
 
-	// The output of HKDF is taken as is because we use hashLen = 32
-
-	s.cipherState.initializeKey(output[hashLen*2:])
+	// If hashLen is 64, then the output of HKDF is truncated to 32 bytes
+	s.cipherState.initializeKey(output[hashLen*2 : hashLen*2+32])
 }
 
 // encrypts the plaintext and authenticates the hash
@@ -157,7 +159,7 @@ func (s *symmetricState) mixKeyAndHash(inputKeyMaterial []byte) {
 func (s *symmetricState) encryptAndHash(plaintext []byte) (ciphertext []byte, err error) {
 
 	// Note that if k is empty, the encryptWithAd() call will set ciphertext equal to plaintext.
-	ciphertext, err = s.cipherState.encryptWithAd(s.h[:], plaintext)
+	ciphertext, err = s.cipherState.encryptWithAd(s.h, plaintext)
 
 	if err != nil {
 		return
@@ -172,7 +174,7 @@ func (s *symmetricState) encryptAndHash(plaintext []byte) (ciphertext []byte, er
 func (s *symmetricState) decryptAndHash(ciphertext []byte) (plaintext []byte, err error) {
 
 	// Note that if k is empty, the decryptWithAd() call will set plaintext equal to ciphertext.
-	plaintext, err = s.cipherState.decryptWithAd(s.h[:], ciphertext)
+	plaintext, err = s.cipherState.decryptWithAd(s.h, ciphertext)
 
 	if err != nil {
 		return
@@ -184,15 +186,23 @@ func (s *symmetricState) decryptAndHash(ciphertext []byte) (plaintext []byte, er
 }
 
 func (s symmetricState) Split() (c1, c2 *cipherState) {
-	c1 = new(cipherState)
-	c2 = new(cipherState)
-	output := hkdf(s.ck[:], []byte{}, 2)
-	// The output of HKDF is taken as is because we use hashLen = 32
-	c1.initializeKey(output[:hashLen])
-	c2.initializeKey(output[hashLen:])
+	c1 = &cipherState{cipher: s.cipherState.cipher}
+	c2 = &cipherState{cipher: s.cipherState.cipher}
+	hashLen := s.hash.hashLen
+	output := s.hash.hkdf(s.ck, []byte{}, 2)
+	// If hashLen is 64, then the outputs of HKDF are truncated to 32 bytes
+	c1.initializeKey(output[:32])
+	c2.initializeKey(output[hashLen : hashLen+32])
 	return
 }
 
+// exporterSecret derives a secret from the final chaining key and handshake
+// hash, independent from the keys returned by Split(). Keying material can
+// then be exported from it, see Conn.ExportKeyingMaterial()
+func (s symmetricState) exporterSecret() []byte {
+	return s.hash.hkdf(s.ck, s.h, 2)[:s.hash.hashLen]
+}
+
 //
 // HandshakeState object
 //
@@ -200,8 +210,10 @@ func (s symmetricState) Split() (c1, c2 *cipherState) {
 type handshakeState struct {
 	// the symmetricState object
 	symmetricState symmetricState
+	// the DH function
+	dh dhFunc
 	/* Empty is a special value which indicates the variable has not yet been initialized.
-	we'll use KeyPair.privateKey = 0 as Empty
+	we'll use a nil KeyPair.PrivateKey as Empty
 	*/
 	s  KeyPair // The local static key pair
 	e  KeyPair // The local ephemeral key pair
@@ -218,82 +230,80 @@ type handshakeState struct {
 	// or ReadMessage
 	shouldWrite bool
 
-	// pre-shared key
-	psk []byte
+	// the pre-shared keys, consumed in order by the psk tokens
+	psks [][]byte
+	// true if the handshake pattern contains psk tokens: in that case
+	// ephemeral public keys are also mixed into the chaining key
+	pskMode bool
 
 	// for test vectors
 	debugEphemeral *KeyPair
 }
 
 // This allows you to initialize a peer.
-// * see `patterns` for a list of available handshakePatterns
+// * protocol is the handshake pattern and the DH, cipher and hash functions
+//   to use, see `Config.protocol()` and `parseProtocolName()`
 // * initiator = false means the instance is for a responder
 // * prologue is a byte string record of anything that happened prior the Noise handshakeState
 // * s, e, rs, re are the local and remote static/ephemeral key pairs to be set (if they exist)
 // the function returns a handshakeState object.
-func initialize(handshakeType noiseHandshakeType, initiator bool, prologue []byte, s, e, rs, re *KeyPair) (h handshakeState) {
-	handshakePattern, ok := patterns[handshakeType]
-	if !ok {
-		panic("Noise: the supplied handshakePattern does not exist")
-	}
+func initialize(protocol protocol, initiator bool, prologue []byte, s, e, rs, re *KeyPair) (h handshakeState, err error) {
+	handshakePattern := protocol.pattern
 
-	h.symmetricState.initializeSymmetric([]byte("Noise_" + handshakePattern.name + "_25519_ChaChaPoly_SHA256"))
+	h.dh = protocol.dh
+	h.symmetricState.cipherState.cipher = protocol.cipher
+	h.symmetricState.hash = protocol.hash
+	h.symmetricState.initializeSymmetric([]byte(protocol.name()))
 
 	h.symmetricState.mixHash(prologue)
 
 	if s != nil {
-		h.s = *s
+		h.s = s.clone()
 	}
 	if e != nil {
-		panic("Noise: fallback patterns are not implemented")
+		h.e = e.clone()
 	}
 	if rs != nil {
-		h.rs = *rs
+		h.rs = rs.clone()
 	}
 	if re != nil {
-		panic("Noise: fallback patterns are not implemented")
+		h.re = re.clone()
 	}
 
 	h.initiator = initiator
 	h.shouldWrite = initiator
+	h.pskMode = handshakePattern.countTokens(token_psk) > 0
 
 	//Calls MixHash() once for each public key listed in the pre-messages from handshake_pattern, with the specified public key as input (see Section 7 for an explanation of pre-messages). If both initiator and responder have pre-messages, the initiator's public keys are hashed first.
-
-	// initiator pre-message pattern
-	for _, token := range handshakePattern.preMessagePatterns[0] {
-		if token == token_s {
-			if initiator {
-				if s == nil {
-					panic("Noise: the static key of the client should be set")
-				}
-				h.symmetricState.mixHash(s.PublicKey[:])
-			} else {
-				if rs == nil {
-					panic("Noise: the remote static key of the server should be set")
-				}
-				h.symmetricState.mixHash(rs.PublicKey[:])
+	// In a PSK handshake, an ephemeral key in a pre-message is also mixed with MixKey() (see Section 9.2).
+
+	// initiator pre-message pattern, then responder pre-message pattern
+	for idx, preMessage := range handshakePattern.preMessagePatterns {
+		local := (idx == 0) == initiator
+		for _, token := range preMessage {
+			var key *KeyPair
+			switch {
+			case token == token_s && local:
+				key = s
+			case token == token_s:
+				key = rs
+			case token == token_e && local:
+				key = e
+			case token == token_e:
+				key = re
+			default:
+				return h, configError("noise: token of pre-message not supported")
 			}
-		} else {
-			panic("Noise: token of pre-message not supported")
-		}
-	}
-
-	// responder pre-message pattern
-	for _, token := range handshakePattern.preMessagePatterns[1] {
-		if token == token_s {
-			if initiator {
-				if rs == nil {
-					panic("Noise: the remote static key of the client should be set")
-				}
-				h.symmetricState.mixHash(rs.PublicKey[:])
-			} else {
-				if s == nil {
-					panic("Noise: the static key of the server should be set")
+			if key == nil {
+				if local {
+					return h, configError("noise: the local keys required by the pre-messages should be set")
 				}
-				h.symmetricState.mixHash(s.PublicKey[:])
+				return h, configError("noise: the remote keys required by the pre-messages should be set")
+			}
+			h.symmetricState.mixHash(key.PublicKey)
+			if token == token_e && h.pskMode {
+				h.symmetricState.mixKey(key.PublicKey)
 			}
-		} else {
-			panic("Noise: token of pre-message not supported")
 		}
 	}
 
@@ -306,11 +316,11 @@ func initialize(handshakeType noiseHandshakeType, initiator bool, prologue []byt
 func (h *handshakeState) writeMessage(payload []byte, messageBuffer *[]byte) (c1, c2 *cipherState, err error) {
 	// is it our turn to write?
 	if !h.shouldWrite {
-		panic("Noise: unexpected call to WriteMessage should be ReadMessage")
+		return nil, nil, wrongTurnError("noise: unexpected call to WriteMessage should be ReadMessage")
 	}
 	// do we have a token to process?
 	if len(h.messagePatterns) == 0 || len(h.messagePatterns[0]) == 0 {
-		panic("Noise: no more tokens or message patterns to write")
+		return nil, nil, wrongTurnError("noise: no more tokens or message patterns to write")
 	}
 
 	// process the patterns
@@ -318,48 +328,57 @@ func (h *handshakeState) writeMessage(payload []byte, messageBuffer *[]byte) (c1
 
 		switch pattern {
 		default:
-			panic("Noise: token not recognized")
+			return nil, nil, errors.New("noise: token not recognized")
 		case token_e:
 			// debug
 			if h.debugEphemeral != nil {
-				h.e = *h.debugEphemeral
+				h.e = h.debugEphemeral.clone()
 			} else {
-				h.e = *GenerateKeypair(nil)
+				var e *KeyPair
+				e, err = h.dh.generateKeypair(nil)
+				if err != nil {
+					return
+				}
+				h.e = *e
 			}
-			*messageBuffer = append(*messageBuffer, h.e.PublicKey[:]...)
-			h.symmetricState.mixHash(h.e.PublicKey[:])
-			if len(h.psk) > 0 {
+			*messageBuffer = append(*messageBuffer, h.e.PublicKey...)
+			h.symmetricState.mixHash(h.e.PublicKey)
+			if h.pskMode {
 				h.symmetricState.mixKey(h.e.PublicKey)
 			}
 		case token_s:
 			var ciphertext []byte
-			ciphertext, err = h.symmetricState.encryptAndHash(h.s.PublicKey[:])
+			ciphertext, err = h.symmetricState.encryptAndHash(h.s.PublicKey)
 			if err != nil {
 				return
 			}
 			*messageBuffer = append(*messageBuffer, ciphertext...)
 
 		case token_ee:
-			h.symmetricState.mixKey(dh(h.e, h.re.PublicKey))
+			h.symmetricState.mixKey(h.dh.dh(h.e.PrivateKey, h.re.PublicKey))
 
 		case token_es:
 			if h.initiator {
-				h.symmetricState.mixKey(dh(h.e, h.rs.PublicKey))
+				h.symmetricState.mixKey(h.dh.dh(h.e.PrivateKey, h.rs.PublicKey))
 			} else {
-				h.symmetricState.mixKey(dh(h.s, h.re.PublicKey))
+				h.symmetricState.mixKey(h.dh.dh(h.s.PrivateKey, h.re.PublicKey))
 			}
 
 		case token_se:
 			if h.initiator {
-				h.symmetricState.mixKey(dh(h.s, h.re.PublicKey))
+				h.symmetricState.mixKey(h.dh.dh(h.s.PrivateKey, h.re.PublicKey))
 			} else {
-				h.symmetricState.mixKey(dh(h.e, h.rs.PublicKey))
+				h.symmetricState.mixKey(h.dh.dh(h.e.PrivateKey, h.rs.PublicKey))
 			}
 
 		case token_ss:
-			h.symmetricState.mixKey(dh(h.s, h.rs.PublicKey))
+			h.symmetricState.mixKey(h.dh.dh(h.s.PrivateKey, h.rs.PublicKey))
 		case token_psk:
-			h.symmetricState.mixKeyAndHash(h.psk)
+			if len(h.psks) == 0 {
+				return nil, nil, configError("noise: no pre-shared key left for the psk token")
+			}
+			h.symmetricState.mixKeyAndHash(h.psks[0])
+			h.psks = h.psks[1:]
 		}
 	}
 
@@ -393,11 +412,11 @@ func (h *handshakeState) writeMessage(payload []byte, messageBuffer *[]byte) (c1
 func (h *handshakeState) readMessage(message []byte, payloadBuffer *[]byte) (c1, c2 *cipherState, err error) {
 	// is it our turn to read?
 	if h.shouldWrite {
-		panic("Noise: unexpected call to ReadMessage should be WriteMessage")
+		return nil, nil, wrongTurnError("noise: unexpected call to ReadMessage should be WriteMessage")
 	}
 	// do we have a token to process?
 	if len(h.messagePatterns) == 0 || len(h.messagePatterns[0]) == 0 {
-		panic("Noise: no more message pattern to read")
+		return nil, nil, wrongTurnError("noise: no more message pattern to read")
 	}
 
 	// process the patterns
@@ -407,18 +426,20 @@ func (h *handshakeState) readMessage(message []byte, payloadBuffer *[]byte) (c1,
 
 		switch pattern {
 		default:
-			panic("noise: token not recognized")
+			return nil, nil, errors.New("noise: token not recognized")
 		case token_e:
+			dhLen := h.dh.dhLen
 			if len(message[offset:]) < dhLen {
 				return nil, nil, errors.New("noise: the received ephemeral key is to short")
 			}
-			copy(h.re.PublicKey[:], message[offset:offset+dhLen])
+			h.re.PublicKey = append([]byte{}, message[offset:offset+dhLen]...)
 			offset += dhLen
-			h.symmetricState.mixHash(h.re.PublicKey[:])
-			if len(h.psk) > 0 {
+			h.symmetricState.mixHash(h.re.PublicKey)
+			if h.pskMode {
 				h.symmetricState.mixKey(h.re.PublicKey)
 			}
 		case token_s:
+			dhLen := h.dh.dhLen
 			tagLen := 0
 			if h.symmetricState.cipherState.hasKey() {
 				tagLen = 16
@@ -432,30 +453,34 @@ func (h *handshakeState) readMessage(message []byte, payloadBuffer *[]byte) (c1,
 				return
 			}
 			// if we already know the remote static, compare
-			copy(h.rs.PublicKey[:], plaintext)
+			h.rs.PublicKey = plaintext
 			offset += dhLen + tagLen
 
 		case token_ee:
-			h.symmetricState.mixKey(dh(h.e, h.re.PublicKey))
+			h.symmetricState.mixKey(h.dh.dh(h.e.PrivateKey, h.re.PublicKey))
 
 		case token_es:
 			if h.initiator {
-				h.symmetricState.mixKey(dh(h.e, h.rs.PublicKey))
+				h.symmetricState.mixKey(h.dh.dh(h.e.PrivateKey, h.rs.PublicKey))
 			} else {
-				h.symmetricState.mixKey(dh(h.s, h.re.PublicKey))
+				h.symmetricState.mixKey(h.dh.dh(h.s.PrivateKey, h.re.PublicKey))
 			}
 
 		case token_se:
 			if h.initiator {
-				h.symmetricState.mixKey(dh(h.s, h.re.PublicKey))
+				h.symmetricState.mixKey(h.dh.dh(h.s.PrivateKey, h.re.PublicKey))
 			} else {
-				h.symmetricState.mixKey(dh(h.e, h.rs.PublicKey))
+				h.symmetricState.mixKey(h.dh.dh(h.e.PrivateKey, h.rs.PublicKey))
 			}
 
 		case token_ss:
-			h.symmetricState.mixKey(dh(h.s, h.rs.PublicKey))
+			h.symmetricState.mixKey(h.dh.dh(h.s.PrivateKey, h.rs.PublicKey))
 		case token_psk:
-			h.symmetricState.mixKeyAndHash(h.psk)
+			if len(h.psks) == 0 {
+				return nil, nil, configError("noise: no pre-shared key left for the psk token")
+			}
+			h.symmetricState.mixKeyAndHash(h.psks[0])
+			h.psks = h.psks[1:]
 		}
 	}
 
@@ -492,6 +517,16 @@ func (h *handshakeState) clear() {
 	h.e.clear()
 	h.rs.clear()
 	h.re.clear()
+	h.psks = nil
+}
+
+// clone returns a deep copy of the key pair, so that clearing it
+// does not affect the key pair passed by the application
+func (kp KeyPair) clone() KeyPair {
+	return KeyPair{
+		PrivateKey: append([]byte(nil), kp.PrivateKey...),
+		PublicKey:  append([]byte(nil), kp.PublicKey...),
+	}
 }
 
 // TODO: is there a better way to get rid of secrets in Go?
@@ -0,0 +1,333 @@
+package noise
+
+import (
+	"errors"
+)
+
+//
+// NoiseSocket
+//
+// NoiseSocket (https://noisesocket.org) frames Noise messages on a stream.
+// Handshake messages are sent as:
+//
+//	negotiation_data_len (2 bytes) || negotiation_data || noise_message_len (2 bytes) || noise_message
+//
+// and transport messages as:
+//
+//	noise_message_len (2 bytes) || noise_message
+//
+// The payloads of handshake messages and transport messages carry a body
+// that can be padded to hide its length:
+//
+//	body_len (2 bytes) || body || padding
+//
+// The negotiation data of the client's initial message typically describes
+// the Noise protocol it uses. The server then accepts it (and responds with
+// empty negotiation data), switches to another protocol that it initiates,
+// asks the client to retry with another protocol, or rejects the client.
+//
+
+// A NoiseSocketDecision is the answer of a NoiseSocket server to the initial
+// message of a client, see Config.NoiseSocketNegotiate.
+type NoiseSocketDecision uint8
+
+const (
+	// NoiseSocketAccept processes the initial message and continues the handshake
+	NoiseSocketAccept NoiseSocketDecision = iota
+	// NoiseSocketSwitch ignores the initial message and starts a new
+	// handshake initiated by the server. If the new handshake pattern has an
+	// ephemeral pre-message from the responder (for example XXfallback), the
+	// ephemeral key of the client's initial message is re-used
+	NoiseSocketSwitch
+	// NoiseSocketRetry asks the client to send a new initial message
+	NoiseSocketRetry
+	// NoiseSocketReject refuses the client
+	NoiseSocketReject
+)
+
+// The prologue of a NoiseSocket handshake starts with one of these labels,
+// followed by the negotiation that happened before it:
+//
+// * Init1: initial_negotiation_data_len || initial_negotiation_data
+// * Init2 (switch): initial message || response_negotiation_data_len || response_negotiation_data
+// * Init3 (retry): initial message || retry message || retried_negotiation_data_len || retried_negotiation_data
+//
+// where the messages are NoiseSocket handshake messages. Config.Prologue is
+// appended to it.
+var (
+	noiseSocketInit1 = []byte("NoiseSocketInit1")
+	noiseSocketInit2 = []byte("NoiseSocketInit2")
+	noiseSocketInit3 = []byte("NoiseSocketInit3")
+)
+
+var (
+	errUnexpectedNegotiationData = errors.New("noise: unexpected NoiseSocket negotiation data")
+	errNoiseSocketNotAccepted    = errors.New("noise: the NoiseSocket server did not accept the initial message")
+	errNoiseSocketRejected       = errors.New("noise: the NoiseSocket initial message was rejected")
+)
+
+// noiseSocketPrologue concatenates the label, the given fields, and the
+// prologue of the configuration
+func noiseSocketPrologue(label []byte, fields []byte, config *Config) []byte {
+	prologue := append(append([]byte{}, label...), fields...)
+	return append(prologue, config.Prologue...)
+}
+
+// appendLengthPrefixed appends the length of data (2 bytes, big-endian) and data
+func appendLengthPrefixed(dst, data []byte) []byte {
+	return append(append(dst, byte(len(data)>>8), byte(len(data))), data...)
+}
+
+// noiseSocketMessage encodes a NoiseSocket handshake message
+func noiseSocketMessage(negotiationData, noiseMessage []byte) []byte {
+	message := make([]byte, 0, 4+len(negotiationData)+len(noiseMessage))
+	return appendLengthPrefixed(appendLengthPrefixed(message, negotiationData), noiseMessage)
+}
+
+// encodeNoiseSocketBody adds the length of the body and paddingLength zero
+// bytes of padding, before encryption
+func encodeNoiseSocketBody(body []byte, paddingLength int) ([]byte, error) {
+	if len(body) > 0xffff {
+		return nil, errors.New("noise: the NoiseSocket body is too large")
+	}
+	plaintext := make([]byte, 0, 2+len(body)+paddingLength)
+	plaintext = appendLengthPrefixed(plaintext, body)
+	return append(plaintext, make([]byte, paddingLength)...), nil
+}
+
+// decodeNoiseSocketBody removes the length and the padding of a decrypted body
+func decodeNoiseSocketBody(plaintext []byte) ([]byte, error) {
+	if len(plaintext) < 2 {
+		return nil, errors.New("noise: the received NoiseSocket body is too short")
+	}
+	length := int(plaintext[0])<<8 | int(plaintext[1])
+	if len(plaintext) < 2+length {
+		return nil, errors.New("noise: the received NoiseSocket body is malformed")
+	}
+	return plaintext[2 : 2+length], nil
+}
+
+// writeNoiseSocketMessage writes a NoiseSocket handshake message, and returns
+// its encoding
+func (c *Conn) writeNoiseSocketMessage(negotiationData, noiseMessage []byte) ([]byte, error) {
+	if len(negotiationData) > 0xffff {
+		return nil, errors.New("noise: the NoiseSocket negotiation data is too large")
+	}
+	if len(noiseMessage) > maxMessageLength {
+		return nil, errors.New("noise: the handshake message exceeds the maximum size of a Noise message")
+	}
+	message := noiseSocketMessage(negotiationData, noiseMessage)
+	_, err := c.conn.Write(message)
+	return message, err
+}
+
+// readNoiseSocketMessage reads a NoiseSocket handshake message
+func (c *Conn) readNoiseSocketMessage() (negotiationData, noiseMessage []byte, err error) {
+	readField := func() ([]byte, error) {
+		bufHeader, err := readFromUntil(c.conn, 2) // length header
+		if err != nil {
+			return nil, err
+		}
+		return readFromUntil(c.conn, int(bufHeader[0])<<8|int(bufHeader[1]))
+	}
+	if negotiationData, err = readField(); err != nil {
+		return
+	}
+	noiseMessage, err = readField()
+	return
+}
+
+// noiseSocketHandshake runs the negotiation and the handshake of NoiseSocket
+func (c *Conn) noiseSocketHandshake(protocol protocol, keyPair, remoteKeyPair *KeyPair) (c1, c2 *cipherState, err error) {
+	if c.isClient {
+		return c.noiseSocketClient(protocol, keyPair, remoteKeyPair)
+	}
+	return c.noiseSocketServer(protocol, keyPair, remoteKeyPair)
+}
+
+// switchConfig replaces the configuration of the connection during the
+// negotiation, initiator is the role of this peer in the new handshake
+func (c *Conn) switchConfig(config *Config, initiator bool) (protocol protocol, keyPair, remoteKeyPair *KeyPair, err error) {
+	if config == nil || !config.NoiseSocket {
+		err = configError("noise: the configuration of a NoiseSocket negotiation must set NoiseSocket")
+		return
+	}
+	if err = checkRequirements(initiator, config); err != nil {
+		return
+	}
+	if protocol, err = config.protocol(); err != nil {
+		return
+	}
+	if keyPair, remoteKeyPair, err = config.keyPairs(protocol.dh); err != nil {
+		return
+	}
+	c.config = config
+	return
+}
+
+func (c *Conn) noiseSocketClient(protocol protocol, keyPair, remoteKeyPair *KeyPair) (c1, c2 *cipherState, err error) {
+	negotiationData := c.config.NegotiationData
+	prologue := noiseSocketPrologue(noiseSocketInit1, appendLengthPrefixed(nil, negotiationData), c.config)
+	retried := false
+	for {
+		// initial message
+		if err = c.initializeHandshake(protocol, true, prologue, keyPair, nil, remoteKeyPair, nil); err != nil {
+			return
+		}
+		var noiseMessage, initialMessage []byte
+		if noiseMessage, c1, c2, err = c.nextHandshakeMessage(); err != nil {
+			return
+		}
+		if initialMessage, err = c.writeNoiseSocketMessage(negotiationData, noiseMessage); err != nil {
+			return
+		}
+		// one-way patterns end here
+		if c1 != nil {
+			return
+		}
+
+		// the server accepted our initial message
+		var responseData []byte
+		if responseData, noiseMessage, err = c.readNoiseSocketMessage(); err != nil {
+			return
+		}
+		if len(responseData) == 0 {
+			if err = alertFrame(noiseMessage); err != nil {
+				return
+			}
+			if c1, c2, err = c.readHandshakeMessage(noiseMessage); err != nil || c1 != nil {
+				return
+			}
+			return c.runHandshake()
+		}
+
+		// the server switched protocol, asked us to retry, or rejected us
+		switched := len(noiseMessage) > 0
+		if c.config.NoiseSocketRenegotiate == nil {
+			return nil, nil, errNoiseSocketNotAccepted
+		}
+		var config *Config
+		if config, err = c.config.NoiseSocketRenegotiate(responseData, switched); err != nil {
+			return
+		}
+		if protocol, keyPair, remoteKeyPair, err = c.switchConfig(config, !switched); err != nil {
+			return
+		}
+		previous := c.hs
+
+		if switched {
+			ephemeral := previous.e
+			prologue = noiseSocketPrologue(noiseSocketInit2, appendLengthPrefixed(initialMessage, responseData), c.config)
+			err = c.initializeHandshake(protocol, false, prologue, keyPair, &ephemeral, remoteKeyPair, nil)
+			previous.clear()
+			if err != nil {
+				return
+			}
+			if c1, c2, err = c.readHandshakeMessage(noiseMessage); err != nil || c1 != nil {
+				return
+			}
+			return c.runHandshake()
+		}
+
+		previous.clear()
+		if retried {
+			return nil, nil, errors.New("noise: the NoiseSocket server asked to retry more than once")
+		}
+		retried = true
+		negotiationData = c.config.NegotiationData
+		fields := append(initialMessage, noiseSocketMessage(responseData, nil)...)
+		prologue = noiseSocketPrologue(noiseSocketInit3, appendLengthPrefixed(fields, negotiationData), c.config)
+	}
+}
+
+func (c *Conn) noiseSocketServer(protocol protocol, keyPair, remoteKeyPair *KeyPair) (c1, c2 *cipherState, err error) {
+	negotiationData, noiseMessage, err := c.readNoiseSocketMessage()
+	if err != nil {
+		return
+	}
+	if c.config.GetConfigForClient != nil {
+		var config *Config
+		if config, err = c.configForClient(negotiationData); err != nil {
+			return
+		}
+		if protocol, keyPair, remoteKeyPair, err = c.switchConfig(config, false); err != nil {
+			return
+		}
+	}
+	initialMessage := noiseSocketMessage(negotiationData, noiseMessage)
+	prologue := noiseSocketPrologue(noiseSocketInit1, appendLengthPrefixed(nil, negotiationData), c.config)
+	retried := false
+	for {
+		decision, responseData, config := NoiseSocketAccept, []byte(nil), (*Config)(nil)
+		if c.config.NoiseSocketNegotiate != nil {
+			decision, responseData, config = c.config.NoiseSocketNegotiate(negotiationData)
+		}
+		if decision != NoiseSocketAccept && len(responseData) == 0 {
+			return nil, nil, errors.New("noise: a NoiseSocket server must send negotiation data to switch, retry or reject")
+		}
+		if decision == NoiseSocketReject {
+			if _, err = c.writeNoiseSocketMessage(responseData, nil); err != nil {
+				return
+			}
+			return nil, nil, errNoiseSocketRejected
+		}
+		if decision == NoiseSocketRetry && retried {
+			return nil, nil, errors.New("noise: a NoiseSocket server can only ask to retry once")
+		}
+		if config != nil {
+			if protocol, keyPair, remoteKeyPair, err = c.switchConfig(config, decision == NoiseSocketSwitch); err != nil {
+				return
+			}
+		}
+
+		switch decision {
+		case NoiseSocketAccept:
+			if err = c.initializeHandshake(protocol, false, prologue, keyPair, nil, remoteKeyPair, nil); err != nil {
+				return
+			}
+			if c1, c2, err = c.readHandshakeMessage(noiseMessage); err != nil || c1 != nil {
+				return
+			}
+			return c.runHandshake()
+
+		case NoiseSocketSwitch:
+			// the client's ephemeral key can be re-used (fallback patterns)
+			var remoteEphemeral *KeyPair
+			if protocol.pattern.preMessagePatterns[1].contains(token_e) {
+				if len(noiseMessage) < protocol.dh.dhLen {
+					return nil, nil, errors.New("noise: the NoiseSocket initial message does not start with an ephemeral key")
+				}
+				remoteEphemeral = &KeyPair{PublicKey: append([]byte{}, noiseMessage[:protocol.dh.dhLen]...)}
+			}
+			c.handshakeMessages++ // the ignored initial message
+			prologue = noiseSocketPrologue(noiseSocketInit2, appendLengthPrefixed(initialMessage, responseData), c.config)
+			if err = c.initializeHandshake(protocol, true, prologue, keyPair, nil, remoteKeyPair, remoteEphemeral); err != nil {
+				return
+			}
+			if noiseMessage, c1, c2, err = c.nextHandshakeMessage(); err != nil {
+				return
+			}
+			if _, err = c.writeNoiseSocketMessage(responseData, noiseMessage); err != nil || c1 != nil {
+				return
+			}
+			return c.runHandshake()
+
+		case NoiseSocketRetry:
+			var retryMessage []byte
+			if retryMessage, err = c.writeNoiseSocketMessage(responseData, nil); err != nil {
+				return
+			}
+			c.handshakeMessages++ // the ignored initial message
+			if negotiationData, noiseMessage, err = c.readNoiseSocketMessage(); err != nil {
+				return
+			}
+			fields := append(initialMessage, retryMessage...)
+			prologue = noiseSocketPrologue(noiseSocketInit3, appendLengthPrefixed(fields, negotiationData), c.config)
+			initialMessage = noiseSocketMessage(negotiationData, noiseMessage)
+			retried = true
+
+		default:
+			return nil, nil, errors.New("noise: unknown NoiseSocket decision")
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package noise
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+//
+// NoiseSocket transcripts
+//
+// Each transcript describes a NoiseSocket connection (keys, protocols,
+// negotiation data and decision of the server) and the frames written on the
+// wire by each peer. The connection is replayed with the same ephemeral keys,
+// and the frames must match byte for byte.
+//
+// vectors/noisesocket/go-noisesocket/ holds connections recorded from
+// go-noisesocket peers (https://github.com/go-noisesocket/noisesocket), see
+// the README of the folder. They check the interoperability of the two
+// implementations and are never rewritten.
+//
+// vectors/noisesocket/regression/ holds transcripts generated by this
+// implementation with -update-transcripts. They only detect unintended
+// changes of its wire format, and prove nothing about interoperability.
+//
+
+var updateTranscripts = flag.Bool("update-transcripts", false, "rewrite the frames of the NoiseSocket regression transcripts")
+
+type noiseSocketTranscript struct {
+	Description string `json:"description"`
+
+	ClientProtocol     string   `json:"client_protocol"`
+	ClientStatic       string   `json:"client_static"`
+	ClientEphemerals   []string `json:"client_ephemerals"`
+	ClientRemoteStatic string   `json:"client_remote_static,omitempty"`
+
+	ServerStatic     string   `json:"server_static"`
+	ServerEphemerals []string `json:"server_ephemerals"`
+
+	// "accept", "switch", "retry" or "reject"
+	ServerDecision string `json:"server_decision"`
+	// the protocol the server switches to, or asks the client to retry with
+	RenegotiatedProtocol string `json:"renegotiated_protocol,omitempty"`
+
+	ClientFrames []string `json:"client_frames"`
+	ServerFrames []string `json:"server_frames"`
+}
+
+// recordingConn records the frames written on a connection
+type recordingConn struct {
+	net.Conn
+	frames *[]string
+}
+
+func (r recordingConn) Write(b []byte) (int, error) {
+	n, err := r.Conn.Write(b)
+	if err == nil {
+		*r.frames = append(*r.frames, hex.EncodeToString(b))
+	}
+	return n, err
+}
+
+// the root key signing the static keys of the transcripts
+var transcriptRootKey = ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+
+func transcriptKeyPair(t *testing.T, privateKey string) *KeyPair {
+	raw, err := hex.DecodeString(privateKey)
+	if err != nil || len(raw) != 32 {
+		t.Fatalf("invalid private key %q", privateKey)
+	}
+	var key [32]byte
+	copy(key[:], raw)
+	return GenerateKeypair(&key)
+}
+
+func transcriptConfig(keyPair *KeyPair, protocolName string) *Config {
+	return &Config{
+		NoiseSocket:          true,
+		ProtocolName:         protocolName,
+		NegotiationData:      []byte(protocolName),
+		KeyPair:              keyPair,
+		StaticPublicKeyProof: CreateStaticPublicKeyProof(transcriptRootKey, keyPair),
+		PublicKeyVerifier:    CreatePublicKeyVerifier(transcriptRootKey.Public().(ed25519.PublicKey)),
+	}
+}
+
+// replay runs the connection described by the transcript and records its frames
+func (tr *noiseSocketTranscript) replay(t *testing.T) (clientFrames, serverFrames []string) {
+	decisions := map[string]NoiseSocketDecision{
+		"accept": NoiseSocketAccept,
+		"switch": NoiseSocketSwitch,
+		"retry":  NoiseSocketRetry,
+		"reject": NoiseSocketReject,
+	}
+	decision, ok := decisions[tr.ServerDecision]
+	if !ok {
+		t.Fatalf("unknown decision %q", tr.ServerDecision)
+	}
+
+	// configurations
+	clientKeyPair := transcriptKeyPair(t, tr.ClientStatic)
+	serverKeyPair := transcriptKeyPair(t, tr.ServerStatic)
+	clientConfig := transcriptConfig(clientKeyPair, tr.ClientProtocol)
+	if tr.ClientRemoteStatic != "" {
+		clientConfig.RemoteKey, _ = hex.DecodeString(tr.ClientRemoteStatic)
+	}
+	clientConfig.NoiseSocketRenegotiate = func(negotiationData []byte, switched bool) (*Config, error) {
+		if tr.RenegotiatedProtocol == "" || string(negotiationData) != tr.RenegotiatedProtocol {
+			return nil, errors.New("rejected: " + string(negotiationData))
+		}
+		return transcriptConfig(clientKeyPair, tr.RenegotiatedProtocol), nil
+	}
+	serverConfig := transcriptConfig(serverKeyPair, tr.ClientProtocol)
+	negotiations := 0
+	serverConfig.NoiseSocketNegotiate = func(negotiationData []byte) (NoiseSocketDecision, []byte, *Config) {
+		negotiations++
+		if negotiations > 1 {
+			return NoiseSocketAccept, nil, nil
+		}
+		if decision == NoiseSocketReject {
+			return decision, []byte("unsupported protocol"), nil
+		}
+		var config *Config
+		if tr.RenegotiatedProtocol != "" {
+			config = transcriptConfig(serverKeyPair, tr.RenegotiatedProtocol)
+			config.NoiseSocketNegotiate = serverConfig.NoiseSocketNegotiate
+		}
+		return decision, []byte(tr.RenegotiatedProtocol), config
+	}
+
+	// connections
+	clientPipe, serverPipe := net.Pipe()
+	client := Client(recordingConn{clientPipe, &clientFrames}, clientConfig)
+	server := Server(recordingConn{serverPipe, &serverFrames}, serverConfig)
+	for _, key := range tr.ClientEphemerals {
+		client.debugEphemerals = append(client.debugEphemerals, transcriptKeyPair(t, key))
+	}
+	for _, key := range tr.ServerEphemerals {
+		server.debugEphemerals = append(server.debugEphemerals, transcriptKeyPair(t, key))
+	}
+
+	// the server answers the client's message
+	serverErr := make(chan error, 1)
+	go func() {
+		var buf [100]byte
+		n, err := server.Read(buf[:])
+		if err == nil && !bytes.Equal(buf[:n], []byte("hello")) {
+			err = errors.New("the server received " + string(buf[:n]))
+		}
+		if err == nil {
+			_, err = server.Write([]byte("hello to you"))
+		}
+		server.Close()
+		serverErr <- err
+	}()
+
+	err := client.Handshake()
+	if decision == NoiseSocketReject {
+		if err == nil {
+			t.Fatal("the client should have been rejected")
+		}
+		client.Close()
+		if err = <-serverErr; err != errNoiseSocketRejected {
+			t.Fatal("unexpected server error:", err)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal("client handshake failed:", err)
+	}
+	defer client.Close()
+	if _, err = client.Write([]byte("hello")); err != nil {
+		t.Fatal("client can't write:", err)
+	}
+	var buf [100]byte
+	n, err := client.Read(buf[:])
+	if err != nil || !bytes.Equal(buf[:n], []byte("hello to you")) {
+		t.Fatal("client can't read the server's answer:", err)
+	}
+	// the server closes the connection with a close_notify
+	if _, err = client.Read(buf[:]); err != io.EOF {
+		t.Fatal("the client should have read io.EOF, not", err)
+	}
+	if err = <-serverErr; err != nil {
+		t.Fatal("server failed:", err)
+	}
+	return
+}
+
+// loadTranscripts returns the NoiseSocket transcripts of a folder of
+// vectors/noisesocket/
+func loadTranscripts(t *testing.T, folder string) (files []string, transcripts []noiseSocketTranscript) {
+	files, err := filepath.Glob(filepath.Join("./vectors/noisesocket", folder, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		raw, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var transcript noiseSocketTranscript
+		if err = json.Unmarshal(raw, &transcript); err != nil {
+			t.Fatal(file, err)
+		}
+		transcripts = append(transcripts, transcript)
+	}
+	return
+}
+
+// compareFrames checks the frames written by the replay of a transcript
+func compareFrames(t *testing.T, file string, transcript *noiseSocketTranscript, clientFrames, serverFrames []string) {
+	for peer, frames := range map[string][2][]string{
+		"client": {transcript.ClientFrames, clientFrames},
+		"server": {transcript.ServerFrames, serverFrames},
+	} {
+		expected, actual := frames[0], frames[1]
+		if len(expected) != len(actual) {
+			t.Fatalf("%s: the %s wrote %d frames instead of %d", file, peer, len(actual), len(expected))
+		}
+		for i := range expected {
+			if expected[i] != actual[i] {
+				t.Fatalf("%s: frame %d of the %s differs\nexpected: %s\nactual:   %s", file, i, peer, expected[i], actual[i])
+			}
+		}
+	}
+}
+
+func TestNoiseSocketTranscripts(t *testing.T) {
+	files, transcripts := loadTranscripts(t, "regression")
+	if len(files) == 0 {
+		t.Fatal("no NoiseSocket regression transcripts found")
+	}
+	for i, file := range files {
+		transcript := &transcripts[i]
+		clientFrames, serverFrames := transcript.replay(t)
+
+		if *updateTranscripts {
+			transcript.ClientFrames, transcript.ServerFrames = clientFrames, serverFrames
+			raw, err := json.MarshalIndent(transcript, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = ioutil.WriteFile(file, append(raw, '\n'), 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		compareFrames(t, file, transcript, clientFrames, serverFrames)
+	}
+}
+
+func TestNoiseSocketInteroperability(t *testing.T) {
+	files, transcripts := loadTranscripts(t, "go-noisesocket")
+	if len(files) == 0 {
+		t.Skip("no recording of go-noisesocket in vectors/noisesocket/go-noisesocket/, the interoperability is not tested")
+	}
+	for i, file := range files {
+		clientFrames, serverFrames := transcripts[i].replay(t)
+		compareFrames(t, file, &transcripts[i], clientFrames, serverFrames)
+	}
+}
+
+func TestNoiseSocketBody(t *testing.T) {
+	plaintext, err := encodeNoiseSocketBody([]byte("hello"), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plaintext, []byte("\x00\x05hello\x00\x00\x00")) {
+		t.Fatalf("unexpected body %x", plaintext)
+	}
+	body, err := decodeNoiseSocketBody(plaintext)
+	if err != nil || !bytes.Equal(body, []byte("hello")) {
+		t.Fatal("the body could not be decoded", err)
+	}
+	for _, malformed := range [][]byte{nil, {0}, {0, 6, 'h', 'e', 'l', 'l', 'o'}} {
+		if _, err = decodeNoiseSocketBody(malformed); err == nil {
+			t.Fatalf("the malformed body %x should not be decoded", malformed)
+		}
+	}
+}
+
+func TestNoiseSocketRequirements(t *testing.T) {
+	config := Config{NoiseSocket: true, NoisePipes: true}
+	if err := checkRequirements(true, &config); err == nil {
+		t.Fatal("NoisePipes and NoiseSocket should not be accepted together")
+	}
+	if _, err := NewHandshakeState(&Config{NoiseSocket: true, Initiator: true}); err == nil {
+		t.Fatal("NewHandshakeState should not accept NoiseSocket")
+	}
+}
@@ -0,0 +1,303 @@
+package noise
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+//
+// 7.1. Handshake pattern notation
+//
+
+// tokensByName maps the tokens of the specification's notation
+// to the tokens used by the handshakeState
+var tokensByName = map[string]token{
+	"e":   token_e,
+	"s":   token_s,
+	"es":  token_es,
+	"se":  token_se,
+	"ss":  token_ss,
+	"ee":  token_ee,
+	"psk": token_psk,
+}
+
+// parsePattern converts the textual notation of the specification into a
+// handshake pattern. For example the notation of IK is:
+//
+//	<- s
+//	...
+//	-> e, es, s, ss
+//	<- e, ee, se
+//
+// Pre-messages come before the "..." line (if any). An optional header
+// line like "IK(s, rs):" is ignored. The pattern is then checked against
+// the validity rules of the specification, see checkPattern().
+func parsePattern(name, notation string) (hp handshakePattern, err error) {
+	hp.name = name
+	hp.preMessagePatterns = []messagePattern{
+		messagePattern{}, // →
+		messagePattern{}, // ←
+	}
+
+	var lines []string
+	hasPreMessages := false
+	for _, line := range strings.Split(notation, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || (len(lines) == 0 && strings.HasSuffix(line, ":")) {
+			continue
+		}
+		if line == "..." {
+			hasPreMessages = true
+		}
+		lines = append(lines, line)
+	}
+
+	preMessages := hasPreMessages
+	var seenPreMessage [2]bool
+	for _, line := range lines {
+		if line == "..." {
+			if !preMessages {
+				return hp, fmt.Errorf("noise: pattern %s, line %q: only one \"...\" line can separate the pre-messages from the messages", name, line)
+			}
+			preMessages = false
+			continue
+		}
+
+		// direction
+		var initiator bool
+		switch {
+		case strings.HasPrefix(line, "->"):
+			initiator = true
+		case strings.HasPrefix(line, "<-"):
+			initiator = false
+		default:
+			return hp, fmt.Errorf("noise: pattern %s, line %q: a message should start with -> or <-", name, line)
+		}
+
+		// tokens
+		var pattern messagePattern
+		for _, tokenName := range strings.Split(line[2:], ",") {
+			tokenName = strings.TrimSpace(tokenName)
+			if tokenName == "" && len(pattern) == 0 && preMessages {
+				continue
+			}
+			t, ok := tokensByName[tokenName]
+			if !ok {
+				return hp, fmt.Errorf("noise: pattern %s, line %q: unknown token %q", name, line, tokenName)
+			}
+			pattern = append(pattern, t)
+		}
+
+		if preMessages {
+			for _, t := range pattern {
+				if t != token_e && t != token_s {
+					return hp, fmt.Errorf("noise: pattern %s, line %q: pre-messages can only contain e and s", name, line)
+				}
+			}
+			direction := 1
+			if initiator {
+				direction = 0
+			}
+			if seenPreMessage[direction] || (initiator && seenPreMessage[1]) {
+				return hp, fmt.Errorf("noise: pattern %s, line %q: there can only be one pre-message per direction, the initiator's first", name, line)
+			}
+			seenPreMessage[direction] = true
+			hp.preMessagePatterns[direction] = pattern
+			continue
+		}
+
+		// the initiator sends the even messages, the responder the odd ones
+		if initiator != (len(hp.messagePatterns)%2 == 0) {
+			return hp, fmt.Errorf("noise: pattern %s, line %q: messages should alternate, starting with the initiator (->)", name, line)
+		}
+		hp.messagePatterns = append(hp.messagePatterns, pattern)
+	}
+
+	if len(hp.messagePatterns) == 0 {
+		return hp, fmt.Errorf("noise: pattern %s has no messages", name)
+	}
+
+	err = checkPattern(hp)
+	return
+}
+
+// checkPattern enforces the validity rules of the specification
+// (7.3. Handshake pattern validity and 9.3. Validity rule for psk):
+//
+// 1. Parties can only perform DH between keys they possess.
+// 2. Parties must not send their static or ephemeral public key more than
+// once per handshake (including the pre-messages).
+// 3. Parties must not perform a DH calculation more than once per handshake.
+// 4. After a DH between a remote public key and its local static key, a
+// party must not encrypt anything unless it has also performed a DH between
+// its local ephemeral key and that remote public key.
+// 5. A party must not encrypt anything after processing a psk token unless
+// it has sent an ephemeral public key.
+func checkPattern(hp handshakePattern) error {
+	// index 0 is the initiator, index 1 is the responder
+	var sentE, sentS [2]bool
+	roles := [2]string{"initiator", "responder"}
+	done := make(map[token]bool)
+	pskSeen := false
+
+	send := func(party int, t token, where string) error {
+		sent := &sentE[party]
+		keyName := "ephemeral"
+		if t == token_s {
+			sent = &sentS[party]
+			keyName = "static"
+		}
+		if *sent {
+			return fmt.Errorf("noise: pattern %s is invalid: the %s sends its %s key more than once (%s)", hp.name, roles[party], keyName, where)
+		}
+		*sent = true
+		return nil
+	}
+
+	// encryption by a party is only safe if rules 4 and 5 hold
+	canEncrypt := func(party int, where string) error {
+		if party == 0 {
+			if done[token_se] && !done[token_ee] {
+				return fmt.Errorf("noise: pattern %s is invalid: the initiator encrypts after se without ee (%s)", hp.name, where)
+			}
+			if done[token_ss] && !done[token_es] {
+				return fmt.Errorf("noise: pattern %s is invalid: the initiator encrypts after ss without es (%s)", hp.name, where)
+			}
+		} else {
+			if done[token_es] && !done[token_ee] {
+				return fmt.Errorf("noise: pattern %s is invalid: the responder encrypts after es without ee (%s)", hp.name, where)
+			}
+			if done[token_ss] && !done[token_se] {
+				return fmt.Errorf("noise: pattern %s is invalid: the responder encrypts after ss without se (%s)", hp.name, where)
+			}
+		}
+		if pskSeen && !sentE[party] {
+			return fmt.Errorf("noise: pattern %s is invalid: the %s encrypts after psk without sending an ephemeral key (%s)", hp.name, roles[party], where)
+		}
+		return nil
+	}
+
+	// pre-messages
+	for party, pattern := range hp.preMessagePatterns {
+		for _, t := range pattern {
+			if t != token_e && t != token_s {
+				return fmt.Errorf("noise: pattern %s is invalid: pre-messages can only contain e and s", hp.name)
+			}
+			if err := send(party, t, "pre-message"); err != nil {
+				return err
+			}
+		}
+	}
+
+	// messages
+	for idx, pattern := range hp.messagePatterns {
+		party := idx % 2
+		where := fmt.Sprintf("message %d", idx+1)
+		for _, t := range pattern {
+			switch t {
+			case token_e:
+				if err := send(party, t, where); err != nil {
+					return err
+				}
+			case token_s:
+				// the static key is encrypted as soon as a key has been mixed in
+				if len(done) > 0 || pskSeen {
+					if err := canEncrypt(party, where); err != nil {
+						return err
+					}
+				}
+				if err := send(party, t, where); err != nil {
+					return err
+				}
+			case token_ee, token_es, token_se, token_ss:
+				// the first letter is the initiator's key, the second the responder's
+				initiatorKey, responderKey := sentE[0], sentE[1]
+				switch t {
+				case token_es:
+					responderKey = sentS[1]
+				case token_se:
+					initiatorKey = sentS[0]
+				case token_ss:
+					initiatorKey, responderKey = sentS[0], sentS[1]
+				}
+				if !initiatorKey || !responderKey {
+					return fmt.Errorf("noise: pattern %s is invalid: %s is performed before both keys are known (%s)", hp.name, tokenName(t), where)
+				}
+				if done[t] {
+					return fmt.Errorf("noise: pattern %s is invalid: %s is performed more than once (%s)", hp.name, tokenName(t), where)
+				}
+				done[t] = true
+			case token_psk:
+				pskSeen = true
+			default:
+				return errors.New("noise: pattern " + hp.name + " is invalid: unknown token")
+			}
+		}
+		// the payload of the message
+		if err := canEncrypt(party, where); err != nil {
+			return err
+		}
+	}
+
+	// transport messages: the responder cannot send any in one-way patterns
+	if err := canEncrypt(0, "transport messages"); err != nil {
+		return err
+	}
+	if !hp.isOneWay() {
+		if err := canEncrypt(1, "transport messages"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// tokenName returns the notation of a token, for error messages
+func tokenName(t token) string {
+	for name, tok := range tokensByName {
+		if tok == t {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// RegisterHandshakePattern parses a custom handshake pattern written in the
+// notation of the specification (see parsePattern()), checks that it is
+// valid, and makes it available under the given name. The returned value can
+// be used as Config.HandshakePattern, and the name can be used in
+// Config.ProtocolName (with modifiers, for example "Noise_<name>psk0_25519_ChaChaPoly_SHA256").
+//
+// Custom patterns are meant for experimentation: RegisterHandshakePattern
+// should be called before any Listen() or Dial(), it is not safe to call it
+// concurrently with handshakes.
+func RegisterHandshakePattern(name, notation string) (noiseHandshakeType, error) {
+	if name == "" || strings.ContainsAny(name, "_+") {
+		return 0, fmt.Errorf("noise: invalid pattern name %q", name)
+	}
+	if base, modifiers := splitPatternName(name); base != name || len(modifiers) > 0 {
+		return 0, fmt.Errorf("noise: pattern name %q should only contain uppercase letters and digits", name)
+	}
+	if _, ok := findPattern(name); ok {
+		return 0, fmt.Errorf("noise: pattern %s already exists", name)
+	}
+	hp, err := parsePattern(name, notation)
+	if err != nil {
+		return 0, err
+	}
+
+	// use the next available handshake type
+	var handshakeType noiseHandshakeType
+	for existingType := range patterns {
+		if existingType >= handshakeType {
+			handshakeType = existingType
+		}
+	}
+	if handshakeType == 127 {
+		return 0, errors.New("noise: too many handshake patterns registered")
+	}
+	handshakeType++
+	patterns[handshakeType] = hp
+	return handshakeType, nil
+}
@@ -0,0 +1,131 @@
+package noise
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBuiltinPatternsAreValid(t *testing.T) {
+	for _, pattern := range patterns {
+		if err := checkPattern(pattern); err != nil {
+			t.Error(err)
+		}
+	}
+	for _, patternName := range patternsToTest {
+		if _, err := parseProtocolName("Noise_" + patternName + "_25519_ChaChaPoly_SHA256"); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestParsePattern(t *testing.T) {
+	notations := map[noiseHandshakeType]string{
+		Noise_IK: `
+			IK(s, rs):
+			  <- s
+			  ...
+			  -> e, es, s, ss
+			  <- e, ee, se`,
+		Noise_XX: "-> e\n<- e, ee, s, es\n-> s, se",
+		Noise_KK: "-> s\n<- s\n...\n-> e, es, ss\n<- e, ee, se",
+		Noise_N:  "<- s\n...\n-> e, es",
+		Noise_X1K1: `
+			<- s
+			...
+			-> e
+			<- e, ee, es
+			-> s
+			<- se`,
+	}
+	for handshakeType, notation := range notations {
+		expected := patterns[handshakeType]
+		hp, err := parsePattern(expected.name, notation)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(hp, expected) {
+			t.Fatalf("%s was parsed as %v instead of %v", expected.name, hp, expected)
+		}
+	}
+}
+
+func TestParseInvalidPatterns(t *testing.T) {
+	invalid := []struct {
+		notation string
+		reason   string
+	}{
+		{"", "has no messages"},
+		{"-> e\n-> e, ee", "should alternate"},
+		{"<- e\n-> e, ee", "should alternate"},
+		{"-> e\n<- e, ee, foo", "unknown token \"foo\""},
+		{"e, es", "should start with -> or <-"},
+		{"<- s\n-> s\n...\n-> e, es, ss", "initiator's first"},
+		{"<- e, ee\n...\n-> e", "pre-messages can only contain e and s"},
+		{"-> s\n...\n-> e\n...\n<- e, ee", "only one \"...\""},
+		// 7.3. rule 1: DH between keys that are not known yet
+		{"-> e, es\n<- e, ee", "es is performed before both keys are known"},
+		{"-> e, ee\n<- e", "ee is performed before both keys are known"},
+		// 7.3. rule 2: sending a key twice
+		{"-> e\n<- e, ee\n-> e", "initiator sends its ephemeral key more than once"},
+		{"<- s\n...\n-> e, es\n<- e, ee, s", "responder sends its static key more than once"},
+		// 7.3. rule 3: performing a DH twice
+		{"-> e\n<- e, ee, ee", "ee is performed more than once"},
+		// 7.3. rule 4: encrypting with a static key without an ephemeral DH
+		{"-> s\n...\n-> e\n<- e, ee, s, ss", "responder encrypts after ss without se"},
+		{"-> e\n<- s, es", "responder encrypts after es without ee"},
+		{"<- s\n...\n-> s, ss", "initiator encrypts after ss without es"},
+		{"-> e, s\n<- e, ee, se\n-> se", "se is performed more than once"},
+		{"-> e, s\n<- e, se", "initiator encrypts after se without ee (transport messages)"},
+		// 9.3. psk validity rule
+		{"-> e\n<- psk, s", "responder encrypts after psk without sending an ephemeral key"},
+	}
+	for _, test := range invalid {
+		_, err := parsePattern("TEST", test.notation)
+		if err == nil {
+			t.Fatalf("%q should not be a valid pattern", test.notation)
+		}
+		if !strings.Contains(err.Error(), test.reason) {
+			t.Fatalf("unexpected error for %q: %s", test.notation, err)
+		}
+	}
+
+	// modifiers are checked as well
+	if _, err := parseProtocolName("Noise_NXpsk1_25519_ChaChaPoly_SHA256"); err != nil {
+		t.Fatal("NXpsk1 should be valid:", err)
+	}
+}
+
+func TestRegisterHandshakePattern(t *testing.T) {
+	// a made up pattern: NK where the client sends its static key at the end
+	handshakeType, err := RegisterHandshakePattern("NKX", "<- s\n...\n-> e, es\n<- e, ee\n-> s, se")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer delete(patterns, handshakeType)
+	if _, err := RegisterHandshakePattern("NKX", "-> e\n<- e, ee"); err == nil {
+		t.Fatal("a pattern name should not be registered twice")
+	}
+	if _, err := RegisterHandshakePattern("NK_X", "-> e\n<- e, ee"); err == nil {
+		t.Fatal("a pattern name should not contain underscores")
+	}
+	if _, err := RegisterHandshakePattern("BAD", "-> e, ee\n<- e"); err == nil {
+		t.Fatal("an invalid pattern should not be registered")
+	}
+
+	serverKeyPair := GenerateKeypair(nil)
+	clientKeyPair := GenerateKeypair(nil)
+	testPatternOverConn(t,
+		&Config{
+			HandshakePattern:     handshakeType,
+			KeyPair:              clientKeyPair,
+			RemoteKey:            serverKeyPair.PublicKey,
+			StaticPublicKeyProof: CreateStaticPublicKeyProof(rootKey.privateKey, clientKeyPair),
+		},
+		&Config{
+			ProtocolName:      "Noise_NKX_25519_ChaChaPoly_SHA256",
+			KeyPair:           serverKeyPair,
+			PublicKeyVerifier: publicKeyVerifier,
+		},
+	)
+}
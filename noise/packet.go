@@ -0,0 +1,624 @@
+package noise
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+//
+// Datagrams
+//
+// A PacketConn runs a Noise session over a datagram transport (for example
+// UDP), where messages can be lost, duplicated or re-ordered. Each datagram
+// starts with its type:
+//
+//	handshake: 1 || index of the message in the handshake (1 byte) || handshake message
+//	transport: 2 || nonce (8 bytes, big-endian) || transport message
+//	alert:     3 || Alert, sent in clear when a handshake fails. It cannot be
+//	           authenticated, and the peer ignores it
+//	cookie:    4 || cookie, see cookie.go
+//
+// Transport messages are encrypted with the nonce they carry, instead of the
+// implicit counter of a Conn. A sliding window of the nonces received (as in
+// WireGuard, see RFC 6479) rejects replayed and too old datagrams.
+//
+// While a peer waits for the next handshake message, it sends its last one
+// again after Config.RetransmitTimeout. A peer receiving a handshake message
+// twice knows that its answer was lost, and sends it again.
+//
+
+const (
+	packetHandshake byte = iota + 1
+	packetTransport
+	packetAlert
+	packetCookie
+)
+
+// maxDatagramSize is the largest payload of a UDP datagram over IPv4
+const maxDatagramSize = 65507
+
+// maxPacketNoiseMessageLength is the largest Noise message carried by a datagram
+const maxPacketNoiseMessageLength = maxDatagramSize - 1 - 8
+
+// DefaultRetransmitTimeout is the time a PacketConn waits for the next
+// handshake message when Config.RetransmitTimeout is not set.
+const DefaultRetransmitTimeout = time.Second
+
+// maxRetransmitBackoff bounds the doubling of the retransmission timeout
+const maxRetransmitBackoff = 8
+
+// maxEarlyDatagrams is the number of transport messages kept when they arrive
+// before the last handshake message, which was lost or re-ordered
+const maxEarlyDatagrams = 16
+
+// retransmitTimeout returns the first retransmission timeout of a PacketConn
+func (config *Config) retransmitTimeout() time.Duration {
+	if config.RetransmitTimeout > 0 {
+		return config.RetransmitTimeout
+	}
+	return DefaultRetransmitTimeout
+}
+
+// A PacketConn is a Noise session with a single peer over a net.PacketConn.
+// It implements net.Conn: each Write sends a single datagram, and each Read
+// returns a single datagram. As with UDP, datagrams can be lost or arrive
+// out of order, but a datagram is never returned twice.
+type PacketConn struct {
+	conn     net.PacketConn
+	raddr    net.Addr
+	config   *Config
+	isClient bool
+
+	// the handshake is run by a Conn without a socket, which then keeps the
+	// cipher states and the results of the handshake
+	hs             *Conn
+	handshakeErr   error
+	handshakeMutex sync.Mutex
+
+	// the last handshake datagrams sent and received, to answer the
+	// retransmissions of the peer
+	lastSent, lastReceived []byte
+
+	// read deadline of the application, the handshake sets its own
+	deadlineLock sync.Mutex
+	readDeadline time.Time
+
+	// transport messages received before the end of the handshake
+	early [][]byte
+
+	inLock, outLock sync.Mutex
+	readBuffer      []byte
+	replay          replayWindow
+
+	// cookies of a server, see cookie.go
+	cookies cookieJar
+}
+
+// PacketClient returns a new Noise client side PacketConn, sending its
+// datagrams to raddr over conn.
+func PacketClient(conn net.PacketConn, raddr net.Addr, config *Config) *PacketConn {
+	return &PacketConn{conn: conn, raddr: raddr, config: config, isClient: true}
+}
+
+// PacketServer returns a new Noise server side PacketConn. Its peer is the
+// sender of the first handshake message: datagrams coming from other
+// addresses are then ignored.
+func PacketServer(conn net.PacketConn, config *Config) *PacketConn {
+	return &PacketConn{conn: conn, config: config}
+}
+
+// DialPacket sends datagrams to the given network address ("udp", "udp4" or
+// "udp6" network) from a new local socket, and runs the Noise handshake.
+// The configuration config must be non-nil.
+func DialPacket(network, addr string, config *Config) (*PacketConn, error) {
+	if err := checkPacketRequirements(true, config); err != nil {
+		return nil, err
+	}
+	raddr, err := net.ResolveUDPAddr(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenPacket(network, ":0")
+	if err != nil {
+		return nil, err
+	}
+	p := PacketClient(conn, raddr, config)
+	if err = p.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// checkPacketRequirements checks a configuration for a PacketConn
+func checkPacketRequirements(isClient bool, config *Config) error {
+	if err := checkRequirements(isClient, config); err != nil {
+		return err
+	}
+	if config.NoisePipes || config.NoiseSocket {
+		return configError("noise: NoisePipes and NoiseSocket are not available over datagrams")
+	}
+	return nil
+}
+
+// LocalAddr returns the local network address.
+func (p *PacketConn) LocalAddr() net.Addr {
+	return p.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote network address. For a server, it is nil
+// until the first handshake message has been received.
+func (p *PacketConn) RemoteAddr() net.Addr {
+	return p.raddr
+}
+
+// SetDeadline sets the read and write deadlines of the underlying connection.
+func (p *PacketConn) SetDeadline(t time.Time) error {
+	p.deadlineLock.Lock()
+	p.readDeadline = t
+	p.deadlineLock.Unlock()
+	return p.conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the underlying connection.
+func (p *PacketConn) SetReadDeadline(t time.Time) error {
+	p.deadlineLock.Lock()
+	p.readDeadline = t
+	p.deadlineLock.Unlock()
+	return p.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline of the underlying connection.
+func (p *PacketConn) SetWriteDeadline(t time.Time) error {
+	return p.conn.SetWriteDeadline(t)
+}
+
+// Close closes the underlying connection.
+func (p *PacketConn) Close() error {
+	return p.conn.Close()
+}
+
+// MaxMessageSize returns the largest data a single Write can send.
+func (p *PacketConn) MaxMessageSize() int {
+	if p.config.Padding != nil {
+		return maxPacketNoiseMessageLength - NoiseTagLength - 2 // 2-byte body length
+	}
+	return maxPacketNoiseMessageLength - NoiseTagLength
+}
+
+// Write sends b in a single datagram. It returns ErrMessageTooLarge if b is
+// larger than MaxMessageSize().
+func (p *PacketConn) Write(b []byte) (int, error) {
+	if len(b) > p.MaxMessageSize() {
+		return 0, ErrMessageTooLarge
+	}
+
+	// Make sure to go through the handshake first
+	if err := p.Handshake(); err != nil {
+		return 0, err
+	}
+	if !p.hs.canWrite() {
+		return 0, oneWayError("noise: a server cannot write on one-way patterns")
+	}
+
+	p.outLock.Lock()
+	defer p.outLock.Unlock()
+
+	out := p.hs.out
+	if out.n >= maxDataNonce {
+		return 0, errNonceExhausted
+	}
+	plaintext := b
+	if p.hs.paddedBodies() {
+		var err error
+		if plaintext, err = encodeNoiseSocketBody(b, p.hs.paddingLength(len(b), maxPacketNoiseMessageLength)); err != nil {
+			return 0, err
+		}
+	}
+	datagram := make([]byte, 9, 9+len(plaintext)+NoiseTagLength)
+	datagram[0] = packetTransport
+	binary.BigEndian.PutUint64(datagram[1:], out.n)
+	ciphertext, err := out.encryptWithAd(nil, plaintext)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = p.conn.WriteTo(append(datagram, ciphertext...), p.raddr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Read reads the data of the next datagram into b. Datagrams that cannot be
+// authenticated, or that were already received, are ignored. If b is too
+// small for the data, it is truncated and io.ErrShortBuffer is returned.
+func (p *PacketConn) Read(b []byte) (int, error) {
+	// Make sure to go through the handshake first
+	if err := p.Handshake(); err != nil {
+		return 0, err
+	}
+	if !p.hs.canRead() {
+		return 0, oneWayError("noise: a client cannot read on one-way patterns")
+	}
+
+	p.inLock.Lock()
+	defer p.inLock.Unlock()
+
+	if p.readBuffer == nil {
+		p.readBuffer = make([]byte, maxDatagramSize)
+	}
+	for len(p.early) > 0 {
+		datagram := p.early[0]
+		p.early = p.early[1:]
+		if data, ok := p.openDatagram(datagram, p.raddr); ok {
+			n := copy(b, data)
+			if n < len(data) {
+				return n, io.ErrShortBuffer
+			}
+			return n, nil
+		}
+	}
+	for {
+		n, addr, err := p.conn.ReadFrom(p.readBuffer)
+		if err != nil {
+			return 0, err
+		}
+		if data, ok := p.openDatagram(p.readBuffer[:n], addr); ok {
+			n = copy(b, data)
+			if n < len(data) {
+				return n, io.ErrShortBuffer
+			}
+			return n, nil
+		}
+	}
+}
+
+// openDatagram returns the data of a transport message received after the
+// handshake, or false if the datagram must be ignored
+func (p *PacketConn) openDatagram(datagram []byte, addr net.Addr) ([]byte, bool) {
+	if !sameAddr(addr, p.raddr) || len(datagram) == 0 {
+		return nil, false
+	}
+	switch datagram[0] {
+	case packetHandshake:
+		// the peer did not receive the last handshake message
+		if p.lastSent != nil && bytes.Equal(datagram, p.lastReceived) {
+			p.conn.WriteTo(p.lastSent, p.raddr)
+		}
+		return nil, false
+	case packetTransport:
+		if len(datagram) < 9+NoiseTagLength {
+			return nil, false
+		}
+		nonce := binary.BigEndian.Uint64(datagram[1:9])
+		if nonce > maxDataNonce || !p.replay.check(nonce) {
+			return nil, false
+		}
+		in := p.hs.in
+		in.n = nonce
+		plaintext, err := in.decryptWithAd(nil, datagram[9:])
+		if err != nil {
+			return nil, false
+		}
+		p.replay.accept(nonce)
+		if p.hs.paddedBodies() {
+			if plaintext, err = decodeNoiseSocketBody(plaintext); err != nil {
+				return nil, false
+			}
+		}
+		return plaintext, true
+	}
+	return nil, false
+}
+
+// sameAddr returns true if the two addresses are the same
+func sameAddr(a, b net.Addr) bool {
+	return a != nil && b != nil && a.Network() == b.Network() && a.String() == b.String()
+}
+
+//
+// Handshake
+//
+
+// Handshake runs the handshake if it has not yet been run. Most uses of
+// this package need not call Handshake explicitly: the first Read or Write
+// will call it automatically.
+func (p *PacketConn) Handshake() error {
+	return p.HandshakeContext(context.Background())
+}
+
+// HandshakeContext runs the handshake like Handshake, but gives up when ctx
+// is done: the handshake then fails with ctx.Err(), and the underlying
+// connection stays open. Config.HandshakeTimeout also applies.
+func (p *PacketConn) HandshakeContext(ctx context.Context) error {
+	if timeout := p.config.handshakeTimeout(p.isClient); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	// interrupt the handshake by waking its read up
+	stop := watchContext(ctx, readInterrupter{p.conn})
+	err := p.handshake(ctx)
+	stop()
+	return err
+}
+
+// readInterrupter wakes up the reads of a connection when it is closed,
+// without closing the connection
+type readInterrupter struct {
+	conn net.PacketConn
+}
+
+func (r readInterrupter) Close() error {
+	return r.conn.SetReadDeadline(time.Unix(1, 0))
+}
+
+// handshake runs the handshake if it has not yet been run
+func (p *PacketConn) handshake(ctx context.Context) error {
+	p.handshakeMutex.Lock()
+	defer p.handshakeMutex.Unlock()
+
+	if p.hs != nil && p.hs.handshakeComplete {
+		return nil
+	}
+	if p.handshakeErr != nil {
+		return p.handshakeErr
+	}
+
+	err := p.runHandshake(ctx)
+
+	// restore the read deadline of the application
+	p.deadlineLock.Lock()
+	p.conn.SetReadDeadline(p.readDeadline)
+	p.deadlineLock.Unlock()
+
+	if err != nil {
+		// tell the peer why the handshake failed
+		if p.hs != nil && p.hs.handshakeAlert != 0 && p.raddr != nil {
+			p.conn.WriteTo([]byte{packetAlert, byte(p.hs.handshakeAlert)}, p.raddr)
+		}
+		p.handshakeErr = err
+	}
+	return err
+}
+
+// newHandshake sets a new handshake up
+func (p *PacketConn) newHandshake() error {
+	protocol, err := p.config.protocol()
+	if err != nil {
+		return err
+	}
+	keyPair, remoteKeyPair, err := p.config.keyPairs(protocol.dh)
+	if err != nil {
+		return err
+	}
+	p.hs = &Conn{config: p.config, isClient: p.isClient, datagram: true}
+	return p.hs.initializeHandshake(protocol, p.isClient, p.config.Prologue, keyPair, nil, remoteKeyPair, nil)
+}
+
+// runHandshake writes and reads the handshake messages until the handshake
+// is complete or ctx is done, retransmitting them when needed
+func (p *PacketConn) runHandshake(ctx context.Context) error {
+	if err := checkPacketRequirements(p.isClient, p.config); err != nil {
+		return err
+	}
+	if err := p.newHandshake(); err != nil {
+		return err
+	}
+
+	buf := make([]byte, maxDatagramSize)
+	timeout := p.config.retransmitTimeout()
+	var c1, c2 *cipherState
+	for c1 == nil {
+		if p.hs.hs.shouldWrite {
+			index := p.hs.handshakeMessages
+			noiseMessage, cs1, cs2, err := p.hs.nextHandshakeMessage()
+			if err != nil {
+				return err
+			}
+			c1, c2 = cs1, cs2
+			if index == 0 && p.config.Cookies {
+				p.lastSent = cookieDatagram(nil, noiseMessage)
+			} else {
+				p.lastSent = append([]byte{packetHandshake, byte(index)}, noiseMessage...)
+			}
+			if _, err = p.conn.WriteTo(p.lastSent, p.raddr); err != nil {
+				return err
+			}
+			timeout = p.config.retransmitTimeout()
+			continue
+		}
+
+		// wait for the next handshake message. Once ctx is done, the
+		// deadline is set in the past: it must be checked after ours is set
+		p.conn.SetReadDeadline(p.handshakeDeadline(timeout))
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, addr, err := p.conn.ReadFrom(buf)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err != nil {
+			if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() || p.pastReadDeadline() {
+				return err
+			}
+			// nothing arrived in time: send the last message again
+			if p.lastSent != nil {
+				if _, err = p.conn.WriteTo(p.lastSent, p.raddr); err != nil {
+					return err
+				}
+			}
+			if timeout < maxRetransmitBackoff*p.config.retransmitTimeout() {
+				timeout *= 2
+			}
+			continue
+		}
+		datagram := buf[:n]
+		if len(datagram) < 2 || (p.raddr != nil && !sameAddr(addr, p.raddr)) {
+			continue
+		}
+
+		switch datagram[0] {
+		case packetAlert:
+			// alerts are sent in clear during the handshake: anyone could
+			// spoof them, so the handshake goes on until its timeout
+		case packetHandshake:
+			// the peer did not receive our last message
+			if p.lastReceived != nil && bytes.Equal(datagram, p.lastReceived) {
+				if _, err = p.conn.WriteTo(p.lastSent, p.raddr); err != nil {
+					return err
+				}
+				continue
+			}
+			if int(datagram[1]) != p.hs.handshakeMessages {
+				continue
+			}
+			message := datagram[2:]
+			if p.raddr == nil && p.config.Cookies {
+				var ok bool
+				if message, ok = p.checkCookie(message, addr); !ok {
+					continue
+				}
+			}
+			if c1, c2, err = p.hs.readHandshakeMessage(message); err != nil {
+				// a server ignores the invalid first messages, which
+				// anyone can send
+				if p.raddr == nil {
+					if err = p.newHandshake(); err != nil {
+						return err
+					}
+					continue
+				}
+				return err
+			}
+			p.lastReceived = append([]byte{}, datagram...)
+			if p.raddr == nil {
+				p.raddr = addr
+			}
+		case packetCookie:
+			// the server wants a cookie with our first message, which
+			// is sent again right away
+			if p.isClient && p.config.Cookies && p.hs.handshakeMessages == 1 && len(datagram) == 1+cookieSize {
+				p.lastSent = cookieDatagram(datagram[1:], p.lastSent[3+int(p.lastSent[2]):])
+				if _, err = p.conn.WriteTo(p.lastSent, p.raddr); err != nil {
+					return err
+				}
+				timeout = p.config.retransmitTimeout()
+			}
+		case packetTransport:
+			// the peer completed the handshake, but our last handshake
+			// message has not arrived yet
+			if p.raddr != nil && len(p.early) < maxEarlyDatagrams {
+				p.early = append(p.early, append([]byte{}, datagram...))
+			}
+		}
+	}
+
+	// the last message is only sent again if it was ours
+	if p.hs.hs.shouldWrite {
+		p.lastSent = nil
+	}
+	p.hs.completeHandshake(c1, c2)
+	return nil
+}
+
+// handshakeDeadline returns the read deadline of the next handshake message
+func (p *PacketConn) handshakeDeadline(timeout time.Duration) time.Time {
+	deadline := time.Now().Add(timeout)
+	p.deadlineLock.Lock()
+	defer p.deadlineLock.Unlock()
+	if !p.readDeadline.IsZero() && p.readDeadline.Before(deadline) {
+		return p.readDeadline
+	}
+	return deadline
+}
+
+// pastReadDeadline returns true if the read deadline of the application has passed
+func (p *PacketConn) pastReadDeadline() bool {
+	p.deadlineLock.Lock()
+	defer p.deadlineLock.Unlock()
+	return !p.readDeadline.IsZero() && !time.Now().Before(p.readDeadline)
+}
+
+// session returns the Conn that ran the handshake
+func (p *PacketConn) session() *Conn {
+	p.handshakeMutex.Lock()
+	defer p.handshakeMutex.Unlock()
+	if p.hs == nil {
+		return &Conn{config: p.config}
+	}
+	return p.hs
+}
+
+// HandshakeHash returns the hash of the whole handshake, see Conn.HandshakeHash().
+func (p *PacketConn) HandshakeHash() ([]byte, error) {
+	return p.session().HandshakeHash()
+}
+
+// ExportKeyingMaterial derives keying material from the session, see
+// Conn.ExportKeyingMaterial().
+func (p *PacketConn) ExportKeyingMaterial(label, context []byte, length int) ([]byte, error) {
+	return p.session().ExportKeyingMaterial(label, context, length)
+}
+
+// StaticKey returns the static key of the remote peer.
+func (p *PacketConn) StaticKey() ([]byte, error) {
+	return p.session().StaticKey()
+}
+
+//
+// Replay window
+//
+
+// replayBlocks is the number of 64-bit blocks of the replay window: the
+// window covers the replayWindowSize last nonces, and one more block is
+// needed as the window slides over the blocks
+const (
+	replayBlocks     = 17
+	replayWindowSize = (replayBlocks - 1) * 64
+)
+
+// replayWindow remembers which of the last nonces were received
+type replayWindow struct {
+	next   uint64 // one more than the largest nonce received
+	bitmap [replayBlocks]uint64
+}
+
+// check returns true if the nonce was not received yet and is not too old
+func (w *replayWindow) check(n uint64) bool {
+	if n >= w.next {
+		return true
+	}
+	if w.next > replayWindowSize && n < w.next-replayWindowSize {
+		return false
+	}
+	return w.bitmap[(n/64)%replayBlocks]&(1<<(n%64)) == 0
+}
+
+// accept marks the nonce as received, check must have returned true
+func (w *replayWindow) accept(n uint64) {
+	if n >= w.next {
+		// clear the blocks the window slides over
+		var from uint64
+		if w.next > 0 {
+			from = (w.next-1)/64 + 1
+		}
+		if to := n / 64; to >= from {
+			count := to - from + 1
+			if count > replayBlocks {
+				count = replayBlocks
+			}
+			for i := uint64(0); i < count; i++ {
+				w.bitmap[(from+i)%replayBlocks] = 0
+			}
+		}
+		w.next = n + 1
+	}
+	w.bitmap[(n/64)%replayBlocks] |= 1 << (n % 64)
+}
@@ -0,0 +1,211 @@
+package noise
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lossyPacketConn drops the datagrams written at the given positions
+// (starting at 1), and records the others
+type lossyPacketConn struct {
+	net.PacketConn
+	drop map[int]bool
+
+	sync.Mutex
+	writes  int
+	written [][]byte
+}
+
+func (l *lossyPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	l.Lock()
+	l.writes++
+	dropped := l.drop[l.writes]
+	if !dropped {
+		l.written = append(l.written, append([]byte{}, b...))
+	}
+	l.Unlock()
+	if dropped {
+		return len(b), nil
+	}
+	return l.PacketConn.WriteTo(b, addr)
+}
+
+// newPacketPair returns a client and a server using Noise_XX over UDP, which
+// drop the given datagrams
+func newPacketPair(t *testing.T, clientDrops, serverDrops map[int]bool) (client, server *PacketConn, clientConn *lossyPacketConn) {
+	listen := func(drop map[int]bool) *lossyPacketConn {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal("cannot listen on localhost:", err)
+		}
+		return &lossyPacketConn{PacketConn: conn, drop: drop}
+	}
+	config := func() *Config {
+		return &Config{
+			HandshakePattern:     Noise_XX,
+			KeyPair:              GenerateKeypair(nil),
+			StaticPublicKeyProof: []byte{},
+			PublicKeyVerifier:    verifier,
+			RetransmitTimeout:    20 * time.Millisecond,
+		}
+	}
+	clientConn = listen(clientDrops)
+	serverConn := listen(serverDrops)
+	client = PacketClient(clientConn, serverConn.LocalAddr(), config())
+	server = PacketServer(serverConn, config())
+	return
+}
+
+// exchange runs the handshake and sends a datagram in each direction
+func exchange(t *testing.T, client, server *PacketConn) {
+	serverErr := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 100)
+		n, err := server.Read(buf)
+		if err == nil {
+			_, err = server.Write(buf[:n])
+		}
+		serverErr <- err
+	}()
+
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatal("client can't write:", err)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 100)
+	n, err := client.Read(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Fatal("the server should have echoed the datagram, got", err)
+	}
+	if err = <-serverErr; err != nil {
+		t.Fatal("server failed:", err)
+	}
+}
+
+func TestPacketConn(t *testing.T) {
+	client, server, _ := newPacketPair(t, nil, nil)
+	defer client.Close()
+	defer server.Close()
+	exchange(t, client, server)
+
+	if !sameAddr(server.RemoteAddr(), client.LocalAddr()) {
+		t.Fatal("the server should be bound to the client's address, not", server.RemoteAddr())
+	}
+	clientHash, _ := client.HandshakeHash()
+	serverHash, err := server.HandshakeHash()
+	if err != nil || !bytes.Equal(clientHash, serverHash) {
+		t.Fatal("the peers should share the same handshake hash")
+	}
+}
+
+func TestPacketRetransmission(t *testing.T) {
+	// the first message of the client, the answer of the server and the
+	// last message of the client are each lost once
+	client, server, _ := newPacketPair(t, map[int]bool{1: true, 3: true}, map[int]bool{1: true})
+	defer client.Close()
+	defer server.Close()
+	exchange(t, client, server)
+}
+
+func TestPacketSpoofedAlert(t *testing.T) {
+	client, server, _ := newPacketPair(t, nil, nil)
+	defer client.Close()
+	defer server.Close()
+
+	// an alert in clear from the address of the server, before it answers
+	server.conn.(*lossyPacketConn).PacketConn.WriteTo([]byte{packetAlert, byte(AlertBadPublicKey)}, client.LocalAddr())
+	time.Sleep(20 * time.Millisecond)
+	exchange(t, client, server)
+}
+
+func TestPacketHandshakeContext(t *testing.T) {
+	client, server, clientConn := newPacketPair(t, nil, nil)
+	defer client.Close()
+	defer server.Close()
+
+	// nobody answers the client
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if err := client.HandshakeContext(ctx); err != context.Canceled {
+		t.Fatal("the handshake should have been cancelled, got", err)
+	}
+	if err := client.Handshake(); err != context.Canceled {
+		t.Fatal("the handshake should keep its error, got", err)
+	}
+	// the underlying connection is still open
+	if _, err := clientConn.WriteTo([]byte("hello"), server.LocalAddr()); err != nil {
+		t.Fatal("the underlying connection should not have been closed:", err)
+	}
+}
+
+func TestPacketReplay(t *testing.T) {
+	client, server, clientConn := newPacketPair(t, nil, nil)
+	defer client.Close()
+	defer server.Close()
+	exchange(t, client, server)
+
+	// the transport message of the client is replayed, then a new one is sent
+	clientConn.Lock()
+	replayed := clientConn.written[len(clientConn.written)-1]
+	clientConn.Unlock()
+	if _, err := clientConn.PacketConn.WriteTo(replayed, server.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Write([]byte("second")); err != nil {
+		t.Fatal("client can't write:", err)
+	}
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 100)
+	n, err := server.Read(buf)
+	if err != nil || string(buf[:n]) != "second" {
+		t.Fatalf("the server should have ignored the replayed datagram, got %q (%v)", buf[:n], err)
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	var w replayWindow
+	receive := func(n uint64) bool {
+		if !w.check(n) {
+			return false
+		}
+		w.accept(n)
+		return true
+	}
+	for _, n := range []uint64{0, 2, 1, 5, 100} {
+		if !receive(n) {
+			t.Fatal("the nonce should have been accepted:", n)
+		}
+	}
+	for _, n := range []uint64{0, 1, 2, 5, 100} {
+		if receive(n) {
+			t.Fatal("the replayed nonce should have been rejected:", n)
+		}
+	}
+	if !receive(3) {
+		t.Fatal("a late nonce inside the window should be accepted")
+	}
+
+	// slide the window far away
+	if !receive(100 + replayWindowSize) {
+		t.Fatal("a new nonce should be accepted")
+	}
+	if receive(99) || receive(100) {
+		t.Fatal("the nonces out of the window should be rejected")
+	}
+	if !receive(101) || receive(101) {
+		t.Fatal("the oldest nonce of the window should be accepted once")
+	}
+	if !receive(1<<40) || !receive(1<<40-replayWindowSize+1) || receive(1<<40-replayWindowSize) {
+		t.Fatal("unexpected window after a large jump")
+	}
+}
+
+func TestPacketRequirements(t *testing.T) {
+	if _, err := DialPacket("udp", "127.0.0.1:1", &Config{HandshakePattern: Noise_NK, NoiseSocket: true}); err == nil {
+		t.Fatal("NoiseSocket should not be accepted over datagrams")
+	}
+}
@@ -0,0 +1,95 @@
+package noise
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+)
+
+//
+// Padding
+//
+// The length of encrypted messages leaks the length of the data they carry.
+// With a padding policy, handshake payloads and transport messages carry a
+// body that is padded before encryption, see encodeNoiseSocketBody():
+//
+//	body_len (2 bytes) || body || padding
+//
+
+// A PaddingPolicy returns the number of padding bytes to add to a body
+// encoded in length bytes (its 2-byte length included), between 0 and
+// maxPadding. Other values are truncated to these bounds.
+type PaddingPolicy func(length, maxPadding int) int
+
+// PadToBlockSize pads messages to a multiple of blockSize bytes
+func PadToBlockSize(blockSize int) PaddingPolicy {
+	return func(length, maxPadding int) int {
+		if blockSize <= 0 || length%blockSize == 0 {
+			return 0
+		}
+		return blockSize - length%blockSize
+	}
+}
+
+// PadToMaxFrame pads every message to the largest possible size. This hides
+// the length of the messages completely, at the cost of a lot of bandwidth.
+func PadToMaxFrame() PaddingPolicy {
+	return func(length, maxPadding int) int {
+		return maxPadding
+	}
+}
+
+// PadRandomly adds between min and max bytes of padding, chosen uniformly
+// at random for each message
+func PadRandomly(min, max int) PaddingPolicy {
+	return func(length, maxPadding int) int {
+		if max <= min {
+			return min
+		}
+		var buf [8]byte
+		if _, err := rand.Read(buf[:]); err != nil {
+			panic("noise: no source of randomness for the padding: " + err.Error())
+		}
+		return min + int(binary.BigEndian.Uint64(buf[:])%uint64(max-min+1))
+	}
+}
+
+// paddedBodies returns true if the messages of the connection carry a
+// padded body
+func (c *Conn) paddedBodies() bool {
+	return c.config.NoiseSocket || c.config.Padding != nil
+}
+
+// paddingLength applies the padding policy of the configuration to a body of
+// bodyLength bytes, sent in a message of at most maxLength bytes after
+// encryption
+func (c *Conn) paddingLength(bodyLength, maxLength int) int {
+	maxPadding := maxLength - NoiseTagLength - 2 - bodyLength
+	if c.config.Padding == nil || maxPadding <= 0 {
+		return 0
+	}
+	padding := c.config.Padding(2+bodyLength, maxPadding)
+	if padding < 0 {
+		return 0
+	}
+	if padding > maxPadding {
+		return maxPadding
+	}
+	return padding
+}
+
+// maxTokensLength returns an upper bound on the size of the keys written by
+// the next handshake message, before its payload
+func (h *handshakeState) maxTokensLength() (length int) {
+	if len(h.messagePatterns) == 0 {
+		return 0
+	}
+	for _, t := range h.messagePatterns[0] {
+		switch t {
+		case token_e:
+			length += h.dh.dhLen
+		case token_s:
+			length += h.dh.dhLen + NoiseTagLength
+		}
+	}
+	return
+}
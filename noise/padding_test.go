@@ -0,0 +1,100 @@
+package noise
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestPaddingPolicies(t *testing.T) {
+	block := PadToBlockSize(64)
+	for length, expected := range map[int]int{1: 63, 64: 0, 65: 63, 130: 62} {
+		if padding := block(length, 1000); padding != expected {
+			t.Fatalf("PadToBlockSize(64) pads %d bytes with %d bytes instead of %d", length, padding, expected)
+		}
+	}
+	if padding := PadToMaxFrame()(10, 500); padding != 500 {
+		t.Fatal("PadToMaxFrame() should use all the available padding, not", padding)
+	}
+	random := PadRandomly(10, 20)
+	for i := 0; i < 100; i++ {
+		if padding := random(5, 1000); padding < 10 || padding > 20 {
+			t.Fatal("PadRandomly(10, 20) returned", padding)
+		}
+	}
+}
+
+func TestPaddingLength(t *testing.T) {
+	c := Conn{config: &Config{Padding: func(length, maxPadding int) int { return 100000 }}}
+	// a transport message of 10 bytes: 2-byte length, body and tag
+	if padding := c.paddingLength(10, NoiseMessageLength); padding != NoiseMessageLength-NoiseTagLength-2-10 {
+		t.Fatal("the padding should be truncated to the maximum frame, not", padding)
+	}
+	c.config.Padding = func(length, maxPadding int) int { return -1 }
+	if padding := c.paddingLength(10, NoiseMessageLength); padding != 0 {
+		t.Fatal("negative padding should be ignored, not", padding)
+	}
+}
+
+func TestPaddedConn(t *testing.T) {
+	serverKeyPair := GenerateKeypair(nil)
+	clientConfig := Config{
+		HandshakePattern: Noise_NK,
+		RemoteKey:        serverKeyPair.PublicKey,
+		Padding:          PadToBlockSize(128),
+	}
+	serverConfig := Config{
+		HandshakePattern: Noise_NK,
+		KeyPair:          serverKeyPair,
+		Padding:          PadToMaxFrame(),
+	}
+
+	var clientFrames, serverFrames []string
+	clientPipe, serverPipe := net.Pipe()
+	client := Client(recordingConn{clientPipe, &clientFrames}, &clientConfig)
+	server := Server(recordingConn{serverPipe, &serverFrames}, &serverConfig)
+
+	// the server echoes the client's messages
+	serverDone := make(chan struct{})
+	go func() {
+		defer close(serverDone)
+		defer server.Close()
+		buf := make([]byte, 1000)
+		for {
+			n, err := server.Read(buf)
+			if err != nil {
+				return
+			}
+			if _, err = server.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+	}()
+
+	for _, message := range []string{"a", "hello", string(bytes.Repeat([]byte("x"), 300))} {
+		if _, err := client.Write([]byte(message)); err != nil {
+			t.Fatal("client can't write:", err)
+		}
+		buf := make([]byte, 1000)
+		n, err := client.Read(buf)
+		if err != nil || string(buf[:n]) != message {
+			t.Fatalf("the server should have echoed %q, not %q (%v)", message, buf[:n], err)
+		}
+	}
+	client.Close()
+	<-serverDone
+
+	// the frames of the client (hex-encoded), after the first handshake
+	// message, have padded messages of a multiple of 128 bytes
+	for i, frame := range clientFrames[1:] {
+		if (len(frame)/2-2-NoiseTagLength)%128 != 0 {
+			t.Fatalf("frame %d of the client is not padded: %d bytes", i+1, len(frame)/2)
+		}
+	}
+	// the frames of the server all have the maximum size
+	for i, frame := range serverFrames {
+		if len(frame)/2 != 2+NoiseMessageLength {
+			t.Fatalf("frame %d of the server is not padded to the maximum size: %d bytes", i, len(frame)/2)
+		}
+	}
+}
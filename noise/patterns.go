@@ -1,5 +1,11 @@
 package noise
 
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
 //
 // Handshake Patterns
 //
@@ -51,11 +57,122 @@ const (
 	Noise_IX
 	Noise_NNpsk2
 
-	// Not implemented
+	// Noise_NN is a pattern where neither the client nor the server
+	// are authenticated. It only protects against passive attackers.
 	Noise_NN
+
+	// Noise_KN is a pattern where the client static key is known
+	// to the server, while the server is not authenticated.
 	Noise_KN
+
+	// Noise_XN is a pattern where the client static key is
+	// transmitted during the handshake, while the server is not
+	// authenticated. It is the responsability of the server to
+	// validate the received key properly.
 	Noise_XN
+
+	// Noise_IN is similar to Noise_XN, except that the client
+	// static key is transmitted immediately in the first message,
+	// saving a round trip at the cost of identity hiding.
 	Noise_IN
+
+	// 7.6. Deferred patterns
+	//
+	// Deferred patterns delay the authentication of a peer to a later
+	// message, trading round trips for identity hiding and resistance to
+	// Key Compromise Impersonation (KCI).
+
+	// Noise_NK1 is a deferred variant of Noise_NK where the server
+	// only authenticates itself in the second message.
+	Noise_NK1
+
+	// Noise_NX1 is a deferred variant of Noise_NX where the server
+	// authentication is deferred to the third message.
+	Noise_NX1
+
+	// Noise_X1N is a deferred variant of Noise_XN where the client
+	// authentication is deferred to the fourth message.
+	Noise_X1N
+
+	// Noise_X1K is a deferred variant of Noise_XK where the client
+	// authentication is deferred to the fourth message.
+	Noise_X1K
+
+	// Noise_XK1 is a deferred variant of Noise_XK where the server
+	// authentication is deferred to the second message.
+	Noise_XK1
+
+	// Noise_X1K1 is a deferred variant of Noise_XK where both the
+	// client and the server authentications are deferred.
+	Noise_X1K1
+
+	// Noise_X1X is a deferred variant of Noise_XX where the client
+	// authentication is deferred to the fourth message.
+	Noise_X1X
+
+	// Noise_XX1 is a deferred variant of Noise_XX where the server
+	// authentication is deferred to the third message.
+	Noise_XX1
+
+	// Noise_X1X1 is a deferred variant of Noise_XX where both the
+	// client and the server authentications are deferred.
+	Noise_X1X1
+
+	// Noise_K1N is a deferred variant of Noise_KN where the client
+	// authentication is deferred to the third message.
+	Noise_K1N
+
+	// Noise_K1K is a deferred variant of Noise_KK where the client
+	// authentication is deferred to the third message.
+	Noise_K1K
+
+	// Noise_KK1 is a deferred variant of Noise_KK where the server
+	// authentication is deferred to the second message.
+	Noise_KK1
+
+	// Noise_K1K1 is a deferred variant of Noise_KK where both the
+	// client and the server authentications are deferred.
+	Noise_K1K1
+
+	// Noise_K1X is a deferred variant of Noise_KX where the client
+	// authentication is deferred to the third message.
+	Noise_K1X
+
+	// Noise_KX1 is a deferred variant of Noise_KX where the server
+	// authentication is deferred to the third message.
+	Noise_KX1
+
+	// Noise_K1X1 is a deferred variant of Noise_KX where both the
+	// client and the server authentications are deferred.
+	Noise_K1X1
+
+	// Noise_I1N is a deferred variant of Noise_IN where the client
+	// authentication is deferred to the third message.
+	Noise_I1N
+
+	// Noise_I1K is a deferred variant of Noise_IK where the client
+	// authentication is deferred to the third message.
+	Noise_I1K
+
+	// Noise_IK1 is a deferred variant of Noise_IK where the server
+	// authentication is deferred to the second message.
+	Noise_IK1
+
+	// Noise_I1K1 is a deferred variant of Noise_IK where both the
+	// client and the server authentications are deferred.
+	Noise_I1K1
+
+	// Noise_I1X is a deferred variant of Noise_IX where the client
+	// authentication is deferred to the third message.
+	Noise_I1X
+
+	// Noise_IX1 is a deferred variant of Noise_IX where the server
+	// authentication is deferred to the third message.
+	Noise_IX1
+
+	// Noise_I1X1 is a deferred variant of Noise_IX where both the
+	// client and the server authentications are deferred.
+	Noise_I1X1
 )
 
 type token uint8
@@ -72,12 +189,48 @@ const (
 
 type messagePattern []token
 
+// contains returns true if the message pattern includes the token t
+func (mp messagePattern) contains(t token) bool {
+	for _, token := range mp {
+		if token == t {
+			return true
+		}
+	}
+	return false
+}
+
 type handshakePattern struct {
 	name               string
 	preMessagePatterns []messagePattern
 	messagePatterns    []messagePattern
 }
 
+// isOneWay returns true if the pattern only allows the initiator to send
+// data to the responder (for example Noise_N, Noise_K or Noise_X)
+func (hp handshakePattern) isOneWay() bool {
+	return len(hp.messagePatterns) == 1
+}
+
+// hasEphemeralPreMessage returns true if one of the peers must know the
+// ephemeral key of the other before the handshake (for example the
+// fallback patterns)
+func (hp handshakePattern) hasEphemeralPreMessage() bool {
+	return hp.preMessagePatterns[0].contains(token_e) || hp.preMessagePatterns[1].contains(token_e)
+}
+
+// transmitsStatic returns true if the initiator (or the responder if
+// initiator is false) sends its static public key as part of a message
+// of the handshake. The receiver of the key then needs a way to verify it.
+func (hp handshakePattern) transmitsStatic(initiator bool) bool {
+	for idx, pattern := range hp.messagePatterns {
+		// initiator's messages are the even ones
+		if (idx%2 == 0) == initiator && pattern.contains(token_s) {
+			return true
+		}
+	}
+	return false
+}
+
 // TODO: add more patterns
 var patterns = map[noiseHandshakeType]handshakePattern{
 
@@ -253,19 +406,673 @@ var patterns = map[noiseHandshakeType]handshakePattern{
 	},
 
 	/*
-		NNpsk2():
+		NN():
+		  -> e
+		  <- e, ee
+	*/
+	Noise_NN: handshakePattern{
+		name: "NN",
+		preMessagePatterns: []messagePattern{
+			messagePattern{}, // →
+			messagePattern{}, // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e},           // →
+			messagePattern{token_e, token_ee}, // ←
+		},
+	},
+
+	/*
+		KN(s, rs):
+		  -> s
+		  ...
+		  -> e
+		  <- e, ee, se
+	*/
+	Noise_KN: handshakePattern{
+		name: "KN",
+		preMessagePatterns: []messagePattern{
+			messagePattern{token_s}, // →
+			messagePattern{},        // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e},                     // →
+			messagePattern{token_e, token_ee, token_se}, // ←
+		},
+	},
+
+	/*
+		XN(s, rs):
+		  -> e
+		  <- e, ee
+		  -> s, se
+	*/
+	Noise_XN: handshakePattern{
+		name: "XN",
+		preMessagePatterns: []messagePattern{
+			messagePattern{}, // →
+			messagePattern{}, // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e},           // →
+			messagePattern{token_e, token_ee}, // ←
+			messagePattern{token_s, token_se}, // →
+		},
+	},
+
+	/*
+		IN(s, rs):
+		  -> e, s
+		  <- e, ee, se
+	*/
+	Noise_IN: handshakePattern{
+		name: "IN",
+		preMessagePatterns: []messagePattern{
+			messagePattern{}, // →
+			messagePattern{}, // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e, token_s},            // →
+			messagePattern{token_e, token_ee, token_se}, // ←
+		},
+	},
+
+	//
+	// 7.6. Deferred patterns
+	//
+
+	/*
+		NK1:
+		  <- s
+		  ...
+		  -> e
+		  <- e, ee, es
+	*/
+	Noise_NK1: handshakePattern{
+		name: "NK1",
+		preMessagePatterns: []messagePattern{
+			messagePattern{},        // →
+			messagePattern{token_s}, // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e},                     // →
+			messagePattern{token_e, token_ee, token_es}, // ←
+		},
+	},
+
+	/*
+		NX1:
+		  -> e
+		  <- e, ee, s
+		  -> es
+	*/
+	Noise_NX1: handshakePattern{
+		name: "NX1",
+		preMessagePatterns: []messagePattern{
+			messagePattern{}, // →
+			messagePattern{}, // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e},                    // →
+			messagePattern{token_e, token_ee, token_s}, // ←
+			messagePattern{token_es},                   // →
+		},
+	},
+
+	/*
+		X1N:
+		  -> e
+		  <- e, ee
+		  -> s
+		  <- se
+	*/
+	Noise_X1N: handshakePattern{
+		name: "X1N",
+		preMessagePatterns: []messagePattern{
+			messagePattern{}, // →
+			messagePattern{}, // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e},           // →
+			messagePattern{token_e, token_ee}, // ←
+			messagePattern{token_s},           // →
+			messagePattern{token_se},          // ←
+		},
+	},
+
+	/*
+		X1K:
+		  <- s
+		  ...
+		  -> e, es
+		  <- e, ee
+		  -> s
+		  <- se
+	*/
+	Noise_X1K: handshakePattern{
+		name: "X1K",
+		preMessagePatterns: []messagePattern{
+			messagePattern{},        // →
+			messagePattern{token_s}, // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e, token_es}, // →
+			messagePattern{token_e, token_ee}, // ←
+			messagePattern{token_s},           // →
+			messagePattern{token_se},          // ←
+		},
+	},
+
+	/*
+		XK1:
+		  <- s
+		  ...
+		  -> e
+		  <- e, ee, es
+		  -> s, se
+	*/
+	Noise_XK1: handshakePattern{
+		name: "XK1",
+		preMessagePatterns: []messagePattern{
+			messagePattern{},        // →
+			messagePattern{token_s}, // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e},                     // →
+			messagePattern{token_e, token_ee, token_es}, // ←
+			messagePattern{token_s, token_se},           // →
+		},
+	},
+
+	/*
+		X1K1:
+		  <- s
+		  ...
+		  -> e
+		  <- e, ee, es
+		  -> s
+		  <- se
+	*/
+	Noise_X1K1: handshakePattern{
+		name: "X1K1",
+		preMessagePatterns: []messagePattern{
+			messagePattern{},        // →
+			messagePattern{token_s}, // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e},                     // →
+			messagePattern{token_e, token_ee, token_es}, // ←
+			messagePattern{token_s},                     // →
+			messagePattern{token_se},                    // ←
+		},
+	},
+
+	/*
+		X1X:
+		  -> e
+		  <- e, ee, s, es
+		  -> s
+		  <- se
+	*/
+	Noise_X1X: handshakePattern{
+		name: "X1X",
+		preMessagePatterns: []messagePattern{
+			messagePattern{}, // →
+			messagePattern{}, // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e},                              // →
+			messagePattern{token_e, token_ee, token_s, token_es}, // ←
+			messagePattern{token_s},                              // →
+			messagePattern{token_se},                             // ←
+		},
+	},
+
+	/*
+		XX1:
+		  -> e
+		  <- e, ee, s
+		  -> es, s, se
+	*/
+	Noise_XX1: handshakePattern{
+		name: "XX1",
+		preMessagePatterns: []messagePattern{
+			messagePattern{}, // →
+			messagePattern{}, // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e},                     // →
+			messagePattern{token_e, token_ee, token_s},  // ←
+			messagePattern{token_es, token_s, token_se}, // →
+		},
+	},
+
+	/*
+		X1X1:
 		  -> e
-		  <- e, ee, psk
+		  <- e, ee, s
+		  -> es, s
+		  <- se
 	*/
-	Noise_NNpsk2: handshakePattern{
-		name: "NNpsk2",
+	Noise_X1X1: handshakePattern{
+		name: "X1X1",
 		preMessagePatterns: []messagePattern{
 			messagePattern{}, // →
 			messagePattern{}, // ←
 		},
 		messagePatterns: []messagePattern{
-			messagePattern{token_e},                      // →
-			messagePattern{token_e, token_ee, token_psk}, // ←
+			messagePattern{token_e},                    // →
+			messagePattern{token_e, token_ee, token_s}, // ←
+			messagePattern{token_es, token_s},          // →
+			messagePattern{token_se},                   // ←
 		},
 	},
+
+	/*
+		K1N:
+		  -> s
+		  ...
+		  -> e
+		  <- e, ee
+		  -> se
+	*/
+	Noise_K1N: handshakePattern{
+		name: "K1N",
+		preMessagePatterns: []messagePattern{
+			messagePattern{token_s}, // →
+			messagePattern{},        // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e},           // →
+			messagePattern{token_e, token_ee}, // ←
+			messagePattern{token_se},          // →
+		},
+	},
+
+	/*
+		K1K:
+		  -> s
+		  <- s
+		  ...
+		  -> e, es
+		  <- e, ee
+		  -> se
+	*/
+	Noise_K1K: handshakePattern{
+		name: "K1K",
+		preMessagePatterns: []messagePattern{
+			messagePattern{token_s}, // →
+			messagePattern{token_s}, // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e, token_es}, // →
+			messagePattern{token_e, token_ee}, // ←
+			messagePattern{token_se},          // →
+		},
+	},
+
+	/*
+		KK1:
+		  -> s
+		  <- s
+		  ...
+		  -> e
+		  <- e, ee, se, es
+	*/
+	Noise_KK1: handshakePattern{
+		name: "KK1",
+		preMessagePatterns: []messagePattern{
+			messagePattern{token_s}, // →
+			messagePattern{token_s}, // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e},                               // →
+			messagePattern{token_e, token_ee, token_se, token_es}, // ←
+		},
+	},
+
+	/*
+		K1K1:
+		  -> s
+		  <- s
+		  ...
+		  -> e
+		  <- e, ee, es
+		  -> se
+	*/
+	Noise_K1K1: handshakePattern{
+		name: "K1K1",
+		preMessagePatterns: []messagePattern{
+			messagePattern{token_s}, // →
+			messagePattern{token_s}, // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e},                     // →
+			messagePattern{token_e, token_ee, token_es}, // ←
+			messagePattern{token_se},                    // →
+		},
+	},
+
+	/*
+		K1X:
+		  -> s
+		  ...
+		  -> e
+		  <- e, ee, s, es
+		  -> se
+	*/
+	Noise_K1X: handshakePattern{
+		name: "K1X",
+		preMessagePatterns: []messagePattern{
+			messagePattern{token_s}, // →
+			messagePattern{},        // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e},                              // →
+			messagePattern{token_e, token_ee, token_s, token_es}, // ←
+			messagePattern{token_se},                             // →
+		},
+	},
+
+	/*
+		KX1:
+		  -> s
+		  ...
+		  -> e
+		  <- e, ee, se, s
+		  -> es
+	*/
+	Noise_KX1: handshakePattern{
+		name: "KX1",
+		preMessagePatterns: []messagePattern{
+			messagePattern{token_s}, // →
+			messagePattern{},        // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e},                              // →
+			messagePattern{token_e, token_ee, token_se, token_s}, // ←
+			messagePattern{token_es},                             // →
+		},
+	},
+
+	/*
+		K1X1:
+		  -> s
+		  ...
+		  -> e
+		  <- e, ee, s
+		  -> se, es
+	*/
+	Noise_K1X1: handshakePattern{
+		name: "K1X1",
+		preMessagePatterns: []messagePattern{
+			messagePattern{token_s}, // →
+			messagePattern{},        // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e},                    // →
+			messagePattern{token_e, token_ee, token_s}, // ←
+			messagePattern{token_se, token_es},         // →
+		},
+	},
+
+	/*
+		I1N:
+		  -> e, s
+		  <- e, ee
+		  -> se
+	*/
+	Noise_I1N: handshakePattern{
+		name: "I1N",
+		preMessagePatterns: []messagePattern{
+			messagePattern{}, // →
+			messagePattern{}, // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e, token_s},  // →
+			messagePattern{token_e, token_ee}, // ←
+			messagePattern{token_se},          // →
+		},
+	},
+
+	/*
+		I1K:
+		  <- s
+		  ...
+		  -> e, es, s
+		  <- e, ee
+		  -> se
+	*/
+	Noise_I1K: handshakePattern{
+		name: "I1K",
+		preMessagePatterns: []messagePattern{
+			messagePattern{},        // →
+			messagePattern{token_s}, // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e, token_es, token_s}, // →
+			messagePattern{token_e, token_ee},          // ←
+			messagePattern{token_se},                   // →
+		},
+	},
+
+	/*
+		IK1:
+		  <- s
+		  ...
+		  -> e, s
+		  <- e, ee, se, es
+	*/
+	Noise_IK1: handshakePattern{
+		name: "IK1",
+		preMessagePatterns: []messagePattern{
+			messagePattern{},        // →
+			messagePattern{token_s}, // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e, token_s},                      // →
+			messagePattern{token_e, token_ee, token_se, token_es}, // ←
+		},
+	},
+
+	/*
+		I1K1:
+		  <- s
+		  ...
+		  -> e, s
+		  <- e, ee, es
+		  -> se
+	*/
+	Noise_I1K1: handshakePattern{
+		name: "I1K1",
+		preMessagePatterns: []messagePattern{
+			messagePattern{},        // →
+			messagePattern{token_s}, // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e, token_s},            // →
+			messagePattern{token_e, token_ee, token_es}, // ←
+			messagePattern{token_se},                    // →
+		},
+	},
+
+	/*
+		I1X:
+		  -> e, s
+		  <- e, ee, s, es
+		  -> se
+	*/
+	Noise_I1X: handshakePattern{
+		name: "I1X",
+		preMessagePatterns: []messagePattern{
+			messagePattern{}, // →
+			messagePattern{}, // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e, token_s},                     // →
+			messagePattern{token_e, token_ee, token_s, token_es}, // ←
+			messagePattern{token_se},                             // →
+		},
+	},
+
+	/*
+		IX1:
+		  -> e, s
+		  <- e, ee, se, s
+		  -> es
+	*/
+	Noise_IX1: handshakePattern{
+		name: "IX1",
+		preMessagePatterns: []messagePattern{
+			messagePattern{}, // →
+			messagePattern{}, // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e, token_s},                     // →
+			messagePattern{token_e, token_ee, token_se, token_s}, // ←
+			messagePattern{token_es},                             // →
+		},
+	},
+
+	/*
+		I1X1:
+		  -> e, s
+		  <- e, ee, s
+		  -> se, es
+	*/
+	Noise_I1X1: handshakePattern{
+		name: "I1X1",
+		preMessagePatterns: []messagePattern{
+			messagePattern{}, // →
+			messagePattern{}, // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e, token_s},           // →
+			messagePattern{token_e, token_ee, token_s}, // ←
+			messagePattern{token_se, token_es},         // →
+		},
+	},
+}
+
+// patterns with modifiers are derived from their base pattern,
+// see applyModifiers()
+func init() {
+	nnpsk2, err := applyModifiers(patterns[Noise_NN], []string{"psk2"})
+	if err != nil {
+		panic(err)
+	}
+	patterns[Noise_NNpsk2] = nnpsk2
+}
+
+// countTokens returns the number of times the token t appears
+// in the messages of the handshake pattern
+func (hp handshakePattern) countTokens(t token) (count int) {
+	for _, pattern := range hp.messagePatterns {
+		for _, token := range pattern {
+			if token == t {
+				count++
+			}
+		}
+	}
+	return
+}
+
+//
+// 9. Pattern modifiers
+//
+
+// applyModifiers derives a new handshake pattern from a base pattern and
+// a list of modifiers, for example XX and ["psk0", "psk3"] gives XXpsk0+psk3.
+//
+// * psk0 places a "psk" token at the beginning of the first message
+// * pskN (N > 0) places a "psk" token at the end of the Nth message
+// * fallback turns the first message into a pre-message, see applyFallback()
+func applyModifiers(base handshakePattern, modifiers []string) (hp handshakePattern, err error) {
+	if len(modifiers) == 0 {
+		return base, nil
+	}
+
+	// deep copy of the base pattern so that it is left untouched
+	hp.name = base.name + strings.Join(modifiers, "+")
+	for _, pattern := range base.preMessagePatterns {
+		hp.preMessagePatterns = append(hp.preMessagePatterns, append(messagePattern{}, pattern...))
+	}
+	for _, pattern := range base.messagePatterns {
+		hp.messagePatterns = append(hp.messagePatterns, append(messagePattern{}, pattern...))
+	}
+
+	seen := make(map[string]bool)
+	for _, modifier := range modifiers {
+		if seen[modifier] {
+			return hp, fmt.Errorf("noise: modifier %q is used twice", modifier)
+		}
+		seen[modifier] = true
+
+		if modifier == "fallback" {
+			if hp, err = applyFallback(hp); err != nil {
+				return
+			}
+			continue
+		}
+
+		if !strings.HasPrefix(modifier, "psk") {
+			return hp, fmt.Errorf("noise: unknown modifier %q", modifier)
+		}
+		position, err := strconv.Atoi(modifier[len("psk"):])
+		if err != nil || position < 0 || modifier != "psk"+strconv.Itoa(position) {
+			return hp, fmt.Errorf("noise: unknown modifier %q", modifier)
+		}
+		if position > len(hp.messagePatterns) {
+			return hp, fmt.Errorf("noise: modifier %q does not apply to a %d-message pattern", modifier, len(hp.messagePatterns))
+		}
+
+		if position == 0 {
+			hp.messagePatterns[0] = append(messagePattern{token_psk}, hp.messagePatterns[0]...)
+		} else {
+			hp.messagePatterns[position-1] = append(hp.messagePatterns[position-1], token_psk)
+		}
+	}
+
+	return hp, nil
+}
+
+// applyFallback converts the initiator's first message into a pre-message
+// that the responder received by some other means (for example a failed
+// Noise_IK message in Noise Pipes). The rest of the pattern is then
+// initiated by the former responder: the roles are swapped, and so are
+// the "es" and "se" tokens, which are always written from the initiator's
+// point of view.
+func applyFallback(base handshakePattern) (hp handshakePattern, err error) {
+	if len(base.messagePatterns) < 2 {
+		return hp, fmt.Errorf("noise: fallback does not apply to the one-way pattern %s", base.name)
+	}
+	if len(base.preMessagePatterns[0]) > 0 {
+		return hp, fmt.Errorf("noise: fallback does not apply to %s, the initiator already has a pre-message", base.name)
+	}
+	first := base.messagePatterns[0]
+	for _, t := range first {
+		if t != token_e && t != token_s {
+			return hp, fmt.Errorf("noise: fallback does not apply to %s, its first message can only contain e and s", base.name)
+		}
+	}
+
+	hp.name = base.name
+	hp.preMessagePatterns = []messagePattern{
+		base.preMessagePatterns[1], // →
+		first,                      // ←
+	}
+	for _, pattern := range base.messagePatterns[1:] {
+		swapped := make(messagePattern, len(pattern))
+		for idx, t := range pattern {
+			switch t {
+			case token_es:
+				t = token_se
+			case token_se:
+				t = token_es
+			}
+			swapped[idx] = t
+		}
+		hp.messagePatterns = append(hp.messagePatterns, swapped)
+	}
+	return
 }
@@ -3,6 +3,8 @@ package noise
 import (
 	"bytes"
 	"crypto/rand"
+	"errors"
+	"fmt"
 	"testing"
 
 	"golang.org/x/crypto/ed25519"
@@ -45,24 +47,25 @@ func TestNoiseKK(t *testing.T) {
 	addr := listener.Addr().String()
 
 	// run the server and Accept one connection
+	serverErr := make(chan error, 1)
 	go func() {
 		serverSocket, err := listener.Accept()
 		if err != nil {
-			t.Fatal("a server cannot accept()")
+			serverErr <- err
+			return
 		}
 		var buf [100]byte
 		n, err := serverSocket.Read(buf[:])
 		if err != nil {
-			t.Fatal("server can't read on socket")
+			serverErr <- err
+			return
 		}
 		if !bytes.Equal(buf[:n], []byte("hello")) {
-			t.Fatal("client message failed")
+			serverErr <- errors.New("client message failed")
+			return
 		}
-
-		if _, err = serverSocket.Write([]byte("ca va?")); err != nil {
-			t.Fatal("server can't write on socket")
-		}
-
+		_, err = serverSocket.Write([]byte("ca va?"))
+		serverErr <- err
 	}()
 
 	// Run the client
@@ -82,6 +85,9 @@ func TestNoiseKK(t *testing.T) {
 	if !bytes.Equal(buf[:n], []byte("ca va?")) {
 		t.Fatal("server message failed")
 	}
+	if err := <-serverErr; err != nil {
+		t.Fatal("server failed:", err)
+	}
 }
 
 func TestNoiseNK(t *testing.T) {
@@ -109,24 +115,101 @@ func TestNoiseNK(t *testing.T) {
 	addr := listener.Addr().String()
 
 	// run the server and Accept one connection
+	serverErr := make(chan error, 1)
 	go func() {
 		serverSocket, err := listener.Accept()
 		if err != nil {
-			t.Fatal("a server cannot accept()")
+			serverErr <- err
+			return
 		}
 		var buf [100]byte
 		n, err := serverSocket.Read(buf[:])
 		if err != nil {
-			t.Fatal("server can't read on socket")
+			serverErr <- err
+			return
 		}
 		if !bytes.Equal(buf[:n], []byte("hello")) {
-			t.Fatal("client message failed")
+			serverErr <- errors.New("client message failed")
+			return
 		}
+		_, err = serverSocket.Write([]byte("ca va?"))
+		serverErr <- err
+	}()
 
-		if _, err = serverSocket.Write([]byte("ca va?")); err != nil {
-			t.Fatal("server can't write on socket")
-		}
+	// Run the client
+	clientSocket, err := Dial("tcp", addr, &clientConfig)
+	if err != nil {
+		t.Fatal("client can't connect to server", err)
+	}
+	_, err = clientSocket.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal("client can't write on socket")
+	}
+	var buf [100]byte
+	n, err := clientSocket.Read(buf[:])
+	if err != nil {
+		t.Fatal("client can't read server's answer")
+	}
+	if !bytes.Equal(buf[:n], []byte("ca va?")) {
+		t.Fatal("server message failed")
+	}
+	if err := <-serverErr; err != nil {
+		t.Fatal("server failed:", err)
+	}
+}
+
+func TestNoiseNK448(t *testing.T) {
+
+	// init
+	serverKeyPair, err := GenerateDHKeypair(DH448, nil)
+	if err != nil {
+		t.Fatal("cannot generate a X448 key pair", err)
+	}
+	clientConfig := Config{
+		HandshakePattern: Noise_NK,
+		DHFunction:       DH448,
+		RemoteKey:        serverKeyPair.PublicKey,
+	}
+	serverConfig := Config{
+		KeyPair:          serverKeyPair,
+		HandshakePattern: Noise_NK,
+		DHFunction:       DH448,
+	}
+
+	// a X25519 remote key should not be accepted
+	badConfig := clientConfig
+	badConfig.RemoteKey = GenerateKeypair(nil).PublicKey
+	if err := Client(nil, &badConfig).Handshake(); err == nil {
+		t.Fatal("a 32-byte remote key should not be accepted with X448")
+	}
 
+	// get a Noise.listener
+	listener, err := Listen("tcp", "127.0.0.1:0", &serverConfig) // port 0 will find out a free port
+	if err != nil {
+		t.Fatal("cannot setup a listener on localhost:", err)
+	}
+	addr := listener.Addr().String()
+
+	// run the server and Accept one connection
+	serverErr := make(chan error, 1)
+	go func() {
+		serverSocket, err := listener.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		var buf [100]byte
+		n, err := serverSocket.Read(buf[:])
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		if !bytes.Equal(buf[:n], []byte("hello")) {
+			serverErr <- errors.New("client message failed")
+			return
+		}
+		_, err = serverSocket.Write([]byte("ca va?"))
+		serverErr <- err
 	}()
 
 	// Run the client
@@ -146,6 +229,9 @@ func TestNoiseNK(t *testing.T) {
 	if !bytes.Equal(buf[:n], []byte("ca va?")) {
 		t.Fatal("server message failed")
 	}
+	if err := <-serverErr; err != nil {
+		t.Fatal("server failed:", err)
+	}
 }
 
 func TestNoiseXX(t *testing.T) {
@@ -174,30 +260,37 @@ func TestNoiseXX(t *testing.T) {
 	addr := listener.Addr().String()
 
 	// run the server and Accept one connection
+	serverErr := make(chan error, 1)
 	go func() {
 		serverSocket, err := listener.Accept()
 		if err != nil {
-			t.Fatal("a server cannot accept()")
+			serverErr <- err
+			return
 		}
 		var buf [100]byte
 		n, err := serverSocket.Read(buf[:])
 		if err != nil {
-			t.Fatal("server can't read on socket")
+			serverErr <- err
+			return
 		}
 		if !bytes.Equal(buf[:n], []byte("hello")) {
-			t.Fatal("client message failed")
+			serverErr <- errors.New("client message failed")
+			return
 		}
-
 		if _, err = serverSocket.Write([]byte("ca va?")); err != nil {
-			t.Fatal("server can't write on socket")
+			serverErr <- err
+			return
 		}
 		clientStatic, err := serverSocket.(*Conn).StaticKey()
 		if err != nil {
-			t.Fatal("client static key not retrieved")
+			serverErr <- err
+			return
 		}
 		if !bytes.Equal(clientStatic, clientKeyPair.PublicKey[:]) {
-			t.Fatalf("client static retrieved not correct %x", clientStatic)
+			serverErr <- fmt.Errorf("client static retrieved not correct %x", clientStatic)
+			return
 		}
+		serverErr <- nil
 	}()
 
 	// Run the client
@@ -226,6 +319,9 @@ func TestNoiseXX(t *testing.T) {
 	if !bytes.Equal(serverStatic, serverKeyPair.PublicKey[:]) {
 		t.Fatalf("(conn %p) static key received different than server's one %x", clientSocket, serverStatic)
 	}
+	if err := <-serverErr; err != nil {
+		t.Fatal("server failed:", err)
+	}
 }
 
 func TestNoiseN(t *testing.T) {
@@ -250,19 +346,24 @@ func TestNoiseN(t *testing.T) {
 	addr := listener.Addr().String()
 
 	// run the server and Accept one connection
+	serverErr := make(chan error, 1)
 	go func() {
 		serverSocket, err2 := listener.Accept()
 		if err2 != nil {
-			t.Fatal("a server cannot accept()")
+			serverErr <- err2
+			return
 		}
 		var buf [100]byte
 		n, err2 := serverSocket.Read(buf[:])
 		if err2 != nil {
-			t.Fatal("server can't read on socket")
+			serverErr <- err2
+			return
 		}
 		if !bytes.Equal(buf[:n], []byte("hello")) {
-			t.Fatal("client message failed")
+			serverErr <- errors.New("client message failed")
+			return
 		}
+		serverErr <- nil
 
 		/* TODO: test that this fails
 		if _, err = serverSocket.Write([]byte("ca va?")); err != nil {
@@ -281,4 +382,257 @@ func TestNoiseN(t *testing.T) {
 	if err != nil {
 		t.Fatal("client can't write on socket")
 	}
+	if err := <-serverErr; err != nil {
+		t.Fatal("server failed:", err)
+	}
+}
+
+// testPatternOverConn runs a handshake between a client and a server over
+// TCP, and checks that both can write and read on the secure channel
+func testPatternOverConn(t *testing.T, clientConfig, serverConfig *Config) {
+
+	// get a Noise.listener
+	listener, err := Listen("tcp", "127.0.0.1:0", serverConfig) // port 0 will find out a free port
+	if err != nil {
+		t.Fatal("cannot setup a listener on localhost:", err)
+	}
+	defer listener.Close()
+	addr := listener.Addr().String()
+
+	// run the server and Accept one connection
+	serverErr := make(chan error, 1)
+	go func() {
+		serverSocket, err := listener.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		defer serverSocket.Close()
+		var buf [100]byte
+		n, err := serverSocket.Read(buf[:])
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		if !bytes.Equal(buf[:n], []byte("hello")) {
+			serverErr <- errors.New("client message failed")
+			return
+		}
+		_, err = serverSocket.Write([]byte("ca va?"))
+		serverErr <- err
+	}()
+
+	// Run the client
+	clientSocket, err := Dial("tcp", addr, clientConfig)
+	if err != nil {
+		t.Fatal("client can't connect to server", err)
+	}
+	defer clientSocket.Close()
+	if _, err = clientSocket.Write([]byte("hello")); err != nil {
+		t.Fatal("client can't write on socket", err)
+	}
+	var buf [100]byte
+	n, err := clientSocket.Read(buf[:])
+	if err != nil {
+		t.Fatal("client can't read server's answer", err)
+	}
+	if !bytes.Equal(buf[:n], []byte("ca va?")) {
+		t.Fatal("server message failed")
+	}
+	if err := <-serverErr; err != nil {
+		t.Fatal("server failed:", err)
+	}
+}
+
+func TestNoiseNN(t *testing.T) {
+	testPatternOverConn(t,
+		&Config{HandshakePattern: Noise_NN},
+		&Config{HandshakePattern: Noise_NN},
+	)
+}
+
+func TestNoiseKN(t *testing.T) {
+	clientKeyPair := GenerateKeypair(nil)
+	testPatternOverConn(t,
+		&Config{HandshakePattern: Noise_KN, KeyPair: clientKeyPair},
+		&Config{HandshakePattern: Noise_KN, RemoteKey: clientKeyPair.PublicKey},
+	)
+}
+
+func TestNoiseXN(t *testing.T) {
+	clientKeyPair := GenerateKeypair(nil)
+	testPatternOverConn(t,
+		&Config{
+			HandshakePattern:     Noise_XN,
+			KeyPair:              clientKeyPair,
+			StaticPublicKeyProof: CreateStaticPublicKeyProof(rootKey.privateKey, clientKeyPair),
+		},
+		&Config{
+			HandshakePattern:  Noise_XN,
+			PublicKeyVerifier: publicKeyVerifier,
+		},
+	)
+}
+
+func TestNoiseIN(t *testing.T) {
+	clientKeyPair := GenerateKeypair(nil)
+	testPatternOverConn(t,
+		&Config{
+			HandshakePattern:     Noise_IN,
+			KeyPair:              clientKeyPair,
+			StaticPublicKeyProof: CreateStaticPublicKeyProof(rootKey.privateKey, clientKeyPair),
+		},
+		&Config{
+			HandshakePattern:  Noise_IN,
+			PublicKeyVerifier: publicKeyVerifier,
+		},
+	)
+}
+
+var deferredPatterns = []noiseHandshakeType{
+	Noise_NK1, Noise_NX1,
+	Noise_X1N, Noise_X1K, Noise_XK1, Noise_X1K1, Noise_X1X, Noise_XX1, Noise_X1X1,
+	Noise_K1N, Noise_K1K, Noise_KK1, Noise_K1K1, Noise_K1X, Noise_KX1, Noise_K1X1,
+	Noise_I1N, Noise_I1K, Noise_IK1, Noise_I1K1, Noise_I1X, Noise_IX1, Noise_I1X1,
+}
+
+// configsForPattern creates a client and a server configuration
+// with everything the handshake pattern needs
+func configsForPattern(handshakeType noiseHandshakeType) (clientConfig, serverConfig *Config) {
+	pattern := patterns[handshakeType]
+	clientKeyPair := GenerateKeypair(nil)
+	serverKeyPair := GenerateKeypair(nil)
+	clientConfig = &Config{HandshakePattern: handshakeType, KeyPair: clientKeyPair}
+	serverConfig = &Config{HandshakePattern: handshakeType, KeyPair: serverKeyPair}
+	// pre-messages
+	if len(pattern.preMessagePatterns[0]) > 0 {
+		serverConfig.RemoteKey = clientKeyPair.PublicKey
+	}
+	if len(pattern.preMessagePatterns[1]) > 0 {
+		clientConfig.RemoteKey = serverKeyPair.PublicKey
+	}
+	// static keys sent during the handshake
+	if pattern.transmitsStatic(true) {
+		clientConfig.StaticPublicKeyProof = CreateStaticPublicKeyProof(rootKey.privateKey, clientKeyPair)
+		serverConfig.PublicKeyVerifier = publicKeyVerifier
+	}
+	if pattern.transmitsStatic(false) {
+		serverConfig.StaticPublicKeyProof = CreateStaticPublicKeyProof(rootKey.privateKey, serverKeyPair)
+		clientConfig.PublicKeyVerifier = publicKeyVerifier
+	}
+	return
+}
+
+func TestDeferredPatterns(t *testing.T) {
+	for _, handshakeType := range deferredPatterns {
+		clientConfig, serverConfig := configsForPattern(handshakeType)
+		t.Run(patterns[handshakeType].name, func(t *testing.T) {
+			testPatternOverConn(t, clientConfig, serverConfig)
+		})
+	}
+}
+
+func TestCheckRequirementsDeferred(t *testing.T) {
+	// NX1: the server sends its static key in the second message
+	if err := checkRequirements(true, &Config{HandshakePattern: Noise_NX1}); err != errNoPubkeyVerifier {
+		t.Fatal("a NX1 client should need a public key verifier")
+	}
+	if err := checkRequirements(false, &Config{HandshakePattern: Noise_NX1}); err != errNoProof {
+		t.Fatal("a NX1 server should need a static public key proof")
+	}
+	// X1N: the client sends its static key in the third message
+	if err := checkRequirements(true, &Config{HandshakePattern: Noise_X1N}); err != errNoProof {
+		t.Fatal("a X1N client should need a static public key proof")
+	}
+	if err := checkRequirements(false, &Config{HandshakePattern: Noise_X1N}); err != errNoPubkeyVerifier {
+		t.Fatal("a X1N server should need a public key verifier")
+	}
+	// K1K1: both static keys are known in advance
+	if err := checkRequirements(true, &Config{HandshakePattern: Noise_K1K1}); err != nil {
+		t.Fatal("a K1K1 client should not need a proof or a verifier")
+	}
+	if err := checkRequirements(false, &Config{HandshakePattern: Noise_K1K1}); err != nil {
+		t.Fatal("a K1K1 server should not need a proof or a verifier")
+	}
+}
+
+func TestDeferredPatternBadProof(t *testing.T) {
+	clientConfig, serverConfig := configsForPattern(Noise_X1X1)
+	serverConfig.PublicKeyVerifier = func([]byte, []byte) bool { return false }
+
+	listener, err := Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal("cannot setup a listener on localhost:", err)
+	}
+	defer listener.Close()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverSocket, err := listener.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		defer serverSocket.Close()
+		serverErr <- serverSocket.(*Conn).Handshake()
+	}()
+
+	if _, err := Dial("tcp", listener.Addr().String(), clientConfig); err == nil {
+		t.Fatal("the client handshake should fail when the server rejects its key")
+	}
+	if err := <-serverErr; err == nil {
+		t.Fatal("the server should reject the client's static key")
+	}
+}
+
+func TestNoiseNNpsk2(t *testing.T) {
+	psk := bytes.Repeat([]byte{1}, 32)
+	testPatternOverConn(t,
+		&Config{HandshakePattern: Noise_NNpsk2, PreSharedKey: psk},
+		&Config{HandshakePattern: Noise_NNpsk2, PreSharedKey: psk},
+	)
+}
+
+func TestNoiseKKpsk0psk2(t *testing.T) {
+	clientKeyPair := GenerateKeypair(nil)
+	serverKeyPair := GenerateKeypair(nil)
+	psks := [][]byte{bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)}
+	testPatternOverConn(t,
+		&Config{
+			ProtocolName:  "Noise_KKpsk0+psk2_25519_ChaChaPoly_SHA256",
+			KeyPair:       clientKeyPair,
+			RemoteKey:     serverKeyPair.PublicKey,
+			PreSharedKeys: psks,
+		},
+		&Config{
+			ProtocolName:  "Noise_KKpsk0+psk2_25519_ChaChaPoly_SHA256",
+			KeyPair:       serverKeyPair,
+			RemoteKey:     clientKeyPair.PublicKey,
+			PreSharedKeys: psks,
+		},
+	)
+}
+
+func TestCheckRequirementsPSK(t *testing.T) {
+	psk := bytes.Repeat([]byte{1}, 32)
+	config := &Config{ProtocolName: "Noise_NNpsk0+psk2_25519_ChaChaPoly_SHA256"}
+	if err := checkRequirements(true, config); err == nil {
+		t.Fatal("NNpsk0+psk2 should require pre-shared keys")
+	}
+	config.PreSharedKey = psk
+	if err := checkRequirements(true, config); err == nil {
+		t.Fatal("NNpsk0+psk2 should require two pre-shared keys")
+	}
+	config.PreSharedKeys = [][]byte{psk, psk[:16]}
+	if err := checkRequirements(true, config); err == nil {
+		t.Fatal("pre-shared keys should be 32-byte long")
+	}
+	config.PreSharedKeys = [][]byte{psk, psk}
+	if err := checkRequirements(true, config); err != nil {
+		t.Fatal("NNpsk0+psk2 should accept two pre-shared keys:", err)
+	}
+	// patterns without psk tokens do not take pre-shared keys
+	if err := checkRequirements(true, &Config{HandshakePattern: Noise_NN, PreSharedKey: psk}); err == nil {
+		t.Fatal("NN should not accept a pre-shared key")
+	}
 }
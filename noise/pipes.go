@@ -0,0 +1,163 @@
+package noise
+
+import (
+	"errors"
+)
+
+//
+// 10.4. Noise Pipes
+//
+
+// With Noise Pipes, the first message of the client and the first message
+// of the server start with one of these bytes, indicating the handshake
+// pattern used by the rest of the message.
+const (
+	pipesXX byte = iota
+	pipesIK
+	pipesXXfallback
+)
+
+// noisePipesHandshake runs a Noise Pipes handshake:
+//
+// * a client that doesn't know the server's static key uses Noise_XX
+// * a client that knows the server's static key (RemoteKey) uses Noise_IK,
+// saving a round trip
+// * if the server fails to decrypt the Noise_IK message (for example because
+// the client's cached key is outdated), it switches to Noise_XXfallback,
+// re-using the ephemeral key the client sent in its first message. The
+// message counter is not reset, so that both peers keep the same indices for
+// HandshakePayload and OnHandshakePayload.
+func (c *Conn) noisePipesHandshake(protocol protocol, remoteKeyPair *KeyPair) (c1, c2 *cipherState, err error) {
+	xx, ik, xxfallback := protocol, protocol, protocol
+	xx.pattern = patterns[Noise_XX]
+	ik.pattern = patterns[Noise_IK]
+	if xxfallback.pattern, err = applyModifiers(patterns[Noise_XX], []string{"fallback"}); err != nil {
+		return
+	}
+
+	if c.isClient {
+		return c.noisePipesClient(xx, ik, xxfallback, remoteKeyPair)
+	}
+	return c.noisePipesServer(xx, ik, xxfallback)
+}
+
+var errUnexpectedPipesMessage = errors.New("noise: unexpected Noise Pipes handshake message")
+
+// unexpectedPipesMessage makes the handshake fail with an AlertUnexpectedMessage
+func (c *Conn) unexpectedPipesMessage() (c1, c2 *cipherState, err error) {
+	c.handshakeAlert = AlertUnexpectedMessage
+	return nil, nil, errUnexpectedPipesMessage
+}
+
+func (c *Conn) noisePipesClient(xx, ik, xxfallback protocol, remoteKeyPair *KeyPair) (c1, c2 *cipherState, err error) {
+	// full handshake
+	if remoteKeyPair == nil {
+		if err = c.initializeHandshake(xx, true, c.config.Prologue, c.config.KeyPair, nil, nil, nil); err != nil {
+			return
+		}
+		if _, _, err = c.writeHandshakeMessage([]byte{pipesXX}); err != nil {
+			return
+		}
+		var noiseMessage []byte
+		if noiseMessage, err = c.readHandshakeFrame(); err != nil {
+			return
+		}
+		if len(noiseMessage) == 0 || noiseMessage[0] != pipesXX {
+			return c.unexpectedPipesMessage()
+		}
+		if _, _, err = c.readHandshakeMessage(noiseMessage[1:]); err != nil {
+			return
+		}
+		return c.runHandshake()
+	}
+
+	// zero-RTT handshake
+	if err = c.initializeHandshake(ik, true, c.config.Prologue, c.config.KeyPair, nil, remoteKeyPair, nil); err != nil {
+		return
+	}
+	if _, _, err = c.writeHandshakeMessage([]byte{pipesIK}); err != nil {
+		return
+	}
+	var noiseMessage []byte
+	if noiseMessage, err = c.readHandshakeFrame(); err != nil {
+		return
+	}
+	if len(noiseMessage) == 0 {
+		return c.unexpectedPipesMessage()
+	}
+	switch noiseMessage[0] {
+	case pipesIK:
+		return c.readHandshakeMessage(noiseMessage[1:])
+	case pipesXXfallback:
+		// the server could not decrypt our message, our ephemeral key
+		// becomes a pre-message of Noise_XXfallback, initiated by the server
+		ephemeral := c.hs.e
+		ikState := c.hs
+		if err = c.initializeHandshake(xxfallback, false, c.config.Prologue, c.config.KeyPair, &ephemeral, nil, nil); err != nil {
+			return
+		}
+		ikState.clear()
+		if _, _, err = c.readHandshakeMessage(noiseMessage[1:]); err != nil {
+			return
+		}
+		return c.runHandshake()
+	default:
+		return c.unexpectedPipesMessage()
+	}
+}
+
+func (c *Conn) noisePipesServer(xx, ik, xxfallback protocol) (c1, c2 *cipherState, err error) {
+	var noiseMessage []byte
+	if noiseMessage, err = c.readHandshakeFrame(); err != nil {
+		return
+	}
+	if len(noiseMessage) == 0 {
+		return c.unexpectedPipesMessage()
+	}
+	switch noiseMessage[0] {
+	case pipesXX:
+		if err = c.initializeHandshake(xx, false, c.config.Prologue, c.config.KeyPair, nil, nil, nil); err != nil {
+			return
+		}
+		if _, _, err = c.readHandshakeMessage(noiseMessage[1:]); err != nil {
+			return
+		}
+		if _, _, err = c.writeHandshakeMessage([]byte{pipesXX}); err != nil {
+			return
+		}
+		return c.runHandshake()
+
+	case pipesIK:
+		if err = c.initializeHandshake(ik, false, c.config.Prologue, c.config.KeyPair, nil, nil, nil); err != nil {
+			return
+		}
+		_, _, err = c.readHandshakeMessage(noiseMessage[1:])
+		if err == nil {
+			return c.writeHandshakeMessage([]byte{pipesIK})
+		}
+		// only a message that we couldn't decrypt falls back on
+		// Noise_XXfallback: a client that cannot be authenticated, or whose
+		// payload is rejected, should not be given another chance
+		if c.handshakeAlert != AlertDecryptError {
+			return
+		}
+		// we also need to have received the client's ephemeral key
+		if len(c.hs.re.PublicKey) != ik.dh.dhLen {
+			return
+		}
+		c.handshakeAlert = 0
+		remoteEphemeral := KeyPair{PublicKey: c.hs.re.PublicKey}
+		ikState := c.hs
+		if err = c.initializeHandshake(xxfallback, true, c.config.Prologue, c.config.KeyPair, nil, nil, &remoteEphemeral); err != nil {
+			return
+		}
+		ikState.clear()
+		if _, _, err = c.writeHandshakeMessage([]byte{pipesXXfallback}); err != nil {
+			return
+		}
+		return c.runHandshake()
+
+	default:
+		return c.unexpectedPipesMessage()
+	}
+}
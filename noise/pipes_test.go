@@ -0,0 +1,204 @@
+package noise
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestNoisePipes(t *testing.T) {
+
+	// init
+	serverKeyPair := GenerateKeypair(nil)
+	serverConfig := Config{
+		NoisePipes:           true,
+		KeyPair:              serverKeyPair,
+		StaticPublicKeyProof: CreateStaticPublicKeyProof(rootKey.privateKey, serverKeyPair),
+		PublicKeyVerifier:    publicKeyVerifier,
+	}
+	clientKeyPair := GenerateKeypair(nil)
+	clientConfig := Config{
+		NoisePipes:           true,
+		KeyPair:              clientKeyPair,
+		StaticPublicKeyProof: CreateStaticPublicKeyProof(rootKey.privateKey, clientKeyPair),
+		PublicKeyVerifier:    publicKeyVerifier,
+	}
+
+	// get a Noise.listener
+	listener, err := Listen("tcp", "127.0.0.1:0", &serverConfig) // port 0 will find out a free port
+	if err != nil {
+		t.Fatal("cannot setup a listener on localhost:", err)
+	}
+	defer listener.Close()
+	addr := listener.Addr().String()
+
+	// the server echoes what it receives, and reports the pattern it used
+	serverPatterns := make(chan string)
+	go func() {
+		for {
+			serverSocket, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			var buf [100]byte
+			n, err := serverSocket.Read(buf[:])
+			if err == nil {
+				serverSocket.Write(buf[:n])
+			}
+			serverPatterns <- serverSocket.(*Conn).handshakePattern
+			serverSocket.Close()
+		}
+	}()
+
+	connect := func(expectedPattern string) *Conn {
+		clientSocket, err := Dial("tcp", addr, &clientConfig)
+		if err != nil {
+			t.Fatal("client can't connect to server", err)
+		}
+		defer clientSocket.Close()
+		if _, err = clientSocket.Write([]byte("hello")); err != nil {
+			t.Fatal("client can't write on socket", err)
+		}
+		var buf [100]byte
+		n, err := clientSocket.Read(buf[:])
+		if err != nil {
+			t.Fatal("client can't read server's answer", err)
+		}
+		if !bytes.Equal(buf[:n], []byte("hello")) {
+			t.Fatal("server message failed")
+		}
+		if clientSocket.handshakePattern != expectedPattern {
+			t.Fatalf("the client used %s instead of %s", clientSocket.handshakePattern, expectedPattern)
+		}
+		if serverPattern := <-serverPatterns; serverPattern != expectedPattern {
+			t.Fatalf("the server used %s instead of %s", serverPattern, expectedPattern)
+		}
+		return clientSocket
+	}
+
+	// first connection: Noise_XX, the client learns the server's static key
+	clientSocket := connect("XX")
+	serverStatic, err := clientSocket.StaticKey()
+	if err != nil || !bytes.Equal(serverStatic, serverKeyPair.PublicKey) {
+		t.Fatal("the client did not learn the server's static key")
+	}
+
+	// returning client: Noise_IK with the cached key
+	clientConfig.RemoteKey = serverStatic
+	connect("IK")
+
+	// outdated cached key: the server falls back on Noise_XXfallback
+	clientConfig.RemoteKey = GenerateKeypair(nil).PublicKey
+	clientSocket = connect("XXfallback")
+	serverStatic, err = clientSocket.StaticKey()
+	if err != nil || !bytes.Equal(serverStatic, serverKeyPair.PublicKey) {
+		t.Fatal("the client did not learn the server's new static key")
+	}
+}
+
+func TestNoisePipesRejectedPayload(t *testing.T) {
+	serverKeyPair := GenerateKeypair(nil)
+	clientKeyPair := GenerateKeypair(nil)
+	errRejected := errors.New("rejected payload")
+	serverConfig := &Config{
+		NoisePipes:           true,
+		KeyPair:              serverKeyPair,
+		StaticPublicKeyProof: CreateStaticPublicKeyProof(rootKey.privateKey, serverKeyPair),
+		PublicKeyVerifier:    publicKeyVerifier,
+		OnHandshakePayload:   func(int, []byte) error { return errRejected },
+	}
+	clientConfig := &Config{
+		NoisePipes:           true,
+		KeyPair:              clientKeyPair,
+		RemoteKey:            serverKeyPair.PublicKey,
+		StaticPublicKeyProof: CreateStaticPublicKeyProof(rootKey.privateKey, clientKeyPair),
+		PublicKeyVerifier:    publicKeyVerifier,
+		HandshakePayload:     func(int) []byte { return []byte("payload") },
+	}
+
+	// the Noise_IK message is decrypted, but its payload is rejected: the
+	// server must not fall back on Noise_XXfallback
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	server := Server(serverConn, serverConfig)
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.Handshake()
+		serverConn.Close()
+	}()
+	if err := Client(clientConn, clientConfig).Handshake(); err == nil {
+		t.Fatal("the client should have been rejected")
+	}
+	if err := <-serverErr; err != errRejected {
+		t.Fatal("the server should have failed with the error of OnHandshakePayload, got", err)
+	}
+}
+
+func TestNoisePipesFallbackPayloads(t *testing.T) {
+	// each peer sends the index of the message as payload, and records the
+	// indices at which it receives the remote payloads
+	payload := func(messageIndex int) []byte { return []byte(strconv.Itoa(messageIndex)) }
+	newConfig := func(indices *[]int) *Config {
+		keyPair := GenerateKeypair(nil)
+		return &Config{
+			NoisePipes:           true,
+			KeyPair:              keyPair,
+			StaticPublicKeyProof: CreateStaticPublicKeyProof(rootKey.privateKey, keyPair),
+			PublicKeyVerifier:    publicKeyVerifier,
+			HandshakePayload:     payload,
+			OnHandshakePayload: func(messageIndex int, data []byte) error {
+				if !bytes.Equal(data, payload(messageIndex)) {
+					return fmt.Errorf("payload %q received as message %d", data, messageIndex)
+				}
+				*indices = append(*indices, messageIndex)
+				return nil
+			},
+		}
+	}
+	var clientIndices, serverIndices []int
+	clientConfig, serverConfig := newConfig(&clientIndices), newConfig(&serverIndices)
+	clientConfig.RemoteKey = GenerateKeypair(nil).PublicKey // outdated
+
+	// the Noise_IK message keeps its index 0 after the switch to
+	// Noise_XXfallback, even if its payload is lost
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	server := Server(serverConn, serverConfig)
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.Handshake()
+	}()
+	client := Client(clientConn, clientConfig)
+	if err := client.Handshake(); err != nil {
+		t.Fatal("client handshake failed:", err)
+	}
+	if err := <-serverErr; err != nil {
+		t.Fatal("server handshake failed:", err)
+	}
+	if client.handshakePattern != "XXfallback" {
+		t.Fatal("the handshake did not fall back on Noise_XXfallback, but used", client.handshakePattern)
+	}
+	if !reflect.DeepEqual(clientIndices, []int{1}) || !reflect.DeepEqual(serverIndices, []int{2}) {
+		t.Fatalf("unexpected message indices: client %v, server %v", clientIndices, serverIndices)
+	}
+}
+
+func TestNoisePipesRequirements(t *testing.T) {
+	// both peers send their static keys at some point
+	if err := checkRequirements(true, &Config{NoisePipes: true}); err != errNoPubkeyVerifier {
+		t.Fatal("a Noise Pipes client should need a public key verifier")
+	}
+	if err := checkRequirements(false, &Config{NoisePipes: true, PublicKeyVerifier: publicKeyVerifier}); err != errNoProof {
+		t.Fatal("a Noise Pipes server should need a static public key proof")
+	}
+	// fallback patterns can't be used on their own
+	config := &Config{ProtocolName: "Noise_XXfallback_25519_ChaChaPoly_SHA256"}
+	if err := checkRequirements(true, config); err == nil {
+		t.Fatal("Noise_XXfallback should only be available via Noise Pipes")
+	}
+}
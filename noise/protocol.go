@@ -0,0 +1,203 @@
+package noise
+
+import "strings"
+
+//
+// Noise protocol names
+//
+
+// A protocol gathers the handshake pattern and the cipher suite
+// (DH, cipher and hash functions) used to instantiate a handshakeState.
+type protocol struct {
+	pattern handshakePattern
+	dh      dhFunc
+	cipher  cipherFunc
+	hash    hashFunc
+}
+
+// name returns the Noise protocol name, for example
+// "Noise_XX_25519_ChaChaPoly_SHA256"
+func (p protocol) name() string {
+	return "Noise_" + p.pattern.name + "_" + p.dh.name + "_" + p.cipher.name + "_" + p.hash.name
+}
+
+// parseProtocolName resolves a full Noise protocol name like
+// "Noise_XXpsk3_25519_AESGCM_BLAKE2b" into its handshake pattern
+// (with modifiers), DH function, cipher function and hash function.
+func parseProtocolName(protocolName string) (p protocol, err error) {
+	parts := strings.Split(protocolName, "_")
+	if len(parts) != 5 || parts[0] != "Noise" {
+		err = configError("noise: protocol name %q should be of the form Noise_<pattern>_<dh>_<cipher>_<hash>", protocolName)
+		return
+	}
+
+	// handshake pattern and its modifiers
+	patternName := parts[1]
+	if handshakeType, ok := findPattern(patternName); ok {
+		p.pattern = patterns[handshakeType]
+	} else {
+		base, modifiers := splitPatternName(patternName)
+		if base == "" {
+			err = configError("noise: missing handshake pattern in protocol name %q", protocolName)
+			return
+		}
+		baseType, ok := findPattern(base)
+		if !ok {
+			err = configError("noise: unknown handshake pattern %q in protocol name %q", base, protocolName)
+			return
+		}
+		if p.pattern, err = applyModifiers(patterns[baseType], modifiers); err != nil {
+			err = configError("noise: unsupported modifiers %q for pattern %q in protocol name %q: %s", strings.Join(modifiers, "+"), base, protocolName, err)
+			return
+		}
+		if err = checkPattern(p.pattern); err != nil {
+			return
+		}
+	}
+
+	// DH function
+	for _, dh := range dhs {
+		if dh.name == parts[2] {
+			p.dh = dh
+			break
+		}
+	}
+	if p.dh.name == "" {
+		err = configError("noise: unknown DH function %q in protocol name %q", parts[2], protocolName)
+		return
+	}
+
+	// cipher function
+	for _, cipher := range ciphers {
+		if cipher.name == parts[3] {
+			p.cipher = cipher
+			break
+		}
+	}
+	if p.cipher.name == "" {
+		err = configError("noise: unknown cipher function %q in protocol name %q", parts[3], protocolName)
+		return
+	}
+
+	// hash function
+	for _, hash := range hashes {
+		if hash.name == parts[4] {
+			p.hash = hash
+			break
+		}
+	}
+	if p.hash.name == "" {
+		err = configError("noise: unknown hash function %q in protocol name %q", parts[4], protocolName)
+		return
+	}
+
+	return
+}
+
+// splitPatternName separates a pattern name like "XXpsk0+psk3" into its base
+// pattern "XX" and its list of modifiers ["psk0", "psk3"]. The base pattern
+// is made of the leading uppercase letters and digits of the name.
+func splitPatternName(patternName string) (base string, modifiers []string) {
+	i := 0
+	for ; i < len(patternName); i++ {
+		if c := patternName[i]; (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			break
+		}
+	}
+	base = patternName[:i]
+	if i < len(patternName) {
+		modifiers = strings.Split(patternName[i:], "+")
+	}
+	return
+}
+
+// findPattern returns the handshake pattern named patternName
+func findPattern(patternName string) (noiseHandshakeType, bool) {
+	for handshakeType, pattern := range patterns {
+		if pattern.name == patternName {
+			return handshakeType, true
+		}
+	}
+	return 0, false
+}
+
+// protocol returns the Noise protocol described by the configuration:
+// either ProtocolName if it is set, or the HandshakePattern, DHFunction,
+// CipherFunction and HashFunction fields.
+//
+// With NoisePipes, the handshake pattern is replaced by Noise_XX which has the
+// same requirements as the patterns of Noise Pipes.
+func (config *Config) protocol() (p protocol, err error) {
+	if config.ProtocolName != "" {
+		p, err = parseProtocolName(config.ProtocolName)
+	} else {
+		p, err = config.protocolFromFields()
+	}
+	if err == nil && config.NoisePipes {
+		p.pattern = patterns[Noise_XX]
+	}
+	return
+}
+
+// protocolFromFields returns the Noise protocol described by the
+// HandshakePattern, DHFunction, CipherFunction and HashFunction fields.
+func (config *Config) protocolFromFields() (p protocol, err error) {
+
+	var ok bool
+	if p.pattern, ok = patterns[config.HandshakePattern]; !ok {
+		return p, configError("noise: the supplied handshakePattern does not exist")
+	}
+	if p.dh, ok = dhs[config.DHFunction]; !ok {
+		return p, configError("noise: the supplied DH function does not exist")
+	}
+	if p.cipher, ok = ciphers[config.CipherFunction]; !ok {
+		return p, configError("noise: the supplied cipher function does not exist")
+	}
+	if p.hash, ok = hashes[config.HashFunction]; !ok {
+		return p, configError("noise: the supplied hash function does not exist")
+	}
+	return
+}
+
+// preSharedKeys returns the ordered list of pre-shared keys of the
+// configuration: PreSharedKeys if it is set, or PreSharedKey otherwise.
+func (config *Config) preSharedKeys() [][]byte {
+	if len(config.PreSharedKeys) > 0 {
+		return config.PreSharedKeys
+	}
+	if config.PreSharedKey != nil {
+		return [][]byte{config.PreSharedKey}
+	}
+	return nil
+}
+
+// checkPreSharedKeys makes sure that the configuration contains one 32-byte
+// pre-shared key for every psk token of the handshake pattern
+func (config *Config) checkPreSharedKeys(pattern handshakePattern) error {
+	numPSKs := pattern.countTokens(token_psk)
+	psks := config.preSharedKeys()
+	if len(psks) != numPSKs {
+		return configError("noise: %s requires %d pre-shared keys in noise.Config, got %d", pattern.name, numPSKs, len(psks))
+	}
+	for _, psk := range psks {
+		if len(psk) != 32 {
+			return configError("noise: pre-shared keys passed in noise.Config need to be 32-byte long")
+		}
+	}
+	return nil
+}
+
+// keyPairs checks that the KeyPair and RemoteKey of the configuration match
+// the DH function, and returns them as arguments for initialize()
+func (config *Config) keyPairs(dh dhFunc) (s, rs *KeyPair, err error) {
+	if config.KeyPair != nil && (len(config.KeyPair.PrivateKey) != dh.dhLen || len(config.KeyPair.PublicKey) != dh.dhLen) {
+		return nil, nil, configError("noise: the provided key pair does not match the size of the DH function")
+	}
+	if config.RemoteKey != nil {
+		if len(config.RemoteKey) != dh.dhLen {
+			return nil, nil, configError("noise: the provided remote key does not match the size of the DH function")
+		}
+		rs = &KeyPair{PublicKey: config.RemoteKey}
+	}
+	return config.KeyPair, rs, nil
+}
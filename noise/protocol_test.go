@@ -0,0 +1,171 @@
+package noise
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseProtocolName(t *testing.T) {
+	valid := []string{
+		"Noise_XX_25519_ChaChaPoly_SHA256",
+		"Noise_NK_25519_AESGCM_BLAKE2b",
+		"Noise_IK_448_ChaChaPoly_BLAKE2s",
+		"Noise_NNpsk2_448_AESGCM_SHA512",
+		"Noise_XXpsk3_25519_ChaChaPoly_BLAKE2b",
+		"Noise_KKpsk0+psk2_25519_AESGCM_SHA256",
+		"Noise_IK1psk1_448_ChaChaPoly_SHA512",
+		"Noise_XXfallback_25519_ChaChaPoly_SHA256",
+		"Noise_XXfallback+psk0_25519_AESGCM_SHA256",
+	}
+	for _, protocolName := range valid {
+		protocol, err := parseProtocolName(protocolName)
+		if err != nil {
+			t.Fatalf("%s should be a valid protocol name: %s", protocolName, err)
+		}
+		if protocol.name() != protocolName {
+			t.Fatalf("%s was parsed as %s", protocolName, protocol.name())
+		}
+	}
+
+	invalid := []struct {
+		protocolName string
+		reason       string
+	}{
+		{"", "should be of the form"},
+		{"Noise_XX_25519_ChaChaPoly", "should be of the form"},
+		{"Disco_XX_25519_ChaChaPoly_SHA256", "should be of the form"},
+		{"Noise_psk0_25519_ChaChaPoly_SHA256", "missing handshake pattern"},
+		{"Noise_ZZ_25519_ChaChaPoly_SHA256", "unknown handshake pattern \"ZZ\""},
+		{"Noise_XXhfs_25519_ChaChaPoly_SHA256", "unsupported modifiers \"hfs\""},
+		{"Noise_XXpsk4_25519_ChaChaPoly_SHA256", "unsupported modifiers \"psk4\""},
+		{"Noise_NNpsk0+psk0_25519_ChaChaPoly_SHA256", "unsupported modifiers \"psk0+psk0\""},
+		{"Noise_NNpsk02_25519_ChaChaPoly_SHA256", "unsupported modifiers \"psk02\""},
+		{"Noise_Nfallback_25519_ChaChaPoly_SHA256", "unsupported modifiers \"fallback\""},
+		{"Noise_KKfallback_25519_ChaChaPoly_SHA256", "unsupported modifiers \"fallback\""},
+		{"Noise_XXpsk0+fallback_25519_ChaChaPoly_SHA256", "unsupported modifiers \"psk0+fallback\""},
+		{"Noise_XX_P256_ChaChaPoly_SHA256", "unknown DH function \"P256\""},
+		{"Noise_XX_25519_AESCTR_SHA256", "unknown cipher function \"AESCTR\""},
+		{"Noise_XX_25519_ChaChaPoly_MD5", "unknown hash function \"MD5\""},
+	}
+	for _, test := range invalid {
+		_, err := parseProtocolName(test.protocolName)
+		if err == nil {
+			t.Fatalf("%q should not be a valid protocol name", test.protocolName)
+		}
+		if !strings.Contains(err.Error(), test.reason) {
+			t.Fatalf("unexpected error for %q: %s", test.protocolName, err)
+		}
+	}
+}
+
+func TestConfigProtocolName(t *testing.T) {
+
+	// init
+	serverKeyPair, _ := GenerateDHKeypair(DH448, nil)
+	serverConfig := Config{
+		ProtocolName: "Noise_NK_448_AESGCM_BLAKE2b",
+		KeyPair:      serverKeyPair,
+	}
+	clientConfig := Config{
+		ProtocolName: "Noise_NK_448_AESGCM_BLAKE2b",
+		RemoteKey:    serverKeyPair.PublicKey,
+	}
+
+	// an unknown protocol should be refused
+	if _, err := Listen("tcp", "127.0.0.1:0", &Config{ProtocolName: "Noise_NK_448_AESGCM_MD5"}); err == nil {
+		t.Fatal("a listener should not accept an unknown protocol name")
+	}
+
+	// get a Noise.listener
+	listener, err := Listen("tcp", "127.0.0.1:0", &serverConfig) // port 0 will find out a free port
+	if err != nil {
+		t.Fatal("cannot setup a listener on localhost:", err)
+	}
+	addr := listener.Addr().String()
+
+	// run the server and Accept one connection
+	serverErr := make(chan error, 1)
+	go func() {
+		serverSocket, err := listener.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		var buf [100]byte
+		n, err := serverSocket.Read(buf[:])
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		_, err = serverSocket.Write(buf[:n])
+		serverErr <- err
+	}()
+
+	// Run the client
+	clientSocket, err := Dial("tcp", addr, &clientConfig)
+	if err != nil {
+		t.Fatal("client can't connect to server", err)
+	}
+	if _, err = clientSocket.Write([]byte("hello")); err != nil {
+		t.Fatal("client can't write on socket")
+	}
+	var buf [100]byte
+	n, err := clientSocket.Read(buf[:])
+	if err != nil {
+		t.Fatal("client can't read server's answer")
+	}
+	if !bytes.Equal(buf[:n], []byte("hello")) {
+		t.Fatal("server message failed")
+	}
+	if err := <-serverErr; err != nil {
+		t.Fatal("server failed:", err)
+	}
+}
+
+func TestApplyModifiers(t *testing.T) {
+	// psk0 goes at the beginning of the first message, pskN at the end of the Nth message
+	hp, err := applyModifiers(patterns[Noise_XX], []string{"psk0", "psk3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hp.name != "XXpsk0+psk3" {
+		t.Fatalf("unexpected pattern name %s", hp.name)
+	}
+	expected := []messagePattern{
+		messagePattern{token_psk, token_e},
+		messagePattern{token_e, token_ee, token_s, token_es},
+		messagePattern{token_s, token_se, token_psk},
+	}
+	if !reflect.DeepEqual(hp.messagePatterns, expected) {
+		t.Fatalf("XXpsk0+psk3 is %v instead of %v", hp.messagePatterns, expected)
+	}
+	// the base pattern is left untouched
+	if patterns[Noise_XX].countTokens(token_psk) != 0 {
+		t.Fatal("applying modifiers should not modify the base pattern")
+	}
+	// XXfallback turns the first message of XX into a responder pre-message
+	hp, err = applyModifiers(patterns[Noise_XX], []string{"fallback"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedFallback := handshakePattern{
+		name: "XXfallback",
+		preMessagePatterns: []messagePattern{
+			messagePattern{},
+			messagePattern{token_e},
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e, token_ee, token_s, token_se},
+			messagePattern{token_s, token_es},
+		},
+	}
+	if !reflect.DeepEqual(hp, expectedFallback) {
+		t.Fatalf("XXfallback is %v instead of %v", hp, expectedFallback)
+	}
+	// NNpsk2 is derived from NN
+	if patterns[Noise_NNpsk2].name != "NNpsk2" || patterns[Noise_NNpsk2].countTokens(token_psk) != 1 {
+		t.Fatal("NNpsk2 was not derived properly")
+	}
+}
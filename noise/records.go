@@ -0,0 +1,95 @@
+package noise
+
+import (
+	"errors"
+	"strconv"
+)
+
+//
+// Records
+//
+// The plaintext of every transport message starts with the type of record
+// it carries (except with NoiseSocket, whose transport messages only carry
+// application data as specified):
+//
+// * data: the application data
+// * rekey: the sender rotates its key after this message, see Conn.Rekey()
+// * close_notify: the sender closes the connection, see Conn.Close()
+// * alert: the sender aborts the connection, the next byte is an Alert
+//
+// During the handshake, nothing is encrypted yet: a failing peer sends its
+// Alert in a frame of a single byte instead, which cannot be a valid
+// handshake message. These frames are only accepted during the handshake:
+// a peer rejecting the final handshake message already has the keys of the
+// session, and sends an encrypted alert record.
+//
+
+const (
+	recordData byte = iota
+	recordRekey
+	recordCloseNotify
+	recordAlert
+)
+
+// An Alert tells the peer why the connection is aborted.
+type Alert uint8
+
+const (
+	// AlertInternalError is sent when the failure is not related to the peer
+	AlertInternalError Alert = iota + 1
+	// AlertUnexpectedMessage is sent when a message was not expected at that
+	// point of the protocol
+	AlertUnexpectedMessage
+	// AlertDecryptError is sent when a message could not be decrypted
+	AlertDecryptError
+	// AlertDecodeError is sent when a decrypted message is malformed
+	AlertDecodeError
+	// AlertBadPublicKey is sent when the static public key of the peer was
+	// rejected by the PublicKeyVerifier
+	AlertBadPublicKey
+	// AlertPayloadRejected is sent when a handshake payload was rejected
+	// by OnHandshakePayload
+	AlertPayloadRejected
+)
+
+var alertNames = map[Alert]string{
+	AlertInternalError:     "internal error",
+	AlertUnexpectedMessage: "unexpected message",
+	AlertDecryptError:      "decrypt error",
+	AlertDecodeError:       "decode error",
+	AlertBadPublicKey:      "bad public key",
+	AlertPayloadRejected:   "payload rejected",
+}
+
+func (a Alert) String() string {
+	if name, ok := alertNames[a]; ok {
+		return name
+	}
+	return "alert(" + strconv.Itoa(int(a)) + ")"
+}
+
+// An AlertError is returned when the peer aborted the connection with an Alert
+type AlertError struct {
+	Alert Alert
+}
+
+func (e *AlertError) Error() string {
+	return "noise: the peer aborted the connection: " + e.Alert.String()
+}
+
+// ErrTruncated is returned by Read when the connection was closed without
+// a close_notify: the peer did not call Close, or an attacker cut the
+// connection, and some data might be missing.
+var ErrTruncated = errors.New("noise: the connection was closed without a close_notify, the data might have been truncated")
+
+// errNoRecords is returned when a record other than data is sent with
+// NoiseSocket
+var errNoRecords = errors.New("noise: NoiseSocket transport messages cannot carry rekey, close_notify or alert records")
+
+// alertFrame returns an AlertError if the handshake frame carries an Alert
+func alertFrame(frame []byte) error {
+	if len(frame) == 1 {
+		return &AlertError{Alert: Alert(frame[0])}
+	}
+	return nil
+}
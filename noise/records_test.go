@@ -0,0 +1,188 @@
+package noise
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// newNKPair returns a client and a server using Noise_NK over net.Pipe()
+func newNKPair() (client, server *Conn) {
+	serverKeyPair := GenerateKeypair(nil)
+	clientPipe, serverPipe := net.Pipe()
+	client = Client(clientPipe, &Config{HandshakePattern: Noise_NK, RemoteKey: serverKeyPair.PublicKey})
+	server = Server(serverPipe, &Config{HandshakePattern: Noise_NK, KeyPair: serverKeyPair})
+	return
+}
+
+func TestCloseNotify(t *testing.T) {
+	client, server := newNKPair()
+	defer client.Close()
+	go func() {
+		if _, err := server.Write([]byte("bye")); err == nil {
+			server.Close()
+		}
+	}()
+
+	buf := make([]byte, 10)
+	n, err := client.Read(buf)
+	if err != nil || string(buf[:n]) != "bye" {
+		t.Fatal("client can't read:", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err = client.Read(buf); err != io.EOF {
+			t.Fatal("the client should read io.EOF after a close_notify, not", err)
+		}
+	}
+}
+
+func TestTruncation(t *testing.T) {
+	client, server := newNKPair()
+	defer client.Close()
+	go func() {
+		if _, err := server.Write([]byte("bye")); err == nil {
+			// an attacker cuts the connection
+			server.conn.Close()
+		}
+	}()
+
+	buf := make([]byte, 10)
+	n, err := client.Read(buf)
+	if err != nil || string(buf[:n]) != "bye" {
+		t.Fatal("client can't read:", err)
+	}
+	if _, err = client.Read(buf); err != ErrTruncated {
+		t.Fatal("the client should detect the truncation, not", err)
+	}
+}
+
+func TestCloseDuringWrite(t *testing.T) {
+	client, server := newNKPair()
+	defer server.Close()
+	go server.Handshake()
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the server does not read: the Write blocks
+	written := make(chan error, 1)
+	go func() {
+		_, err := client.Write([]byte("blocked"))
+		written <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	closed := make(chan error, 1)
+	go func() { closed <- client.Close() }()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close should not wait for the Write in progress")
+	}
+	if err := <-written; err == nil {
+		t.Fatal("the Write in progress should have been interrupted")
+	}
+}
+
+func TestHandshakeAlert(t *testing.T) {
+	clientKeyPair := GenerateKeypair(nil)
+	serverKeyPair := GenerateKeypair(nil)
+	clientPipe, serverPipe := net.Pipe()
+	client := Client(clientPipe, &Config{
+		HandshakePattern:     Noise_XX,
+		KeyPair:              clientKeyPair,
+		StaticPublicKeyProof: CreateStaticPublicKeyProof(rootKey.privateKey, clientKeyPair),
+		PublicKeyVerifier:    func(publicKey, proof []byte) bool { return false },
+	})
+	server := Server(serverPipe, &Config{
+		HandshakePattern:     Noise_XX,
+		KeyPair:              serverKeyPair,
+		StaticPublicKeyProof: CreateStaticPublicKeyProof(rootKey.privateKey, serverKeyPair),
+		PublicKeyVerifier:    publicKeyVerifier,
+	})
+	defer client.Close()
+	defer server.Close()
+
+	serverErr := make(chan error)
+	go func() { serverErr <- server.Handshake() }()
+
+	// the client rejects the server's key and tells it why
+	if err := client.Handshake(); err != errRemoteNotAuthenticated {
+		t.Fatal("the client should not accept the server's key, got", err)
+	}
+	err := <-serverErr
+	if alert, ok := err.(*AlertError); !ok || alert.Alert != AlertBadPublicKey {
+		t.Fatal("the server should have received an AlertBadPublicKey, got", err)
+	}
+	// the handshake is not run again
+	if err = client.Handshake(); err != errRemoteNotAuthenticated {
+		t.Fatal("a failed handshake should keep failing, got", err)
+	}
+}
+
+func TestFinalMessageAlert(t *testing.T) {
+	clientKeyPair := GenerateKeypair(nil)
+	serverKeyPair := GenerateKeypair(nil)
+	clientPipe, serverPipe := net.Pipe()
+	client := Client(clientPipe, &Config{
+		HandshakePattern:     Noise_XX,
+		KeyPair:              clientKeyPair,
+		StaticPublicKeyProof: CreateStaticPublicKeyProof(rootKey.privateKey, clientKeyPair),
+		PublicKeyVerifier:    publicKeyVerifier,
+	})
+	server := Server(serverPipe, &Config{
+		HandshakePattern:     Noise_XX,
+		KeyPair:              serverKeyPair,
+		StaticPublicKeyProof: CreateStaticPublicKeyProof(rootKey.privateKey, serverKeyPair),
+		PublicKeyVerifier:    func(publicKey, proof []byte) bool { return false },
+	})
+	defer client.Close()
+	defer server.Close()
+
+	serverErr := make(chan error)
+	go func() { serverErr <- server.Handshake() }()
+
+	// the server rejects the key sent in the final message: the client has
+	// completed its handshake and receives an encrypted alert
+	if err := client.Handshake(); err != nil {
+		t.Fatal("the handshake of the client should be complete, got", err)
+	}
+	buf := make([]byte, 10)
+	_, err := client.Read(buf)
+	if alert, ok := err.(*AlertError); !ok || alert.Alert != AlertBadPublicKey {
+		t.Fatal("the client should have received an AlertBadPublicKey, got", err)
+	}
+	if err = <-serverErr; err != errRemoteNotAuthenticated {
+		t.Fatal("the server should not accept the client's key, got", err)
+	}
+}
+
+func TestUnauthenticatedAlert(t *testing.T) {
+	client, server := newNKPair()
+	// nobody reads a close_notify
+	defer client.conn.Close()
+	defer server.conn.Close()
+	go func() {
+		if server.Handshake() == nil {
+			// an attacker injects an alert in clear
+			server.conn.Write([]byte{0, 1, byte(AlertBadPublicKey)})
+		}
+	}()
+
+	buf := make([]byte, 10)
+	_, err := client.Read(buf)
+	if _, ok := err.(*AlertError); ok || err == nil {
+		t.Fatal("an alert in clear should be rejected after the handshake, got", err)
+	}
+}
+
+func TestAlertString(t *testing.T) {
+	if AlertDecryptError.String() != "decrypt error" || Alert(200).String() != "alert(200)" {
+		t.Fatal("unexpected names of alerts")
+	}
+	err := &AlertError{Alert: AlertPayloadRejected}
+	if err.Error() != "noise: the peer aborted the connection: payload rejected" {
+		t.Fatal("unexpected error message:", err.Error())
+	}
+}
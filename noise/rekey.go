@@ -0,0 +1,65 @@
+package noise
+
+import (
+	"errors"
+	"math"
+)
+
+//
+// 11.3. Rekey
+//
+// A Conn signals that it rotates its sending key with a rekey record,
+// encrypted with the old key. The peer rotates its receiving key when it
+// decrypts it. Following the rekey()
+// function of the specification, the nonce is not reset.
+//
+
+// maxDataNonce is the last nonce usable by a data message: the last nonces
+// of a key are kept for control messages
+const maxDataNonce = math.MaxUint64 - 2
+
+var errNonceExhausted = errors.New("noise: the connection has sent the maximum number of messages, a new handshake is needed")
+
+// Rekey rotates the key encrypting the messages sent on the connection, and
+// tells the peer to do the same with the key decrypting them. Old keys
+// cannot be recovered from new ones, which limits the damage of a later
+// compromise of the connection. See also Config.RekeyAfterMessages and
+// Config.RekeyAfterBytes.
+func (c *Conn) Rekey() error {
+	// Make sure to go through the handshake first
+	if err := c.Handshake(); err != nil {
+		return err
+	}
+
+	if !c.canWrite() {
+		return oneWayError("noise: a server cannot rekey on one-way patterns")
+	}
+
+	// Lock the write socket
+	if c.isHalfDuplex {
+		c.halfDuplexLock.Lock()
+		defer c.halfDuplexLock.Unlock()
+	} else {
+		c.outLock.Lock()
+		defer c.outLock.Unlock()
+	}
+	return c.rekeyOut()
+}
+
+// rekeyOut signals the peer and rotates the sending key, it must be called
+// with the write lock
+func (c *Conn) rekeyOut() error {
+	if err := c.writeTransportMessage(recordRekey, nil); err != nil {
+		return err
+	}
+	c.out.Rekey()
+	c.outMessages, c.outBytes = 0, 0
+	return nil
+}
+
+// shouldRekey returns true if the sending key has reached one of the
+// thresholds of the configuration
+func (c *Conn) shouldRekey() bool {
+	return (c.config.RekeyAfterMessages > 0 && c.outMessages >= c.config.RekeyAfterMessages) ||
+		(c.config.RekeyAfterBytes > 0 && c.outBytes >= c.config.RekeyAfterBytes)
+}
@@ -0,0 +1,155 @@
+package noise
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// newConnPair returns a client and a server connected with net.Pipe(), the
+// server echoing everything it reads
+func newConnPair(clientConfig, serverConfig *Config) (client, server *Conn) {
+	clientPipe, serverPipe := net.Pipe()
+	client = Client(clientPipe, clientConfig)
+	server = Server(serverPipe, serverConfig)
+	go func() {
+		defer server.Close()
+		buf := make([]byte, 1000)
+		for {
+			n, err := server.Read(buf)
+			if err != nil {
+				return
+			}
+			if _, err = server.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+	}()
+	return
+}
+
+func echo(t *testing.T, client *Conn, message string) {
+	if _, err := client.Write([]byte(message)); err != nil {
+		t.Fatal("client can't write:", err)
+	}
+	buf := make([]byte, 1000)
+	n, err := client.Read(buf)
+	if err != nil || !bytes.Equal(buf[:n], []byte(message)) {
+		t.Fatalf("the server should have echoed %q, not %q (%v)", message, buf[:n], err)
+	}
+}
+
+func TestRekey(t *testing.T) {
+	serverKeyPair := GenerateKeypair(nil)
+	client, server := newConnPair(
+		&Config{HandshakePattern: Noise_NK, RemoteKey: serverKeyPair.PublicKey},
+		&Config{HandshakePattern: Noise_NK, KeyPair: serverKeyPair},
+	)
+	defer client.Close()
+
+	echo(t, client, "before")
+	oldKey := client.out.k
+	nonce := client.out.n
+	if err := client.Rekey(); err != nil {
+		t.Fatal("client can't rekey:", err)
+	}
+	if client.out.k == oldKey {
+		t.Fatal("the sending key has not changed")
+	}
+	if client.out.n != nonce+1 {
+		t.Fatal("the rekey message should use a single nonce, and the nonce should not be reset")
+	}
+	echo(t, client, "after")
+
+	// the server rotates its own key, then writes (net.Pipe() blocks until
+	// the client reads)
+	oldKey = client.in.k
+	rekeyErr := make(chan error)
+	go func() {
+		err := server.Rekey()
+		if err == nil {
+			_, err = server.Write([]byte("rekeyed"))
+		}
+		rekeyErr <- err
+	}()
+	buf := make([]byte, 100)
+	n, err := client.Read(buf)
+	if err != nil || string(buf[:n]) != "rekeyed" {
+		t.Fatal("client can't read after the server's rekey:", err)
+	}
+	if err := <-rekeyErr; err != nil {
+		t.Fatal("server can't rekey:", err)
+	}
+	if client.in.k == oldKey {
+		t.Fatal("the receiving key of the client has not changed")
+	}
+	echo(t, client, "after the server's rekey")
+}
+
+func TestRekeyThresholds(t *testing.T) {
+	serverKeyPair := GenerateKeypair(nil)
+	serverConfig := Config{HandshakePattern: Noise_NK, KeyPair: serverKeyPair}
+
+	// after 2 messages
+	client, _ := newConnPair(&Config{HandshakePattern: Noise_NK, RemoteKey: serverKeyPair.PublicKey, RekeyAfterMessages: 2}, &serverConfig)
+	defer client.Close()
+	echo(t, client, "one")
+	oldKey := client.out.k
+	echo(t, client, "two")
+	if client.out.k != oldKey {
+		t.Fatal("the key should not change before the threshold")
+	}
+	echo(t, client, "three")
+	if client.out.k == oldKey {
+		t.Fatal("the key should have changed after 2 messages")
+	}
+	if client.outMessages != 1 {
+		t.Fatal("the counter of messages should have been reset")
+	}
+
+	// after 10 bytes
+	client, _ = newConnPair(&Config{HandshakePattern: Noise_NK, RemoteKey: serverKeyPair.PublicKey, RekeyAfterBytes: 10}, &serverConfig)
+	defer client.Close()
+	echo(t, client, "0123456789")
+	oldKey = client.out.k
+	echo(t, client, "a")
+	if client.out.k == oldKey {
+		t.Fatal("the key should have changed after 10 bytes")
+	}
+}
+
+func TestNonceExhaustion(t *testing.T) {
+	serverKeyPair := GenerateKeypair(nil)
+	client, _ := newConnPair(
+		&Config{HandshakePattern: Noise_NK, RemoteKey: serverKeyPair.PublicKey},
+		&Config{HandshakePattern: Noise_NK, KeyPair: serverKeyPair},
+	)
+	defer client.Close()
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	client.out.n = maxDataNonce
+	if _, err := client.Write([]byte("hello")); err != errNonceExhausted {
+		t.Fatal("the last nonces should be kept for control messages, got", err)
+	}
+}
+
+func TestNoiseSocketRekey(t *testing.T) {
+	serverKeyPair := GenerateKeypair(nil)
+	client, _ := newConnPair(
+		&Config{HandshakePattern: Noise_NK, RemoteKey: serverKeyPair.PublicKey, NoiseSocket: true},
+		&Config{HandshakePattern: Noise_NK, KeyPair: serverKeyPair, NoiseSocket: true},
+	)
+	defer client.Close()
+
+	// NoiseSocket transport messages only carry application data
+	echo(t, client, "hello")
+	if err := client.Rekey(); err != errNoRecords {
+		t.Fatal("a NoiseSocket connection should not be able to signal a rekey, got", err)
+	}
+	echo(t, client, "still working")
+	config := &Config{HandshakePattern: Noise_NK, RemoteKey: serverKeyPair.PublicKey, NoiseSocket: true, RekeyAfterMessages: 10}
+	if err := config.Validate(); err == nil {
+		t.Fatal("RekeyAfterMessages should be rejected with NoiseSocket")
+	}
+}
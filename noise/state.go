@@ -0,0 +1,209 @@
+package noise
+
+import (
+	"errors"
+)
+
+//
+// Exported HandshakeState and CipherState
+//
+// Conn is the easiest way to use Noise, but some transports (message buses,
+// UDP, ...) do not fit the net.Conn interface. The following objects follow
+// the API of the specification instead, and leave the transport of the
+// messages to the application.
+//
+
+// maxMessageLength is the maximum size of a Noise message
+const maxMessageLength = 65535
+
+// A HandshakeState runs the handshake of the protocol described by a Config,
+// one message at a time. Its methods are not safe for concurrent use.
+type HandshakeState struct {
+	hs       handshakeState
+	pattern  handshakePattern
+	complete bool
+	failed   bool
+}
+
+// NewHandshakeState creates a HandshakeState for the initiator (if
+// config.Initiator is true) or the responder of the protocol described by
+// the configuration. StaticPublicKeyProof and PublicKeyVerifier are not used:
+// payloads are given to WriteMessage() and returned by ReadMessage(), and the
+// remote static key is available via RemoteStatic(). Patterns with an
+// ephemeral pre-message, like the fallback patterns, are refused.
+func NewHandshakeState(config *Config) (*HandshakeState, error) {
+	if config == nil {
+		return nil, errNoConfig
+	}
+	if config.NoisePipes {
+		return nil, configError("noise: Noise Pipes is only available via Dial() and Listen()")
+	}
+	if config.NoiseSocket {
+		return nil, configError("noise: NoiseSocket is only available via Dial() and Listen()")
+	}
+	protocol, err := config.protocol()
+	if err != nil {
+		return nil, err
+	}
+	// there is no way to give the ephemeral key of a pre-message
+	if protocol.pattern.hasEphemeralPreMessage() {
+		return nil, configError("noise: %s requires an ephemeral key from a previous handshake, and cannot be used with NewHandshakeState()", protocol.pattern.name)
+	}
+	if err = config.checkPreSharedKeys(protocol.pattern); err != nil {
+		return nil, err
+	}
+	keyPair, remoteKeyPair, err := config.keyPairs(protocol.dh)
+	if err != nil {
+		return nil, err
+	}
+	if protocol.pattern.transmitsStatic(config.Initiator) && keyPair == nil {
+		return nil, configError("noise: %s requires a KeyPair in noise.Config", protocol.pattern.name)
+	}
+	hs, err := initialize(protocol, config.Initiator, config.Prologue, keyPair, nil, remoteKeyPair, nil)
+	if err != nil {
+		return nil, err
+	}
+	hs.psks = config.preSharedKeys()
+	return &HandshakeState{hs: hs, pattern: protocol.pattern}, nil
+}
+
+// WriteMessage writes the next handshake message, carrying the payload.
+// When the handshake completes, cs1 and cs2 are the CipherStates to
+// encrypt the transport messages from the initiator to the responder, and
+// from the responder to the initiator. cs2 is nil for one-way patterns.
+func (h *HandshakeState) WriteMessage(payload []byte) (message []byte, cs1, cs2 *CipherState, err error) {
+	if err = h.checkState(); err != nil {
+		return
+	}
+	if !h.hs.shouldWrite {
+		return nil, nil, nil, wrongTurnError("noise: unexpected call to WriteMessage, it is the turn of ReadMessage")
+	}
+	c1, c2, err := h.hs.writeMessage(payload, &message)
+	if err == nil && len(message) > maxMessageLength {
+		err = errors.New("noise: the handshake message exceeds the maximum size of a Noise message")
+	}
+	if err != nil {
+		h.failed = true
+		return nil, nil, nil, err
+	}
+	cs1, cs2 = h.finish(c1, c2)
+	return
+}
+
+// ReadMessage reads the next handshake message and returns its payload.
+// When the handshake completes, cs1 and cs2 are the CipherStates to
+// encrypt the transport messages from the initiator to the responder, and
+// from the responder to the initiator. cs2 is nil for one-way patterns.
+// After an error the handshake cannot continue.
+func (h *HandshakeState) ReadMessage(message []byte) (payload []byte, cs1, cs2 *CipherState, err error) {
+	if err = h.checkState(); err != nil {
+		return
+	}
+	if h.hs.shouldWrite {
+		return nil, nil, nil, wrongTurnError("noise: unexpected call to ReadMessage, it is the turn of WriteMessage")
+	}
+	if len(message) > maxMessageLength {
+		h.failed = true
+		return nil, nil, nil, errors.New("noise: the handshake message exceeds the maximum size of a Noise message")
+	}
+	c1, c2, err := h.hs.readMessage(message, &payload)
+	if err != nil {
+		h.failed = true
+		return nil, nil, nil, err
+	}
+	cs1, cs2 = h.finish(c1, c2)
+	return
+}
+
+// RemoteStatic returns the static public key of the remote peer, either
+// received during the handshake or given in Config.RemoteKey. It returns
+// nil if the static key of the remote peer is not known (yet).
+func (h *HandshakeState) RemoteStatic() []byte {
+	if len(h.hs.rs.PublicKey) == 0 {
+		return nil
+	}
+	return append([]byte{}, h.hs.rs.PublicKey...)
+}
+
+// HandshakeHash returns the current hash of the handshake. Once the handshake
+// is complete, both peers obtain the same value, unique to the session, which
+// can be used for channel binding (see section 11.2 of the specification).
+func (h *HandshakeState) HandshakeHash() []byte {
+	return append([]byte{}, h.hs.symmetricState.h...)
+}
+
+// PatternName returns the name of the handshake pattern, for example "XXpsk3"
+func (h *HandshakeState) PatternName() string {
+	return h.pattern.name
+}
+
+// checkState returns an error if the handshake is over
+func (h *HandshakeState) checkState() error {
+	if h.failed {
+		return errors.New("noise: the handshake has failed")
+	}
+	if h.complete {
+		return errors.New("noise: the handshake is already complete")
+	}
+	return nil
+}
+
+// finish wraps the cipher states returned by the last message of the handshake
+func (h *HandshakeState) finish(c1, c2 *cipherState) (cs1, cs2 *CipherState) {
+	if c1 == nil {
+		return nil, nil
+	}
+	h.complete = true
+	h.hs.clear()
+	cs1 = &CipherState{cs: c1}
+	// the responder of a one-way pattern never sends transport messages
+	if c2 != nil && !h.pattern.isOneWay() {
+		cs2 = &CipherState{cs: c2}
+	}
+	return
+}
+
+// A CipherState encrypts or decrypts the transport messages going in one
+// direction. Its methods are not safe for concurrent use.
+type CipherState struct {
+	cs *cipherState
+}
+
+// Encrypt encrypts and authenticates the plaintext with the next nonce,
+// along with the additional data ad.
+func (c *CipherState) Encrypt(ad, plaintext []byte) ([]byte, error) {
+	if len(plaintext) > maxMessageLength-NoiseTagLength {
+		return nil, errors.New("noise: the plaintext exceeds the maximum size of a Noise message")
+	}
+	return c.cs.encryptWithAd(ad, plaintext)
+}
+
+// Decrypt authenticates and decrypts the ciphertext with the next nonce,
+// along with the additional data ad. The nonce is only incremented if the
+// decryption succeeds.
+func (c *CipherState) Decrypt(ad, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) > maxMessageLength {
+		return nil, errors.New("noise: the ciphertext exceeds the maximum size of a Noise message")
+	}
+	return c.cs.decryptWithAd(ad, ciphertext)
+}
+
+// Rekey updates the key of the CipherState with a one-way function, see
+// section 11.3 of the specification. Both peers need to rekey at the same
+// point of the conversation.
+func (c *CipherState) Rekey() {
+	c.cs.Rekey()
+}
+
+// SetNonce sets the nonce used by the next call to Encrypt or Decrypt. This
+// is useful with transports that can lose or re-order messages (UDP): the
+// nonce can then be sent explicitly along with each message. Reusing a nonce
+// with the same key breaks the security of the cipher.
+func (c *CipherState) SetNonce(n uint64) {
+	c.cs.n = n
+}
+
+// Nonce returns the nonce used by the next call to Encrypt or Decrypt.
+func (c *CipherState) Nonce() uint64 {
+	return c.cs.n
+}
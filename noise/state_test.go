@@ -0,0 +1,204 @@
+package noise
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// runHandshakeStates runs a handshake between two HandshakeStates and
+// returns the cipher states of the initiator and of the responder
+func runHandshakeStates(t *testing.T, initiator, responder *HandshakeState) (initiatorCS, responderCS [2]*CipherState) {
+	writer, reader := initiator, responder
+	for idx := 0; ; idx++ {
+		payload := []byte{byte(idx)}
+		message, cs1, cs2, err := writer.WriteMessage(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		received, rcs1, rcs2, err := reader.ReadMessage(message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(received, payload) {
+			t.Fatalf("message %d has the wrong payload", idx)
+		}
+		if (cs1 == nil) != (rcs1 == nil) {
+			t.Fatal("only one peer completed the handshake")
+		}
+		if cs1 != nil {
+			if writer == initiator {
+				return [2]*CipherState{cs1, cs2}, [2]*CipherState{rcs1, rcs2}
+			}
+			return [2]*CipherState{rcs1, rcs2}, [2]*CipherState{cs1, cs2}
+		}
+		writer, reader = reader, writer
+	}
+}
+
+func TestHandshakeState(t *testing.T) {
+	initiatorKeyPair := GenerateKeypair(nil)
+	responderKeyPair := GenerateKeypair(nil)
+	psk := bytes.Repeat([]byte{1}, 32)
+
+	initiator, err := NewHandshakeState(&Config{
+		ProtocolName: "Noise_XXpsk3_25519_ChaChaPoly_BLAKE2s",
+		Initiator:    true,
+		KeyPair:      initiatorKeyPair,
+		PreSharedKey: psk,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	responder, err := NewHandshakeState(&Config{
+		ProtocolName: "Noise_XXpsk3_25519_ChaChaPoly_BLAKE2s",
+		KeyPair:      responderKeyPair,
+		PreSharedKey: psk,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if initiator.PatternName() != "XXpsk3" {
+		t.Fatal("unexpected pattern name", initiator.PatternName())
+	}
+
+	// out of turn calls return errors
+	if _, _, _, err := responder.WriteMessage(nil); err == nil {
+		t.Fatal("the responder should not be able to write first")
+	}
+	if _, _, _, err := initiator.ReadMessage(nil); err == nil {
+		t.Fatal("the initiator should not be able to read first")
+	}
+
+	initiatorCS, responderCS := runHandshakeStates(t, initiator, responder)
+	if !bytes.Equal(initiator.RemoteStatic(), responderKeyPair.PublicKey) || !bytes.Equal(responder.RemoteStatic(), initiatorKeyPair.PublicKey) {
+		t.Fatal("static keys were not exchanged")
+	}
+	if _, _, _, err := initiator.WriteMessage(nil); err == nil {
+		t.Fatal("a complete handshake should not write more messages")
+	}
+	if !bytes.Equal(initiator.HandshakeHash(), responder.HandshakeHash()) {
+		t.Fatal("the handshake hashes do not match")
+	}
+
+	// transport messages
+	ciphertext, err := initiatorCS[0].Encrypt(nil, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := responderCS[0].Decrypt(nil, ciphertext)
+	if err != nil || !bytes.Equal(plaintext, []byte("hello")) {
+		t.Fatal("initiator to responder message failed")
+	}
+	ciphertext, err = responderCS[1].Encrypt([]byte("ad"), []byte("ca va?"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = initiatorCS[1].Decrypt(nil, ciphertext); err == nil {
+		t.Fatal("decryption should fail with the wrong additional data")
+	}
+	plaintext, err = initiatorCS[1].Decrypt([]byte("ad"), ciphertext)
+	if err != nil || !bytes.Equal(plaintext, []byte("ca va?")) {
+		t.Fatal("responder to initiator message failed")
+	}
+
+	// out of order messages with explicit nonces
+	first, _ := initiatorCS[0].Encrypt(nil, []byte("first"))
+	second, _ := initiatorCS[0].Encrypt(nil, []byte("second"))
+	responderCS[0].SetNonce(initiatorCS[0].Nonce() - 1)
+	if plaintext, err = responderCS[0].Decrypt(nil, second); err != nil || !bytes.Equal(plaintext, []byte("second")) {
+		t.Fatal("second message failed")
+	}
+	responderCS[0].SetNonce(initiatorCS[0].Nonce() - 2)
+	if plaintext, err = responderCS[0].Decrypt(nil, first); err != nil || !bytes.Equal(plaintext, []byte("first")) {
+		t.Fatal("first message failed")
+	}
+
+	// rekey
+	responderCS[0].SetNonce(initiatorCS[0].Nonce())
+	initiatorCS[0].Rekey()
+	ciphertext, _ = initiatorCS[0].Encrypt(nil, []byte("rekeyed"))
+	if _, err = responderCS[0].Decrypt(nil, ciphertext); err == nil {
+		t.Fatal("decryption should fail if only one peer rekeyed")
+	}
+	responderCS[0].Rekey()
+	if plaintext, err = responderCS[0].Decrypt(nil, ciphertext); err != nil || !bytes.Equal(plaintext, []byte("rekeyed")) {
+		t.Fatal("rekeyed message failed")
+	}
+}
+
+func TestHandshakeStateErrors(t *testing.T) {
+	// missing keys and pre-shared keys
+	if _, err := NewHandshakeState(&Config{HandshakePattern: Noise_NK, Initiator: true}); err == nil {
+		t.Fatal("a NK initiator needs the responder's static key")
+	}
+	if _, err := NewHandshakeState(&Config{HandshakePattern: Noise_XX, Initiator: true}); err == nil {
+		t.Fatal("a XX initiator needs a static key")
+	}
+	if _, err := NewHandshakeState(&Config{HandshakePattern: Noise_NNpsk2}); err == nil {
+		t.Fatal("NNpsk2 needs a pre-shared key")
+	}
+
+	// the ephemeral key of a pre-message cannot be given
+	for _, initiator := range []bool{true, false} {
+		fallback := &Config{ProtocolName: "Noise_XXfallback_25519_ChaChaPoly_SHA256", KeyPair: GenerateKeypair(nil), Initiator: initiator}
+		_, err := NewHandshakeState(fallback)
+		if !errors.Is(err, ErrConfig) || !strings.Contains(err.Error(), "previous handshake") {
+			t.Fatal("XXfallback should be refused with an ErrConfig, got", err)
+		}
+	}
+
+	// a modified message makes the handshake fail for good
+	responderKeyPair := GenerateKeypair(nil)
+	initiator, _ := NewHandshakeState(&Config{HandshakePattern: Noise_NK, Initiator: true, RemoteKey: responderKeyPair.PublicKey})
+	responder, _ := NewHandshakeState(&Config{HandshakePattern: Noise_NK, KeyPair: responderKeyPair})
+	message, _, _, err := initiator.WriteMessage([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	message[len(message)-1] ^= 1
+	if _, _, _, err = responder.ReadMessage(message); err == nil {
+		t.Fatal("a modified message should not be accepted")
+	}
+	message[len(message)-1] ^= 1
+	if _, _, _, err = responder.ReadMessage(message); err == nil {
+		t.Fatal("a failed handshake should not continue")
+	}
+}
+
+func TestHandshakeStateOneWay(t *testing.T) {
+	initiatorKeyPair := GenerateKeypair(nil)
+	responderKeyPair := GenerateKeypair(nil)
+	for _, pattern := range []string{"N", "K", "X"} {
+		protocolName := "Noise_" + pattern + "_25519_ChaChaPoly_SHA256"
+		initiator, err := NewHandshakeState(&Config{
+			ProtocolName: protocolName,
+			Initiator:    true,
+			KeyPair:      initiatorKeyPair,
+			RemoteKey:    responderKeyPair.PublicKey,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		responder, err := NewHandshakeState(&Config{
+			ProtocolName: protocolName,
+			KeyPair:      responderKeyPair,
+			RemoteKey:    initiatorKeyPair.PublicKey,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		initiatorCS, responderCS := runHandshakeStates(t, initiator, responder)
+		if initiatorCS[0] == nil || responderCS[0] == nil || initiatorCS[1] != nil || responderCS[1] != nil {
+			t.Fatalf("%s should only return the CipherState from the initiator to the responder", pattern)
+		}
+		ciphertext, err := initiatorCS[0].Encrypt(nil, []byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if plaintext, err := responderCS[0].Decrypt(nil, ciphertext); err != nil || string(plaintext) != "hello" {
+			t.Fatalf("%s: the responder cannot decrypt the transport message", pattern)
+		}
+	}
+}
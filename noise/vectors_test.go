@@ -8,8 +8,6 @@ import (
 	"io/ioutil"
 	"os"
 	"testing"
-
-	"golang.org/x/crypto/curve25519"
 )
 
 //
@@ -61,8 +59,10 @@ type vector struct {
 	respEphemeral    []byte
 	respRemoteStatic []byte
 
-	initPsks []byte
-	respPsks []byte
+	initPsks [][]byte
+	respPsks [][]byte
+
+	handshakeHash []byte
 
 	messages []message
 }
@@ -94,10 +94,15 @@ func init() {
 		respStatic, _ := hex.DecodeString(hexVector.RespStatic)
 		respEphemeral, _ := hex.DecodeString(hexVector.RespEphemeral)
 		respRemoteStatic, _ := hex.DecodeString(hexVector.RespRemoteStatic)
-		var initPsks, respPsks []byte
-		if len(hexVector.InitPsks) > 0 {
-			initPsks, _ = hex.DecodeString(hexVector.InitPsks[0])
-			respPsks, _ = hex.DecodeString(hexVector.RespPsks[0])
+		handshakeHash, _ := hex.DecodeString(hexVector.HandshakeHash)
+		var initPsks, respPsks [][]byte
+		for _, hexPsk := range hexVector.InitPsks {
+			psk, _ := hex.DecodeString(hexPsk)
+			initPsks = append(initPsks, psk)
+		}
+		for _, hexPsk := range hexVector.RespPsks {
+			psk, _ := hex.DecodeString(hexPsk)
+			respPsks = append(respPsks, psk)
 		}
 		messages := make([]message, len(hexVector.Messages))
 		for idx, hexMessage := range hexVector.Messages {
@@ -116,6 +121,7 @@ func init() {
 			respRemoteStatic: respRemoteStatic,
 			initPsks:         initPsks,
 			respPsks:         respPsks,
+			handshakeHash:    handshakeHash,
 			messages:         messages,
 		}
 		testVectors[hexVector.ProtocolName] = byteVector
@@ -128,33 +134,85 @@ func init() {
 // Test the following patterns
 //
 
-var patternsToTest = []struct {
-	protocolName string
-	patternName  noiseHandshakeType
-}{
-	{"Noise_N_25519_ChaChaPoly_SHA256", Noise_N},
-	{"Noise_X_25519_ChaChaPoly_SHA256", Noise_X},
-	{"Noise_K_25519_ChaChaPoly_SHA256", Noise_K},
-	{"Noise_KK_25519_ChaChaPoly_SHA256", Noise_KK},
-	{"Noise_NX_25519_ChaChaPoly_SHA256", Noise_NX},
-	{"Noise_NK_25519_ChaChaPoly_SHA256", Noise_NK},
-	{"Noise_XX_25519_ChaChaPoly_SHA256", Noise_XX},
-	{"Noise_KX_25519_ChaChaPoly_SHA256", Noise_KX},
-	{"Noise_XK_25519_ChaChaPoly_SHA256", Noise_XK},
-	{"Noise_IK_25519_ChaChaPoly_SHA256", Noise_IK},
-	{"Noise_IX_25519_ChaChaPoly_SHA256", Noise_IX},
-	{"Noise_NNpsk2_25519_ChaChaPoly_SHA256", Noise_NNpsk2},
+// patterns with modifiers are derived from their base pattern
+var patternsToTest = []string{
+	"N",
+	"X",
+	"K",
+	"KK",
+	"NX",
+	"NK",
+	"XX",
+	"KX",
+	"XK",
+	"IK",
+	"IX",
+	"NN",
+	"KN",
+	"XN",
+	"IN",
+	"Npsk0",
+	"Kpsk0",
+	"Xpsk1",
+	"NNpsk0",
+	"NNpsk2",
+	"NKpsk0",
+	"NKpsk2",
+	"NXpsk2",
+	"XNpsk3",
+	"XKpsk3",
+	"XXpsk3",
+	"KNpsk0",
+	"KNpsk2",
+	"KKpsk0",
+	"KKpsk2",
+	"KXpsk2",
+	"INpsk1",
+	"INpsk2",
+	"IKpsk1",
+	"IKpsk2",
+	"IXpsk2",
+}
+
+var dhsToTest = []noiseDHType{
+	DH25519,
+	DH448,
+}
+
+var ciphersToTest = []noiseCipherType{
+	CipherChaChaPoly,
+	CipherAESGCM,
+}
+
+var hashesToTest = []noiseHashType{
+	HashSHA256,
+	HashSHA512,
+	HashBLAKE2s,
+	HashBLAKE2b,
 }
 
 func TestPatterns(t *testing.T) {
-	for _, pattern := range patternsToTest {
-		testVector := testVectors[pattern.protocolName]
-		initiator, responder := setupInitiatorAndResponder(pattern.patternName, testVector)
-		oneWayPattern := false
-		if pn := pattern.patternName; pn == Noise_N || pn == Noise_K || pn == Noise_X {
-			oneWayPattern = true
+	for _, patternName := range patternsToTest {
+		for _, dhType := range dhsToTest {
+			for _, cipherType := range ciphersToTest {
+				for _, hashType := range hashesToTest {
+					protocolName := "Noise_" + patternName + "_" + dhs[dhType].name + "_" + ciphers[cipherType].name + "_" + hashes[hashType].name
+					testVector, ok := testVectors[protocolName]
+					if !ok {
+						t.Fatalf("no test vector found for %s", protocolName)
+					}
+					protocol, err := parseProtocolName(protocolName)
+					if err != nil {
+						t.Fatal(err)
+					}
+					initiator, responder := setupInitiatorAndResponder(protocol, testVector)
+					goThroughTestVectors(t, protocolName, &initiator, &responder, testVector.messages, protocol.pattern.isOneWay())
+					if !bytes.Equal(initiator.symmetricState.h, testVector.handshakeHash) || !bytes.Equal(responder.symmetricState.h, testVector.handshakeHash) {
+						t.Fatalf("wrong handshake hash for %s", protocolName)
+					}
+				}
+			}
 		}
-		goThroughTestVectors(t, pattern.protocolName, &initiator, &responder, testVector.messages, oneWayPattern)
 	}
 }
 
@@ -162,54 +220,38 @@ func TestPatterns(t *testing.T) {
 // Core functions (title says everything)
 //
 
-func setupInitiatorAndResponder(patternName noiseHandshakeType, testVector vector) (handshakeState, handshakeState) {
+func setupInitiatorAndResponder(protocol protocol, testVector vector) (handshakeState, handshakeState) {
 	var init_s, init_rs, resp_s, resp_rs *KeyPair
 	// setup initiator static
 	if len(testVector.initStatic) > 0 {
-		var static KeyPair
-		copy(static.PrivateKey[:], testVector.initStatic)
-		curve25519.ScalarBaseMult(&static.PublicKey, &static.PrivateKey)
-		init_s = &static
+		init_s, _ = protocol.dh.generateKeypair(testVector.initStatic)
 	}
 	// setup initiator remote static
 	if len(testVector.initRemoteStatic) > 0 {
-		var static KeyPair
-		copy(static.PublicKey[:], testVector.initRemoteStatic)
-		init_rs = &static
+		init_rs = &KeyPair{PublicKey: testVector.initRemoteStatic}
 	}
 	// setup responder static
 	if len(testVector.respStatic) > 0 {
-		var static KeyPair
-		copy(static.PrivateKey[:], testVector.respStatic)
-		curve25519.ScalarBaseMult(&static.PublicKey, &static.PrivateKey)
-		resp_s = &static
+		resp_s, _ = protocol.dh.generateKeypair(testVector.respStatic)
 	}
 	// setup responder remote static
 	if len(testVector.respRemoteStatic) > 0 {
-		var static KeyPair
-		copy(static.PublicKey[:], testVector.respRemoteStatic)
-		resp_rs = &static
+		resp_rs = &KeyPair{PublicKey: testVector.respRemoteStatic}
 	}
-	// initialize(handshakeType, initiator, prologue, s, e, rs, re)
-	initiator := initialize(patternName, true, testVector.initPrologue, init_s, nil, init_rs, nil)
-	responder := initialize(patternName, false, testVector.respPrologue, resp_s, nil, resp_rs, nil)
+	// initialize(protocol, initiator, prologue, s, e, rs, re)
+	initiator, _ := initialize(protocol, true, testVector.initPrologue, init_s, nil, init_rs, nil)
+	responder, _ := initialize(protocol, false, testVector.respPrologue, resp_s, nil, resp_rs, nil)
 	// setup initiator ephemeral
 	if len(testVector.initEphemeral) > 0 {
-		var e KeyPair
-		copy(e.PrivateKey[:], testVector.initEphemeral)
-		curve25519.ScalarBaseMult(&e.PublicKey, &e.PrivateKey)
-		initiator.debugEphemeral = &e
+		initiator.debugEphemeral, _ = protocol.dh.generateKeypair(testVector.initEphemeral)
 	}
 	// setup responder ephemeral
 	if len(testVector.respEphemeral) > 0 {
-		var re KeyPair
-		copy(re.PrivateKey[:], testVector.respEphemeral)
-		curve25519.ScalarBaseMult(&re.PublicKey, &re.PrivateKey)
-		responder.debugEphemeral = &re
+		responder.debugEphemeral, _ = protocol.dh.generateKeypair(testVector.respEphemeral)
 	}
 	// setup psk
-	initiator.psk = testVector.initPsks
-	responder.psk = testVector.respPsks
+	initiator.psks = testVector.initPsks
+	responder.psks = testVector.respPsks
 	//
 	return initiator, responder
 }